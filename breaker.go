@@ -0,0 +1,94 @@
+package badgers3
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting S3 while the circuit breaker is open, see S3Opts.CircuitBreakerThreshold.
+var ErrCircuitOpen = errors.New("S3 circuit breaker is open after repeated failures")
+
+// defaultCircuitBreakerCooldown is used if CircuitBreakerCooldown is not set
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// circuitBreaker counts consecutive failed S3 requests and opens once there were threshold of them in a row.
+// After the cooldown a single operation is let through to probe S3, all others still fail. If its request succeeds,
+// the breaker closes, if it fails the breaker opens for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probeUntil is set while an operation probes S3 after the cooldown. Another probe is let through once it
+	// passed, in case the operation never sent a request.
+	probeUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrCircuitOpen while the breaker is open, or half open and probed by another operation.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+	if cb.failures < cb.threshold {
+		return nil
+	}
+	if now.Before(cb.openUntil) || now.Before(cb.probeUntil) {
+		return ErrCircuitOpen
+	}
+	cb.probeUntil = now.Add(cb.cooldown)
+	return nil
+}
+
+func (cb *circuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !failed {
+		cb.failures = 0
+		cb.probeUntil = time.Time{}
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		cb.probeUntil = time.Time{}
+	}
+}
+
+// breakerTransport reports the outcome of every request to the circuit breaker. Requests that fail because their
+// context is done don't count, neither do S3 errors below 500 such as a missing object.
+type breakerTransport struct {
+	base    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (bt *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := bt.base.RoundTrip(req)
+	switch {
+	case err != nil && (req.Context().Err() != nil || errors.Is(err, ErrRetryBudgetExhausted)):
+	case err != nil:
+		bt.breaker.record(true)
+	default:
+		bt.breaker.record(resp.StatusCode >= http.StatusInternalServerError)
+	}
+	return resp, err
+}
+
+// checkCircuit returns ErrCircuitOpen if S3 should not be contacted right now.
+// It is checked before each operation, as minio would retry requests failed by the transport.
+func (gs *S3Storage) checkCircuit() error {
+	if gs.breaker == nil {
+		return nil
+	}
+	return gs.breaker.allow()
+}
@@ -0,0 +1,216 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// One request per operation keeps the failures countable
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CircuitBreakerThreshold: 3, CircuitBreakerCooldown: 300 * time.Millisecond})
+	ctx := context.Background()
+	f.put("test/breaker/cert", []byte("cert"))
+
+	var down int32 = 1
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if atomic.LoadInt32(&down) == 1 {
+			writeFakeError(w, http.StatusInternalServerError, "InternalError")
+			return true
+		}
+		return false
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := gs.Stat(ctx, "breaker/cert"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected the S3 error, got %v", err)
+		}
+	}
+
+	heads := len(f.recorded(http.MethodHead, "test/breaker/cert"))
+	start := time.Now()
+	if _, err := gs.Stat(ctx, "breaker/cert"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if err := gs.Store(ctx, "breaker/cert", []byte("cert")); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("open breaker took %v to fail", d)
+	}
+	if n := len(f.recorded(http.MethodHead, "test/breaker/cert")); n != heads {
+		t.Error("open breaker contacted S3")
+	}
+
+	// Recovered, the first request after the cooldown closes the breaker
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(400 * time.Millisecond)
+	if _, err := gs.Stat(ctx, "breaker/cert"); err != nil {
+		t.Fatalf("stat after recovery failed: %v", err)
+	}
+	if err := gs.Store(ctx, "breaker/cert", []byte("cert")); err != nil {
+		t.Fatalf("store after recovery failed: %v", err)
+	}
+
+	// Missing objects are not failures
+	for i := 0; i < 5; i++ {
+		if _, err := gs.Stat(ctx, "breaker/missing"); errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("missing objects opened the breaker")
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CircuitBreakerThreshold: 1, CircuitBreakerCooldown: 200 * time.Millisecond})
+	ctx := context.Background()
+	f.put("test/breaker/cert", []byte("cert"))
+
+	var down int32 = 1
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		// Slow enough for all operations to be started while the probe is on its way
+		time.Sleep(100 * time.Millisecond)
+		if atomic.LoadInt32(&down) == 1 {
+			writeFakeError(w, http.StatusInternalServerError, "InternalError")
+			return true
+		}
+		return false
+	})
+	if _, err := gs.Stat(ctx, "breaker/cert"); err == nil {
+		t.Fatal("stat succeeded with S3 down")
+	}
+
+	// After the cooldown only a single operation probes S3
+	probe := func() (opened int32) {
+		time.Sleep(250 * time.Millisecond)
+		heads := len(f.recorded(http.MethodHead, "test/breaker/cert"))
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := gs.Stat(ctx, "breaker/cert"); errors.Is(err, ErrCircuitOpen) {
+					atomic.AddInt32(&opened, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := len(f.recorded(http.MethodHead, "test/breaker/cert")) - heads; n != 1 {
+			t.Errorf("expected a single probe, S3 got %d requests", n)
+		}
+		return opened
+	}
+	if opened := probe(); opened != 4 {
+		t.Errorf("expected all but the probe to fail with ErrCircuitOpen, %d did", opened)
+	}
+	// The failed probe opened the breaker for another cooldown
+	if _, err := gs.Stat(ctx, "breaker/cert"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen after the failed probe, got %v", err)
+	}
+
+	// A successful probe closes the breaker
+	atomic.StoreInt32(&down, 0)
+	probe()
+	for i := 0; i < 3; i++ {
+		if _, err := gs.Stat(ctx, "breaker/cert"); err != nil {
+			t.Errorf("stat after the successful probe failed: %v", err)
+		}
+	}
+}
+
+func TestGuards(t *testing.T) {
+	// One request per operation keeps the failures countable
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+
+	ops := []struct {
+		name string
+		call func(ctx context.Context, gs *S3Storage) error
+	}{
+		{"AuditEncryption", func(ctx context.Context, gs *S3Storage) error {
+			_, err := gs.AuditEncryption(ctx)
+			return err
+		}},
+		{"VerifyKey", func(ctx context.Context, gs *S3Storage) error {
+			return gs.VerifyKey(ctx, "guards/cert")
+		}},
+		{"SwitchEncryption", func(ctx context.Context, gs *S3Storage) error {
+			return gs.SwitchEncryption(ctx, &SecretBoxIO{})
+		}},
+		{"SwitchEncryptionWith", func(ctx context.Context, gs *S3Storage) error {
+			return gs.SwitchEncryptionWith(ctx, &SecretBoxIO{}, SwitchOptions{})
+		}},
+		{"BucketConfig", func(ctx context.Context, gs *S3Storage) error {
+			_, err := gs.BucketConfig(ctx)
+			return err
+		}},
+		{"ExistsMany", func(ctx context.Context, gs *S3Storage) error {
+			_, err := gs.ExistsMany(ctx, []string{"guards/a", "guards/b"})
+			return err
+		}},
+	}
+	for _, op := range ops {
+		t.Run(op.name, func(t *testing.T) {
+			checkGuards(t, op.name, op.call)
+		})
+	}
+}
+
+// checkGuards opens the breaker of a fresh storage, then calls the operation
+// with the breaker open and again after closing the storage.
+func checkGuards(t *testing.T, name string, call func(ctx context.Context, gs *S3Storage) error) {
+	t.Helper()
+	f := newFakeS3(t)
+	m := &recordingMetrics{}
+	gs := newTestStorage(t, f, S3Opts{Metrics: m, CircuitBreakerThreshold: 1, CircuitBreakerCooldown: time.Minute})
+	ctx := context.Background()
+
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		writeFakeError(w, http.StatusInternalServerError, "InternalError")
+		return true
+	})
+	if _, err := gs.Stat(ctx, "guards/cert"); err == nil {
+		t.Fatal("expected the S3 error")
+	}
+	m.take()
+
+	f.mu.Lock()
+	f.requests = nil
+	f.mu.Unlock()
+	if err := call(ctx, gs); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	f.mu.Lock()
+	n := len(f.requests)
+	f.mu.Unlock()
+	if n != 0 {
+		t.Errorf("expected no requests with the breaker open, got %d", n)
+	}
+
+	_ = gs.Close()
+	if err := call(ctx, gs); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	want := []string{name + ":circuit_open", name + ":closed"}
+	if got := m.take(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
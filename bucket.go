@@ -0,0 +1,107 @@
+package badgers3
+
+import (
+	"context"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// BucketConfig summarizes the bucket settings that change how stored certificates behave.
+type BucketConfig struct {
+	// Versioning is the raw versioning status of the bucket, "Enabled", "Suspended" or empty if it was never enabled.
+	Versioning string
+	// VersioningEnabled is true when deleted or overwritten objects are kept as noncurrent versions.
+	VersioningEnabled bool
+
+	// LifecycleRules lists all lifecycle rules configured on the bucket.
+	LifecycleRules []LifecycleRule
+	// ExpiresObjects is true when an enabled lifecycle rule expires objects under ObjPrefix or one of the
+	// IssuerPrefixes.
+	ExpiresObjects bool
+}
+
+// LifecycleRule is a summary of a single bucket lifecycle rule.
+type LifecycleRule struct {
+	ID      string
+	Prefix  string
+	Enabled bool
+
+	// ExpirationDays is the number of days after which current objects expire, zero if they don't.
+	ExpirationDays int
+	// NoncurrentExpirationDays is the number of days after which noncurrent versions expire, zero if they don't.
+	NoncurrentExpirationDays int
+}
+
+// BucketConfig reports the versioning and lifecycle configuration of the bucket.
+// With versioning enabled deletes are not permanent and with lifecycle rules certificates may expire behind CertMagic's back.
+func (gs *S3Storage) BucketConfig(ctx context.Context) (_ BucketConfig, err error) {
+	ctx, op := gs.startOp(ctx, "BucketConfig", "")
+	defer op.end(&err)
+	var bc BucketConfig
+	if err := gs.checkClosed(); err != nil {
+		return bc, err
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return bc, err
+	}
+
+	vc, err := gs.s3client.GetBucketVersioning(ctx, gs.bucket)
+	if err != nil {
+		return bc, err
+	}
+	bc.Versioning = vc.Status
+	bc.VersioningEnabled = vc.Enabled()
+
+	lc, err := gs.s3client.GetBucketLifecycle(ctx, gs.bucket)
+	if err != nil {
+		// A bucket without lifecycle rules reports an error instead of an empty configuration
+		if minio.ToErrorResponse(err).Code == "NoSuchLifecycleConfiguration" {
+			return bc, nil
+		}
+		return bc, err
+	}
+
+	for _, rule := range lc.Rules {
+		lr := LifecycleRule{
+			ID:                       rule.ID,
+			Prefix:                   lifecycleRulePrefix(rule),
+			Enabled:                  rule.Status == "Enabled",
+			ExpirationDays:           int(rule.Expiration.Days),
+			NoncurrentExpirationDays: int(rule.NoncurrentVersionExpiration.NoncurrentDays),
+		}
+		bc.LifecycleRules = append(bc.LifecycleRules, lr)
+
+		expires := lr.ExpirationDays > 0 || !rule.Expiration.Date.IsZero()
+		if lr.Enabled && expires && gs.lifecycleRuleApplies(lr.Prefix) {
+			bc.ExpiresObjects = true
+		}
+	}
+	return bc, nil
+}
+
+// lifecycleRuleApplies reports whether a rule on prefix covers objects under any of the prefixes we store objects
+// under. It does if either prefix contains the other. Our objects are below ObjPrefix/, a rule on "testing/" doesn't
+// apply to ObjPrefix "test", a rule on "te" does.
+func (gs *S3Storage) lifecycleRuleApplies(prefix string) bool {
+	for _, objPrefix := range gs.objPrefixes() {
+		ours := objPrefix + "/"
+		if strings.HasPrefix(ours, prefix) || strings.HasPrefix(prefix, ours) {
+			return true
+		}
+	}
+	return false
+}
+
+// lifecycleRulePrefix returns the prefix a rule applies to, which may be set in one of several places.
+func lifecycleRulePrefix(rule lifecycle.Rule) string {
+	switch {
+	case rule.RuleFilter.Prefix != "":
+		return rule.RuleFilter.Prefix
+	case rule.RuleFilter.And.Prefix != "":
+		return rule.RuleFilter.And.Prefix
+	default:
+		return rule.Prefix
+	}
+}
@@ -0,0 +1,104 @@
+package badgers3
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBucketConfig(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ObjPrefix: "certs"})
+
+	f.setSubresource("versioning", `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+	f.setSubresource("lifecycle", `<LifecycleConfiguration>
+		<Rule><ID>expire-certs</ID><Status>Enabled</Status><Filter><Prefix>certs/</Prefix></Filter><Expiration><Days>30</Days></Expiration></Rule>
+		<Rule><ID>old-logs</ID><Status>Disabled</Status><Filter><Prefix>logs/</Prefix></Filter><NoncurrentVersionExpiration><NoncurrentDays>7</NoncurrentDays></NoncurrentVersionExpiration></Rule>
+	</LifecycleConfiguration>`)
+
+	bc, err := gs.BucketConfig(context.Background())
+	if err != nil {
+		t.Fatalf("reading bucket config failed: %v", err)
+	}
+	if !bc.VersioningEnabled || bc.Versioning != "Enabled" {
+		t.Errorf("expected versioning to be enabled, got %q", bc.Versioning)
+	}
+	if !bc.ExpiresObjects {
+		t.Error("expected the expiring rule on the storage prefix to be reported")
+	}
+
+	want := []LifecycleRule{
+		{ID: "expire-certs", Prefix: "certs/", Enabled: true, ExpirationDays: 30},
+		{ID: "old-logs", Prefix: "logs/", NoncurrentExpirationDays: 7},
+	}
+	if len(bc.LifecycleRules) != len(want) {
+		t.Fatalf("expected %d rules, got %+v", len(want), bc.LifecycleRules)
+	}
+	for i := range want {
+		if bc.LifecycleRules[i] != want[i] {
+			t.Errorf("rule %d: expected %+v, got %+v", i, want[i], bc.LifecycleRules[i])
+		}
+	}
+}
+
+func TestBucketConfigWithoutLifecycle(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	f.setSubresource("versioning", `<VersioningConfiguration></VersioningConfiguration>`)
+
+	bc, err := gs.BucketConfig(context.Background())
+	if err != nil {
+		t.Fatalf("reading bucket config failed: %v", err)
+	}
+	if bc.VersioningEnabled || bc.ExpiresObjects || len(bc.LifecycleRules) != 0 {
+		t.Errorf("expected an empty config, got %+v", bc)
+	}
+}
+
+func TestBucketConfigPrefixBoundary(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ObjPrefix: "test"})
+
+	f.setSubresource("versioning", `<VersioningConfiguration></VersioningConfiguration>`)
+	f.setSubresource("lifecycle", `<LifecycleConfiguration>
+		<Rule><ID>expire-testing</ID><Status>Enabled</Status><Filter><Prefix>testing/</Prefix></Filter><Expiration><Days>30</Days></Expiration></Rule>
+	</LifecycleConfiguration>`)
+
+	bc, err := gs.BucketConfig(context.Background())
+	if err != nil {
+		t.Fatalf("reading bucket config failed: %v", err)
+	}
+	if bc.ExpiresObjects {
+		t.Error("expected a rule on a sibling prefix not to be reported")
+	}
+
+	f.setSubresource("lifecycle", `<LifecycleConfiguration>
+		<Rule><ID>expire-te</ID><Status>Enabled</Status><Filter><Prefix>te</Prefix></Filter><Expiration><Days>30</Days></Expiration></Rule>
+	</LifecycleConfiguration>`)
+
+	bc, err = gs.BucketConfig(context.Background())
+	if err != nil {
+		t.Fatalf("reading bucket config failed: %v", err)
+	}
+	if !bc.ExpiresObjects {
+		t.Error("expected a rule on a prefix of the storage prefix to be reported")
+	}
+}
+
+func TestBucketConfigIssuerPrefixes(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ObjPrefix: "test", IssuerPrefixes: map[string]string{"staging": "staging-certs"}})
+
+	f.setSubresource("versioning", `<VersioningConfiguration></VersioningConfiguration>`)
+	f.setSubresource("lifecycle", `<LifecycleConfiguration>
+		<Rule><ID>expire-staging</ID><Status>Enabled</Status><Filter><Prefix>staging-certs/</Prefix></Filter><Expiration><Days>7</Days></Expiration></Rule>
+	</LifecycleConfiguration>`)
+
+	bc, err := gs.BucketConfig(context.Background())
+	if err != nil {
+		t.Fatalf("reading bucket config failed: %v", err)
+	}
+	if !bc.ExpiresObjects {
+		t.Error("expected the expiring rule on an issuer prefix to be reported")
+	}
+}
@@ -0,0 +1,289 @@
+package badgers3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// bulkConcurrency bounds the number of S3 calls a bulk operation runs at once
+const bulkConcurrency = 8
+
+// LoadResult is the outcome of loading a single key with LoadMany.
+type LoadResult struct {
+	Key   string
+	Value []byte
+	Err   error
+}
+
+// LoadMany loads all keys concurrently and delivers each result as soon as it is available, in no particular order.
+// Loads go through the cache just like Load. The channel is closed once all keys were delivered or ctx is done.
+func (gs *S3Storage) LoadMany(ctx context.Context, keys []string) <-chan LoadResult {
+	results := make(chan LoadResult)
+
+	go func() {
+		defer close(results)
+
+		var (
+			wg  sync.WaitGroup
+			sem = make(chan struct{}, bulkConcurrency)
+		)
+		defer wg.Wait()
+
+		for _, key := range keys {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				buf, err := gs.Load(ctx, key)
+				select {
+				case results <- LoadResult{Key: key, Value: buf, Err: err}:
+				case <-ctx.Done():
+				}
+			}(key)
+		}
+	}()
+
+	return results
+}
+
+// ExistsMany reports for each of keys whether it exists. Cached keys are known to exist with CacheTrustCache like
+// they are for Exists, the others are checked with a single listing per prefix if they share a directory below it
+// that doesn't hold many more objects, and with concurrent HEADs otherwise.
+func (gs *S3Storage) ExistsMany(ctx context.Context, keys []string) (_ map[string]bool, err error) {
+	ctx, op := gs.startOp(ctx, "ExistsMany", "")
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(keys))
+	// Keys of issuers with a prefix of their own can't be found by listing another prefix
+	unknown := map[string][]string{}
+	for _, key := range keys {
+		if gs.cachePolicy == CacheTrustCache && gs.cache.isCacheEntryExistent(ctx, []byte(key)) {
+			exists[key] = true
+		} else {
+			unknown[gs.keyPrefix(key)] = append(unknown[gs.keyPrefix(key)], key)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return exists, nil
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return nil, err
+	}
+	for prefix, group := range unknown {
+		listed := false
+		if dir := commonDir(group); len(group) > 1 && dir != "" {
+			listed, err = gs.existsByListing(ctx, prefix, dir, group, exists)
+		}
+		if err == nil && !listed {
+			err = gs.existsByStat(ctx, group, exists)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return exists, nil
+}
+
+// existsListPerKey bounds the objects existsByListing lists to this many per key it checks
+const existsListPerKey = 10
+
+// existsByListing lists everything below dir under prefix once and looks keys up in the result. dir can lack an issuer
+// when keys of several issuers share a prefix, so it isn't resolved with objName. It gives up and returns false once
+// dir turns out to hold more than existsListPerKey objects per key, HEADs are cheaper then.
+func (gs *S3Storage) existsByListing(ctx context.Context, prefix, dir string, keys []string, exists map[string]bool) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// Stops the listing when giving up
+	defer cancel()
+
+	limit := existsListPerKey * len(keys)
+	listed := map[string]bool{}
+	for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix + "/" + dir,
+		Recursive: true,
+		MaxKeys:   limit + 1,
+	}) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		if len(listed) == limit {
+			return false, nil
+		}
+		listed[obj.Key] = true
+	}
+
+	for _, key := range keys {
+		exists[key] = listed[gs.objName(key)]
+	}
+	return true, nil
+}
+
+// existsByStat checks keys with at most bulkConcurrency concurrent HEADs.
+func (gs *S3Storage) existsByStat(ctx context.Context, keys []string, exists map[string]bool) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, bulkConcurrency)
+	)
+	for _, key := range keys {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			_, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), gs.statOptions())
+			if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			exists[key] = err == nil
+			mu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// ListAcross lists several prefixes like List does and merges the results, e.g. while keys are being moved from
+// one directory to another. Keys are returned once, in the order they were first listed, or sorted if
+// SortedList is set.
+func (gs *S3Storage) ListAcross(ctx context.Context, prefixes []string, recursive bool) ([]string, error) {
+	var (
+		keys []string
+		seen = map[string]bool{}
+	)
+	for _, prefix := range prefixes {
+		listed, err := gs.List(ctx, prefix, recursive)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range listed {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if gs.sortedList {
+		sort.Strings(keys)
+	}
+	return keys, nil
+}
+
+// commonDir returns the deepest directory, including the trailing slash, that contains all keys.
+// It is empty if the keys have no directory in common.
+func commonDir(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	prefix := keys[0]
+	for _, key := range keys[1:] {
+		for !strings.HasPrefix(key, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+// DeletePrefix deletes every object whose key starts with prefix, e.g. everything stored for a site, with
+// multi-object deletes of up to 1000 objects each, and drops them from the cache. Objects that can't be deleted
+// don't stop the others from being deleted, they are reported once all were tried.
+func (gs *S3Storage) DeletePrefix(ctx context.Context, prefix string) (err error) {
+	ctx, op := gs.startOp(ctx, "DeletePrefix", prefix)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	return gs.toMirrors(gs.deletePrefix(ctx, prefix), func(m *S3Storage) error {
+		return m.deletePrefix(ctx, prefix)
+	})
+}
+
+// deletePrefix deletes every object whose key starts with prefix from this storage's bucket.
+func (gs *S3Storage) deletePrefix(ctx context.Context, prefix string) error {
+	if err := gs.checkCircuit(); err != nil {
+		return err
+	}
+
+	// Maps object names to their keys, keys of different issuers may be stored under different prefixes
+	keys := map[string]string{}
+	for _, objPrefix := range gs.objPrefixes() {
+		for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
+			Prefix:    objPrefix + "/" + prefix,
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				return obj.Err
+			}
+			key := strings.TrimPrefix(obj.Key, objPrefix+"/")
+			// Objects of nested prefixes are handled with their own prefix
+			if gs.objName(key) != obj.Key {
+				continue
+			}
+			keys[obj.Key] = key
+		}
+	}
+
+	objects := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objects)
+		for name := range keys {
+			select {
+			case objects <- minio.ObjectInfo{Key: name}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var (
+		failed   = map[string]bool{}
+		firstErr error
+	)
+	for res := range gs.s3client.RemoveObjects(ctx, gs.bucket, objects, minio.RemoveObjectsOptions{}) {
+		failed[res.ObjectName] = true
+		if firstErr == nil {
+			firstErr = fmt.Errorf("deleting %s failed: %w", res.ObjectName, res.Err)
+		}
+	}
+
+	// Even a failed delete may have removed the object
+	for _, key := range keys {
+		gs.deleteCacheEntry(key)
+		gs.invalidateListings(key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d objects under %s could not be deleted: %w", len(failed), len(keys), prefix, firstErr)
+	}
+	return nil
+}
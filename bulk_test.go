@@ -0,0 +1,297 @@
+package badgers3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMany(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("many/%d", i)
+		keys = append(keys, key)
+		f.put("test/"+key, []byte("value-"+key))
+	}
+
+	got := map[string]string{}
+	for res := range gs.LoadMany(context.Background(), keys) {
+		if res.Err != nil {
+			t.Errorf("loading %s failed: %v", res.Key, res.Err)
+		}
+		got[res.Key] = string(res.Value)
+	}
+
+	if len(got) != len(keys) {
+		t.Fatalf("expected %d results, got %d", len(keys), len(got))
+	}
+	for _, key := range keys {
+		if got[key] != "value-"+key {
+			t.Errorf("wrong value for %s: %q", key, got[key])
+		}
+	}
+}
+
+func TestLoadManyCancel(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("many/%d", i)
+		keys = append(keys, key)
+		f.put("test/"+key, []byte("value"))
+	}
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		time.Sleep(50 * time.Millisecond)
+		return false
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := gs.LoadMany(ctx, keys)
+	<-results
+	cancel()
+
+	delivered := 1
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				if delivered == len(keys) {
+					t.Error("cancellation did not stop delivery")
+				}
+				return
+			}
+			delivered++
+		case <-timeout:
+			t.Fatal("results channel was not closed after cancellation")
+		}
+	}
+}
+
+func TestExistsMany(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	want := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("exists/example%d.com/cert", i)
+		want[key] = i%2 == 0
+		if want[key] {
+			f.put("test/"+key, []byte("cert"))
+		}
+	}
+	var keys []string
+	for key := range want {
+		keys = append(keys, key)
+	}
+
+	for _, tc := range []struct {
+		name string
+		keys []string
+	}{
+		{"shared directory", keys},
+		{"no shared directory", append([]string{"elsewhere"}, keys...)},
+	} {
+		f.mu.Lock()
+		f.requests = nil
+		f.mu.Unlock()
+
+		got, err := gs.ExistsMany(ctx, tc.keys)
+		if err != nil {
+			t.Fatalf("%s: ExistsMany failed: %v", tc.name, err)
+		}
+		for _, key := range tc.keys {
+			if got[key] != want[key] {
+				t.Errorf("%s: expected %s to exist: %v, got %v", tc.name, key, want[key], got[key])
+			}
+		}
+
+		f.mu.Lock()
+		n := len(f.requests)
+		f.mu.Unlock()
+		if tc.name == "shared directory" && n >= len(tc.keys) {
+			t.Errorf("%s: expected fewer requests than keys, got %d", tc.name, n)
+		}
+	}
+}
+
+func TestExistsManyIssuerPrefixes(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{IssuerPrefixes: map[string]string{"acme-a": "le"}})
+	f.put("le/certificates/acme-a/a.example.com/a.example.com.crt", []byte("cert"))
+	f.put("test/certificates/acme-b/b.example.com/b.example.com.crt", []byte("cert"))
+
+	want := map[string]bool{
+		"certificates/acme-a/a.example.com/a.example.com.crt": true,
+		"certificates/acme-a/a.example.com/a.example.com.key": false,
+		"certificates/acme-b/b.example.com/b.example.com.crt": true,
+		"certificates/acme-b/b.example.com/b.example.com.key": false,
+	}
+	var keys []string
+	for key := range want {
+		keys = append(keys, key)
+	}
+	got, err := gs.ExistsMany(context.Background(), keys)
+	if err != nil {
+		t.Fatalf("ExistsMany failed: %v", err)
+	}
+	for key, exists := range want {
+		if got[key] != exists {
+			t.Errorf("expected %s to exist: %v, got %v", key, exists, got[key])
+		}
+	}
+}
+
+func TestExistsManySharedIssuerPrefix(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{IssuerPrefixes: map[string]string{"acme-a": "le", "acme-b": "le"}})
+	f.put("le/certificates/acme-a/a.example.com/a.example.com.crt", []byte("cert"))
+	f.put("le/certificates/acme-b/b.example.com/b.example.com.crt", []byte("cert"))
+
+	// Both keys are stored under le, but their common dir certificates/ has no issuer
+	keys := []string{
+		"certificates/acme-a/a.example.com/a.example.com.crt",
+		"certificates/acme-b/b.example.com/b.example.com.crt",
+		"certificates/acme-b/b.example.com/b.example.com.key",
+	}
+	got, err := gs.ExistsMany(context.Background(), keys)
+	if err != nil {
+		t.Fatalf("ExistsMany failed: %v", err)
+	}
+	if !got[keys[0]] || !got[keys[1]] || got[keys[2]] {
+		t.Errorf("expected only the certificates to exist, got %v", got)
+	}
+	if len(f.recorded(http.MethodHead, "le/"+keys[2])) != 0 {
+		t.Error("expected the keys to be found by listing")
+	}
+}
+
+func TestExistsManyLargeDirectory(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	for i := 0; i < 50; i++ {
+		f.put(fmt.Sprintf("test/certificates/example%d.com/cert", i), []byte("cert"))
+	}
+
+	keys := []string{"certificates/example1.com/cert", "certificates/missing.com/cert"}
+	got, err := gs.ExistsMany(context.Background(), keys)
+	if err != nil {
+		t.Fatalf("ExistsMany failed: %v", err)
+	}
+	if !got[keys[0]] || got[keys[1]] {
+		t.Errorf("expected only %s to exist, got %v", keys[0], got)
+	}
+	// Two keys in a large directory are checked one by one instead of listing all of it
+	for _, key := range keys {
+		if n := len(f.recorded(http.MethodHead, "test/"+key)); n != 1 {
+			t.Errorf("expected 1 HEAD for %s, got %d", key, n)
+		}
+	}
+}
+
+func TestExistsManyCachePolicy(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CachePolicy: CacheRevalidate})
+	ctx := context.Background()
+	if err := gs.Store(ctx, "policy/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	f.remove("test/policy/cert")
+
+	got, err := gs.ExistsMany(ctx, []string{"policy/cert"})
+	if err != nil {
+		t.Fatalf("ExistsMany failed: %v", err)
+	}
+	if got["policy/cert"] != gs.Exists(ctx, "policy/cert") {
+		t.Errorf("ExistsMany and Exists disagree: %v", got)
+	}
+}
+
+func TestListAcross(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{SortedList: true})
+	for _, key := range []string{"test/old/a", "test/old/b", "test/new/b", "test/new/c", "test/other/d"} {
+		f.put(key, []byte("value"))
+	}
+
+	// The prefixes overlap, old/a is listed twice
+	keys, err := gs.ListAcross(context.Background(), []string{"old/", "new/", "old/a"}, true)
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	want := []string{"new/b", "new/c", "old/a", "old/b"}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, keys)
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	keys := []string{"site/a", "site/b", "site/assets/c", "site/assets/d", "sites/e"}
+	for _, key := range keys {
+		if err := gs.Store(ctx, key, []byte("value")); err != nil {
+			t.Fatalf("storing %s failed: %v", key, err)
+		}
+		if _, err := gs.Stat(ctx, key); err != nil {
+			t.Fatalf("stat of %s failed: %v", key, err)
+		}
+	}
+
+	if err := gs.DeletePrefix(ctx, "site/"); err != nil {
+		t.Fatalf("deleting prefix failed: %v", err)
+	}
+	for _, key := range keys {
+		_, stored := f.get("test/" + key)
+		cached := gs.cache.isCacheEntryExistent(ctx, []byte(key)) || gs.cache.isCacheEntryExistent(ctx, []byte(key+"_ki"))
+		if want := key == "sites/e"; stored != want || cached != want {
+			t.Errorf("%s: expected stored and cached to be %v, got %v and %v", key, want, stored, cached)
+		}
+	}
+	if n := len(f.recorded(http.MethodDelete, "test/site/a")); n != 0 {
+		t.Errorf("expected a single multi-object delete, got %d DELETEs", n)
+	}
+
+	// Objects that can't be deleted are reported, the others are deleted anyway
+	for _, key := range []string{"bad/a", "bad/b", "bad/c"} {
+		f.put("test/"+key, []byte("value"))
+	}
+	f.undeletable["test/bad/b"] = true
+	err := gs.DeletePrefix(ctx, "bad/")
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") || !strings.Contains(err.Error(), "test/bad/b") {
+		t.Errorf("expected the failed object to be reported, got %v", err)
+	}
+	for key, want := range map[string]bool{"test/bad/a": false, "test/bad/b": true, "test/bad/c": false} {
+		if _, ok := f.get(key); ok != want {
+			t.Errorf("%s: expected it to exist to be %v", key, want)
+		}
+	}
+}
+
+func TestCommonDir(t *testing.T) {
+	for _, tc := range []struct {
+		keys []string
+		want string
+	}{
+		{[]string{"a/b/c", "a/b/d"}, "a/b/"},
+		{[]string{"a/bc", "a/bd"}, "a/"},
+		{[]string{"a/b", "c/d"}, ""},
+		{[]string{"a/b"}, "a/"},
+		{nil, ""},
+	} {
+		if got := commonDir(tc.keys); got != tc.want {
+			t.Errorf("%v: expected %q, got %q", tc.keys, tc.want, got)
+		}
+	}
+}
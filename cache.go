@@ -1,75 +1,479 @@
 package badgers3
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/caddyserver/certmagic"
 	"github.com/dgraph-io/badger"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// sharedCacheDB is a BadgerDB used by all storages with the same cache directory that don't bring their own.
+// It is opened by the first storage needing it and closed once the last one is closed. Its value log GC runs once
+// for all of them, from opening to closing the DB.
+type sharedCacheDB struct {
+	db   *badger.DB
+	refs int
+	// gcStop and gcDone are set while the GC runs
+	gcStop, gcDone chan struct{}
+}
+
 var (
-	db = getCacheDb()
+	// sharedDBMu guards sharedDBs
+	sharedDBMu sync.Mutex
+	// sharedDBs maps cache directories to their open DB
+	sharedDBs = map[string]*sharedCacheDB{}
 )
 
-// handleError will attempt to handle and show any errors thrown by BadgerDB
-func handleCacheError(err error) {
-	if err != nil {
+// acquireSharedDB returns the shared cache in dir, opening it if nobody uses it yet. It must be released with
+// releaseSharedDB. If recreate is set and it has to be opened, a corrupt cache is wiped and created from scratch.
+// Opening it starts the GC every gcInterval if that is positive.
+func acquireSharedDB(dir string, recreate bool, gcInterval time.Duration, logger *slog.Logger) (*badger.DB, error) {
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	shared, ok := sharedDBs[dir]
+	if !ok {
+		db, err := openCacheDB(dir, recreate, logger)
+		if err != nil {
+			return nil, fmt.Errorf("opening cache in %s failed, check that no other process uses it: %w", dir, err)
+		}
+		shared = &sharedCacheDB{db: db}
+		if gcInterval > 0 {
+			shared.gcStop, shared.gcDone = make(chan struct{}), make(chan struct{})
+			go collectCacheGarbage(db, dir, gcInterval, shared.gcStop, shared.gcDone, logger)
+		}
+		sharedDBs[dir] = shared
+	}
+	shared.refs++
+	return shared.db, nil
+}
+
+// releaseSharedDB gives up a reference taken by acquireSharedDB and stops the GC and closes the shared cache in dir
+// if it was the last one.
+func releaseSharedDB(dir string) error {
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	shared := sharedDBs[dir]
+	if shared.refs--; shared.refs > 0 {
+		return nil
+	}
+	delete(sharedDBs, dir)
+	if shared.gcStop != nil {
+		close(shared.gcStop)
+		<-shared.gcDone
+	}
+	return shared.db.Close()
+}
+
+// handleError reports an error returned by BadgerDB for op on key to the error handler. A missing key is not
+// an error, the cache is just cold, and neither is giving up on the cache because the caller's context is done.
+func (c *cache) handleError(op string, key []byte, err error) {
+	if err == nil || errors.Is(err, badger.ErrKeyNotFound) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 		return
 	}
+	c.onError(fmt.Errorf("cache %s of %q failed: %w", op, key, err))
+}
+
+// ErrCacheDisabled is returned by ExportCache and ImportCache if S3Opts.DisableCache is set.
+var ErrCacheDisabled = errors.New("the cache is disabled")
+
+// defaultErrorHandler logs errors that don't fail an operation
+func defaultErrorHandler(err error) {
+	slog.Default().Warn("Cache error", "error", err)
+}
+
+// fallbackCacheDir is used when there is no usable user cache directory
+const fallbackCacheDir = "/tmp/badger-s3"
+
+// defaultCacheDir returns the directory for the BadgerDB, which is badger-s3 inside the user cache directory
+// ($XDG_CACHE_HOME or ~/.cache on Linux) and /tmp/badger-s3 if that can't be used.
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		dir = filepath.Join(dir, "badger-s3")
+		// Badger only creates the last path element itself
+		if err := os.MkdirAll(dir, 0o700); err == nil {
+			return dir
+		}
+	}
+	return fallbackCacheDir
 }
 
-// getCacheDb will open a new BadgerDB for the current S3 instance
-func getCacheDb() *badger.DB {
-	db, err := badger.Open(badger.DefaultOptions("/tmp/badger-s3"))
+// exportTo writes a backup of all entries of the cache to w, including their expiry.
+func (c *cache) exportTo(w io.Writer) error {
+	if c.db == nil {
+		return ErrCacheDisabled
+	}
+	stream := c.db.NewStream()
+	stream.Prefix = c.namespace
+	stream.LogPrefix = "badger-s3 cache export"
+	_, err := stream.Backup(w, 0)
+	return err
+}
+
+// importFrom loads entries written by exportTo.
+func (c *cache) importFrom(r io.Reader) error {
+	if c.db == nil {
+		return ErrCacheDisabled
+	}
+	return c.db.Load(r, cacheImportPendingWrites)
+}
+
+// cacheImportPendingWrites bounds the writes in flight while importing a cache
+const cacheImportPendingWrites = 256
+
+// processCacheDirs counts the cache directories handed out by processCacheDir
+var processCacheDirs int32
+
+// processCacheDir returns a directory next to dir that no other process, and no other storage in this process,
+// uses. Its name carries the host name and PID, so that leftovers can be told apart.
+func processCacheDir(dir string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%s-%d-%d", dir, host, os.Getpid(), atomic.AddInt32(&processCacheDirs, 1))
+}
+
+// openTempCacheDB opens a BadgerDB in a new temporary directory, which is removed again if that fails.
+// This version of BadgerDB has no in-memory mode, so this is the closest to a cache that is private to the process.
+func openTempCacheDB() (*badger.DB, string, error) {
+	dir, err := os.MkdirTemp("", "badger-s3-")
 	if err != nil {
-		_ = fmt.Errorf("unable to open badgerdb, check that there isn't already an instance running")
+		return nil, "", err
+	}
+	db, err := badger.Open(badger.DefaultOptions(dir))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, "", err
+	}
+	return db, dir, nil
+}
+
+// openCacheDB opens the BadgerDB in dir. Failing for any other reason than another process using it means the
+// directory is damaged, e.g. by an unclean shutdown. If recreate is set, it is then wiped and the DB created from
+// scratch, the cache just has to be warmed up from S3 again.
+func openCacheDB(dir string, recreate bool, logger *slog.Logger) (*badger.DB, error) {
+	db, err := badger.Open(badger.DefaultOptions(dir))
+	if err == nil || strings.Contains(err.Error(), "Cannot acquire directory lock") {
+		return db, err
 	}
 
-	return db
+	logger.Warn("Cache can't be opened, it may be corrupt", "dir", dir, "error", err)
+	if !recreate {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("removing corrupt cache in %s failed: %w", dir, err)
+	}
+	logger.Info("Recreating cache", "dir", dir)
+	return badger.Open(badger.DefaultOptions(dir))
 }
 
-// setCacheEntry will set an object into the Badger DB
-func setCacheEntry(key []byte, data []byte, ttl time.Duration) {
-	err := db.Update(func(txn *badger.Txn) error {
-		e := badger.NewEntry(key, data).WithTTL(ttl).WithDiscard()
-		err := txn.SetEntry(e)
-		handleCacheError(err)
+// cache is the part of a BadgerDB used by a single storage
+type cache struct {
+	// hits, misses and evictions are updated atomically and come first to be 64-bit aligned on 32-bit platforms
+	hits, misses, evictions int64
+
+	// db is nil if caching is disabled, every lookup then misses and writes are dropped
+	db *badger.DB
+	// namespace is prepended to all keys, so that several storages can share one DB
+	namespace []byte
+	// compress enables gzip compression of values
+	compress bool
+	// discardVersions marks older versions of an entry as discardable when it is overwritten
+	discardVersions bool
+	// onError is called with the errors of BadgerDB, which don't fail the operation using the cache
+	onError func(error)
+	// slidingTTL, if set, extends the expiry of an entry to this far in the future whenever it is read
+	slidingTTL time.Duration
+	// maxBytes, if set, is the size the cache is kept below by evicting the least recently used entries
+	maxBytes int64
 
+	// sizeMu guards size and sizeKnown
+	sizeMu sync.Mutex
+	// size is the approximate size of the cache, valid if sizeKnown
+	size      int64
+	sizeKnown bool
+}
+
+func newCache(db *badger.DB, namespace string) *cache {
+	c := &cache{db: db, onError: defaultErrorHandler}
+	if namespace != "" {
+		// The separator keeps namespaces from being prefixes of each other
+		c.namespace = append([]byte(namespace), 0)
+	}
+	return c
+}
+
+// key returns the BadgerDB key for a cache key
+func (c *cache) key(key []byte) []byte {
+	if c.namespace == nil {
+		return key
+	}
+	return append(append(make([]byte, 0, len(c.namespace)+len(key)), c.namespace...), key...)
+}
+
+// view runs fn in a read-only transaction like db.View, but returns ctx.Err() as soon as ctx is done instead of
+// waiting for a slow transaction. The transaction then finishes in the background and its result is dropped, so
+// fn must not write to anything the caller reads after an error.
+func (c *cache) view(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		// The context can't be done, no need for a goroutine
+		return c.db.View(fn)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.db.View(fn) }()
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setCacheEntry will set an object into the Badger DB. Entries with a TTL of zero or less never expire, BadgerDB
+// would consider them expired right away. Nothing is written if ctx is already done. Unlike reads, a write that
+// started is not abandoned, it could otherwise land after a later write or delete of the same key.
+func (c *cache) setCacheEntry(ctx context.Context, key []byte, data []byte, ttl time.Duration) {
+	if c.db == nil || ctx.Err() != nil {
+		return
+	}
+	data, meta := c.encodeValue(data)
+	err := c.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry(c.key(key), data).WithMeta(meta)
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		if c.discardVersions {
+			e = e.WithDiscard()
+		}
+		return txn.SetEntry(e)
 	})
 
-	handleCacheError(err)
+	c.handleError("write", key, err)
+	if err == nil && c.maxBytes > 0 {
+		c.grow(len(key) + len(data))
+	}
 }
 
-// getCacheEntry will return a cache entry as a string
-func getCacheEntry(key []byte) (model *string) {
-	var valCopy []byte
-	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		handleCacheError(err)
-
+// getCacheEntry will return a cache entry and whether there is one. Checking for the entry and fetching it is
+// a single lookup, so an entry expiring in between can't be reported as present without a value. It misses once ctx
+// is done.
+func (c *cache) getCacheEntry(ctx context.Context, key []byte) ([]byte, bool) {
+	if c.db == nil {
+		return nil, false
+	}
+	var (
+		valCopy   []byte
+		expiresAt uint64
+	)
+	err := c.view(ctx, func(txn *badger.Txn) error {
+		item, err := txn.Get(c.key(key))
 		if err == nil {
-			err = item.Value(func(val []byte) error {
-				valCopy = append([]byte{}, val...)
-				return nil
-			})
+			expiresAt = item.ExpiresAt()
+			valCopy, err = decodeValue(item)
 		}
 
 		return err
 	})
 
-	handleCacheError(err)
+	c.handleError("read", key, err)
 	if err == nil {
-		strVal := string(valCopy)
-		return &strVal
+		if c.maxBytes > 0 {
+			c.touch(key, expiresAt)
+		}
+		// Only rewrite the entry once half of the sliding window has passed, not on every read
+		if c.slidingTTL > 0 && expiresAt > 0 && time.Until(time.Unix(int64(expiresAt), 0)) < c.slidingTTL/2 {
+			c.setCacheEntry(ctx, key, valCopy, c.slidingTTL)
+		}
+
+		return valCopy, true
 	}
 
-	return nil
+	return nil, false
 }
 
-// isCacheEntryExistent will return true when the given key exists in the cache storage, false otherwise
-func isCacheEntryExistent(key []byte) bool {
-	err := db.View(func(txn *badger.Txn) error {
-		_, err := txn.Get(key)
+// getCacheEntryWithExpiry will return a cache entry together with the time it expires at.
+// The expiry is zero for entries without a TTL. It misses once ctx is done.
+func (c *cache) getCacheEntryWithExpiry(ctx context.Context, key []byte) ([]byte, time.Time, bool) {
+	if c.db == nil {
+		return nil, time.Time{}, false
+	}
+	var (
+		valCopy   []byte
+		expiresAt time.Time
+	)
+	err := c.view(ctx, func(txn *badger.Txn) error {
+		item, err := txn.Get(c.key(key))
+		if err != nil {
+			return err
+		}
+
+		if exp := item.ExpiresAt(); exp > 0 {
+			expiresAt = time.Unix(int64(exp), 0)
+		}
+		valCopy, err = decodeValue(item)
+		return err
+	})
+
+	c.handleError("read", key, err)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	if c.maxBytes > 0 {
+		var exp uint64
+		if !expiresAt.IsZero() {
+			exp = uint64(expiresAt.Unix())
+		}
+		c.touch(key, exp)
+	}
+	return valCopy, expiresAt, true
+}
+
+const (
+	// cacheMetaGzip is set in the user meta of entries whose value is gzip compressed
+	cacheMetaGzip byte = 1 << 0
+	// cacheMetaStamped is set in the user meta of entries whose value starts with the time it was written at
+	cacheMetaStamped byte = 1 << 1
+)
+
+// cacheStampLen is the length of the write time in front of stamped values, unix nanoseconds in big endian
+const cacheStampLen = 8
+
+// encodeValue compresses data if compression is enabled and actually makes it smaller and puts the current
+// time in front of it. It returns the value to store and the user meta describing it.
+func (c *cache) encodeValue(data []byte) ([]byte, byte) {
+	meta := cacheMetaStamped
+	if c.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err == nil && buf.Len() < len(data) {
+			data = buf.Bytes()
+			meta |= cacheMetaGzip
+		}
+	}
+
+	out := make([]byte, cacheStampLen, cacheStampLen+len(data))
+	binary.BigEndian.PutUint64(out, uint64(time.Now().UnixNano()))
+	return append(out, data...), meta
+}
+
+// decodeValue returns a copy of the value of item, without the write time and decompressed if necessary.
+func decodeValue(item *badger.Item) ([]byte, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	if item.UserMeta()&cacheMetaStamped != 0 {
+		if len(val) < cacheStampLen {
+			return nil, errInvalidCacheEntry
+		}
+		val = val[cacheStampLen:]
+	}
+	if item.UserMeta()&cacheMetaGzip == 0 {
+		return val, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(val))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+var errInvalidCacheEntry = errors.New("invalid cache entry")
+
+// getCacheEntryInfo returns when the entry for key was written and when it expires.
+// The write time is zero for entries written by older versions, the expiry for entries without a TTL.
+func (c *cache) getCacheEntryInfo(key []byte) (written, expiresAt time.Time, ok bool) {
+	if c.db == nil {
+		return
+	}
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(c.key(key))
+		if err != nil {
+			return err
+		}
+
+		if exp := item.ExpiresAt(); exp > 0 {
+			expiresAt = time.Unix(int64(exp), 0)
+		}
+		if item.UserMeta()&cacheMetaStamped == 0 {
+			return nil
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) < cacheStampLen {
+				return errInvalidCacheEntry
+			}
+			written = time.Unix(0, int64(binary.BigEndian.Uint64(val)))
+			return nil
+		})
+	})
+
+	c.handleError("read", key, err)
+	return written, expiresAt, err == nil
+}
+
+// cacheHealthKey is the key of the entry written by check
+const cacheHealthKey = ".badger-s3-health"
+
+// check writes an entry and reads it back, returning the error of BadgerDB if either fails. A disabled cache is
+// always fine.
+func (c *cache) check(ctx context.Context) error {
+	if c.db == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	want := []byte(time.Now().Format(time.RFC3339Nano))
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(c.key([]byte(cacheHealthKey)), want).WithTTL(time.Minute))
+	})
+	if err != nil {
+		return err
+	}
+	return c.view(ctx, func(txn *badger.Txn) error {
+		item, err := txn.Get(c.key([]byte(cacheHealthKey)))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if !bytes.Equal(val, want) {
+				return errInvalidCacheEntry
+			}
+			return nil
+		})
+	})
+}
+
+// isCacheEntryExistent will return true when the given key exists in the cache storage, false otherwise or once
+// ctx is done
+func (c *cache) isCacheEntryExistent(ctx context.Context, key []byte) bool {
+	if c.db == nil {
+		return false
+	}
+	err := c.view(ctx, func(txn *badger.Txn) error {
+		_, err := txn.Get(c.key(key))
 		return err
 	})
 
@@ -77,3 +481,118 @@ func isCacheEntryExistent(key []byte) bool {
 	// Otherwise the key does not exist
 	return err == nil
 }
+
+// deleteCacheEntry removes the entry for key, if there is one
+func (c *cache) deleteCacheEntry(key []byte) {
+	if c.db == nil {
+		return
+	}
+	err := c.db.Update(func(txn *badger.Txn) error {
+		if c.maxBytes > 0 {
+			if err := txn.Delete(c.key(accessKey(key))); err != nil {
+				return err
+			}
+		}
+		return txn.Delete(c.key(key))
+	})
+
+	c.handleError("delete", key, err)
+}
+
+// keyInfoFormatV1 marks a KeyInfo cache entry in the binary format written by encodeKeyInfo.
+// Entries written by older versions are JSON and therefore start with '{'.
+const keyInfoFormatV1 = 1
+
+// encodeKeyInfo serializes a KeyInfo for the stat cache, the layout is:
+// version (1 byte) | size (8 bytes) | terminal (1 byte) | modified length (1 byte) | modified | key
+func encodeKeyInfo(ki certmagic.KeyInfo) ([]byte, error) {
+	modified, err := ki.Modified.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 11, 11+len(modified)+len(ki.Key))
+	buf[0] = keyInfoFormatV1
+	binary.BigEndian.PutUint64(buf[1:9], uint64(ki.Size))
+	if ki.IsTerminal {
+		buf[9] = 1
+	}
+	buf[10] = byte(len(modified))
+	buf = append(buf, modified...)
+	buf = append(buf, ki.Key...)
+	return buf, nil
+}
+
+// decodeKeyInfo deserializes a KeyInfo written by encodeKeyInfo or, for older entries, as JSON.
+func decodeKeyInfo(buf []byte) (certmagic.KeyInfo, error) {
+	var ki certmagic.KeyInfo
+	if len(buf) == 0 {
+		return ki, errors.New("empty key info")
+	}
+
+	switch buf[0] {
+	case '{':
+		err := json.Unmarshal(buf, &ki)
+		return ki, err
+	case keyInfoFormatV1:
+		if len(buf) < 11 || len(buf) < 11+int(buf[10]) {
+			return ki, errors.New("truncated key info")
+		}
+		ki.Size = int64(binary.BigEndian.Uint64(buf[1:9]))
+		ki.IsTerminal = buf[9] == 1
+		end := 11 + int(buf[10])
+		if err := ki.Modified.UnmarshalBinary(buf[11:end]); err != nil {
+			return ki, err
+		}
+		ki.Key = string(buf[end:])
+		return ki, nil
+	default:
+		return ki, fmt.Errorf("unknown key info format %d", buf[0])
+	}
+}
+
+// defaultCacheGCInterval is the time between two value log garbage collections unless S3Opts.CacheGCInterval is set
+const defaultCacheGCInterval = 10 * time.Minute
+
+// cacheGCDiscardRatio is the share of a value log file that must be garbage for the GC to rewrite it
+const cacheGCDiscardRatio = 0.5
+
+// runCacheGC rewrites the value log files of db in dir that are mostly garbage, i.e. expired, deleted or
+// overwritten entries, and returns the number of bytes reclaimed.
+func runCacheGC(db *badger.DB, dir string) int64 {
+	before := valueLogSize(dir)
+	// Every run rewrites at most one file, keep going until none is worth it
+	for db.RunValueLogGC(cacheGCDiscardRatio) == nil {
+	}
+	return before - valueLogSize(dir)
+}
+
+// valueLogSize returns the size of the value log files in dir. BadgerDB's own figure is only updated once a minute.
+func valueLogSize(dir string) int64 {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	var size int64
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// collectCacheGarbage runs the value log GC of db in dir every interval until stop is closed, then closes done.
+func collectCacheGarbage(db *badger.DB, dir string, interval time.Duration, stop <-chan struct{}, done chan<- struct{}, logger *slog.Logger) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if reclaimed := runCacheGC(db, dir); reclaimed > 0 {
+			logger.Debug("Cache GC reclaimed space", "dir", dir, "bytes", reclaimed)
+		}
+	}
+}
@@ -0,0 +1,689 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/dgraph-io/badger"
+)
+
+var testKeyInfo = certmagic.KeyInfo{
+	Key:        "certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+	Modified:   time.Date(2022, 11, 3, 12, 30, 15, 500, time.UTC),
+	Size:       3742,
+	IsTerminal: true,
+}
+
+func TestKeyInfoEncoding(t *testing.T) {
+	buf, err := encodeKeyInfo(testKeyInfo)
+	if err != nil {
+		t.Fatalf("encoding failed: %v", err)
+	}
+	ki, err := decodeKeyInfo(buf)
+	if err != nil {
+		t.Fatalf("decoding failed: %v", err)
+	}
+	if ki.Key != testKeyInfo.Key || ki.Size != testKeyInfo.Size || ki.IsTerminal != testKeyInfo.IsTerminal || !ki.Modified.Equal(testKeyInfo.Modified) {
+		t.Errorf("round trip changed the key info: %+v", ki)
+	}
+
+	// Entries cached by older versions are JSON
+	legacy, _ := json.Marshal(testKeyInfo)
+	ki, err = decodeKeyInfo(legacy)
+	if err != nil {
+		t.Fatalf("decoding legacy entry failed: %v", err)
+	}
+	if ki.Key != testKeyInfo.Key || !ki.Modified.Equal(testKeyInfo.Modified) {
+		t.Errorf("legacy entry decoded wrongly: %+v", ki)
+	}
+
+	if _, err := decodeKeyInfo(buf[:5]); err == nil {
+		t.Error("expected an error for a truncated entry")
+	}
+}
+
+func BenchmarkKeyInfoJSON(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		buf, _ := json.Marshal(testKeyInfo)
+		var ki certmagic.KeyInfo
+		_ = json.Unmarshal(buf, &ki)
+	}
+}
+
+func BenchmarkKeyInfoBinary(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		buf, _ := encodeKeyInfo(testKeyInfo)
+		_, _ = decodeKeyInfo(buf)
+	}
+}
+
+func TestDefaultCacheDir(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdg)
+	if got, want := defaultCacheDir(), filepath.Join(xdg, "badger-s3"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	t.Setenv("XDG_CACHE_HOME", "")
+	t.Setenv("HOME", "")
+	if got := defaultCacheDir(); got != fallbackCacheDir {
+		t.Errorf("expected the fallback %s, got %s", fallbackCacheDir, got)
+	}
+}
+
+func TestCachePerProcess(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	f := newFakeS3(t)
+
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		gs, err := NewS3Storage(S3Opts{
+			Endpoint:        f.endpoint(),
+			Bucket:          f.bucket,
+			AccessKeyID:     "test-key",
+			SecretAccessKey: "test-secret",
+			CachePerProcess: true,
+		})
+		if err != nil {
+			t.Fatalf("creating storage failed: %v", err)
+		}
+		t.Cleanup(func() { gs.Close() })
+
+		if !strings.HasPrefix(gs.cacheDir, defaultCacheDir()+"-") {
+			t.Errorf("expected a directory next to %s, got %s", defaultCacheDir(), gs.cacheDir)
+		}
+		gs.cache.setCacheEntry(context.Background(), []byte("key"), []byte("value"), time.Hour)
+		dirs = append(dirs, gs.cacheDir)
+	}
+
+	if dirs[0] == dirs[1] {
+		t.Errorf("both storages use %s", dirs[0])
+	}
+}
+
+func TestDisableCache(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdg)
+	f := newFakeS3(t)
+	gs, err := NewS3Storage(S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		ObjPrefix:       "test",
+		DisableCache:    true,
+	})
+	if err != nil {
+		t.Fatalf("creating storage failed: %v", err)
+	}
+	t.Cleanup(func() { gs.Close() })
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "uncached/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if buf, err := gs.Load(ctx, "uncached/cert"); err != nil || string(buf) != "cert" {
+			t.Errorf("load failed: %q, %v", buf, err)
+		}
+		if n := len(f.recorded(http.MethodGet, "test/uncached/cert")); n != i {
+			t.Errorf("expected every load to go to S3, got %d requests for %d loads", n, i)
+		}
+	}
+	if ki, err := gs.Stat(ctx, "uncached/cert"); err != nil || ki.Size != 4 {
+		t.Errorf("stat failed: %+v, %v", ki, err)
+	}
+	if err := gs.Lock(ctx, "uncached/cert"); err != nil {
+		t.Errorf("lock failed: %v", err)
+	}
+	if err := gs.Unlock(ctx, "uncached/cert"); err != nil {
+		t.Errorf("unlock failed: %v", err)
+	}
+	if err := gs.Delete(ctx, "uncached/cert"); err != nil {
+		t.Errorf("delete failed: %v", err)
+	}
+	if gs.Exists(ctx, "uncached/cert") {
+		t.Error("deleted key still exists")
+	}
+	if err := gs.ExportCache(io.Discard); !errors.Is(err, ErrCacheDisabled) {
+		t.Errorf("expected ErrCacheDisabled, got %v", err)
+	}
+
+	if entries, err := os.ReadDir(xdg); err != nil || len(entries) != 0 {
+		t.Errorf("expected no cache directory to be created, got %v, %v", entries, err)
+	}
+}
+
+func TestSharedDBLifecycle(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	f := newFakeS3(t)
+	opts := S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+	}
+
+	var storages []*S3Storage
+	for i := 0; i < 3; i++ {
+		gs, err := NewS3Storage(opts)
+		if err != nil {
+			t.Fatalf("creating storage failed: %v", err)
+		}
+		storages = append(storages, gs)
+	}
+	first := storages[0].cache.db
+	for _, gs := range storages {
+		if gs.cache.db != first {
+			t.Fatal("the shared DB was opened more than once")
+		}
+	}
+
+	for i, gs := range storages {
+		if err := gs.Close(); err != nil {
+			t.Fatalf("closing storage failed: %v", err)
+		}
+		// Closing twice must not release another storage's reference
+		_ = gs.Close()
+
+		sharedDBMu.Lock()
+		_, open := sharedDBs[defaultCacheDir()]
+		sharedDBMu.Unlock()
+		if last := i == len(storages)-1; open == last {
+			t.Fatalf("after closing %d of %d storages the DB is open: %v", i+1, len(storages), open)
+		}
+		if i < len(storages)-1 {
+			storages[i+1].cache.setCacheEntry(context.Background(), []byte("key"), []byte("value"), time.Hour)
+		}
+	}
+
+	// The directory lock was released, so the DB can be opened again
+	gs, err := NewS3Storage(opts)
+	if err != nil {
+		t.Fatalf("reopening the shared DB failed: %v", err)
+	}
+	if v, ok := gs.cache.getCacheEntry(context.Background(), []byte("key")); !ok || string(v) != "value" {
+		t.Errorf("expected the entry written before, got %q", v)
+	}
+	gs.Close()
+
+	// A failed construction does not keep a reference
+	opts.Bucket = "missing"
+	if _, err := NewS3Storage(opts); err == nil {
+		t.Fatal("expected an error for a missing bucket")
+	}
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	if len(sharedDBs) != 0 {
+		t.Error("failed construction left the shared DB open")
+	}
+}
+
+func TestRecreateCorruptCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, badger.ManifestFilename), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := openCacheDB(dir, false, slog.Default()); err == nil {
+		db.Close()
+		t.Fatal("opened a corrupt cache")
+	}
+
+	db, err := openCacheDB(dir, true, slog.Default())
+	if err != nil {
+		t.Fatalf("recreating the cache failed: %v", err)
+	}
+	defer db.Close()
+	c := newCache(db, "")
+	c.setCacheEntry(context.Background(), []byte("key"), []byte("value"), time.Hour)
+	if v, ok := c.getCacheEntry(context.Background(), []byte("key")); !ok || string(v) != "value" {
+		t.Errorf("recreated cache does not work, got %q", v)
+	}
+
+	// A cache in use is never wiped
+	if _, err := openCacheDB(dir, true, slog.Default()); err == nil {
+		t.Error("opened a cache that is in use")
+	}
+	if _, ok := c.getCacheEntry(context.Background(), []byte("key")); !ok {
+		t.Error("cache in use was wiped")
+	}
+}
+
+func TestCacheErrorHandler(t *testing.T) {
+	f := newFakeS3(t)
+	var errs []error
+	gs := newTestStorage(t, f, S3Opts{ErrorHandler: func(err error) { errs = append(errs, err) }})
+
+	// A cold cache is not an error
+	if _, ok := gs.cache.getCacheEntry(context.Background(), []byte("missing")); ok || len(errs) != 0 {
+		t.Fatalf("expected a silent miss, got %v", errs)
+	}
+
+	// BadgerDB refuses keys this long
+	gs.cache.setCacheEntry(context.Background(), bytes.Repeat([]byte("k"), 70000), []byte("value"), time.Hour)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "cache write") {
+		t.Errorf("expected the failed write to be reported, got %v", errs)
+	}
+}
+
+func TestCacheTempFallback(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	f := newFakeS3(t)
+	opts := S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+	}
+
+	// Someone else uses the cache directory
+	busy, err := badger.Open(badger.DefaultOptions(defaultCacheDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	if _, err := NewS3Storage(opts); err == nil || !strings.Contains(err.Error(), defaultCacheDir()) {
+		t.Fatalf("expected an error naming the cache directory, got %v", err)
+	}
+
+	opts.CacheTempFallback = true
+	gs, err := NewS3Storage(opts)
+	if err != nil {
+		t.Fatalf("creating storage with a temporary cache failed: %v", err)
+	}
+	gs.cache.setCacheEntry(context.Background(), []byte("key"), []byte("value"), time.Hour)
+	if v, ok := gs.cache.getCacheEntry(context.Background(), []byte("key")); !ok || string(v) != "value" {
+		t.Errorf("temporary cache does not work, got %q", v)
+	}
+	dir := gs.cacheDir
+	if err := gs.Close(); err != nil {
+		t.Fatalf("closing storage failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("temporary cache directory %s was not removed: %v", dir, err)
+	}
+}
+
+func TestCacheEntryTTL(t *testing.T) {
+	c := newCache(newTestCacheDB(t), "")
+	for _, tc := range []struct {
+		ttl     time.Duration
+		expires bool
+	}{
+		{ttl: time.Hour, expires: true},
+		{ttl: 0},
+		{ttl: -time.Hour},
+	} {
+		key := []byte("ttl" + tc.ttl.String())
+		c.setCacheEntry(context.Background(), key, []byte("value"), tc.ttl)
+
+		value, expiresAt, ok := c.getCacheEntryWithExpiry(context.Background(), key)
+		if !ok || string(value) != "value" {
+			t.Errorf("TTL %v: entry missing right after it was written", tc.ttl)
+			continue
+		}
+		if tc.expires && time.Until(expiresAt).Round(time.Minute) != tc.ttl {
+			t.Errorf("TTL %v: expected the entry to expire in %v, expires at %v", tc.ttl, tc.ttl, expiresAt)
+		}
+		if !tc.expires && !expiresAt.IsZero() {
+			t.Errorf("TTL %v: expected no expiry, expires at %v", tc.ttl, expiresAt)
+		}
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	f := newFakeS3(t)
+	newStorage := func(dir string) *S3Storage {
+		gs, err := NewS3Storage(S3Opts{
+			Endpoint:        f.endpoint(),
+			Bucket:          f.bucket,
+			AccessKeyID:     "test-key",
+			SecretAccessKey: "test-secret",
+			CacheDir:        dir,
+		})
+		if err != nil {
+			t.Fatalf("creating storage failed: %v", err)
+		}
+		t.Cleanup(func() { gs.Close() })
+		return gs
+	}
+	dirA, dirB := filepath.Join(t.TempDir(), "a"), filepath.Join(t.TempDir(), "b")
+	a, b, sameAsA := newStorage(dirA), newStorage(dirB), newStorage(dirA)
+
+	if a.cache.db == b.cache.db || a.cache.db != sameAsA.cache.db {
+		t.Fatal("storages don't use the DB of their directory")
+	}
+	a.cache.setCacheEntry(context.Background(), []byte("key"), []byte("a"), time.Hour)
+	if _, ok := b.cache.getCacheEntry(context.Background(), []byte("key")); ok {
+		t.Error("entry of another cache directory was found")
+	}
+	if _, err := os.Stat(filepath.Join(dirB, badger.ManifestFilename)); err != nil {
+		t.Errorf("cache was not created in %s: %v", dirB, err)
+	}
+}
+
+func TestSharedDBConcurrentInit(t *testing.T) {
+	f := newFakeS3(t)
+	dir := t.TempDir()
+	opts := S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		CacheDir:        dir,
+	}
+
+	const n = 8
+	var (
+		wg       sync.WaitGroup
+		storages = make([]*S3Storage, n)
+		errs     = make([]error, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			opts := opts
+			opts.CacheNamespace = strconv.Itoa(i)
+			storages[i], errs[i] = NewS3Storage(opts)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, gs := range storages {
+		if errs[i] != nil {
+			t.Fatalf("creating storage %d failed: %v", i, errs[i])
+		}
+		if gs.cache.db != storages[0].cache.db {
+			t.Fatal("the shared DB was opened more than once")
+		}
+	}
+	for _, gs := range storages {
+		wg.Add(1)
+		go func(gs *S3Storage) {
+			defer wg.Done()
+			gs.cache.setCacheEntry(context.Background(), []byte("key"), []byte("value"), time.Hour)
+			if err := gs.Close(); err != nil {
+				t.Errorf("closing storage failed: %v", err)
+			}
+		}(gs)
+	}
+	wg.Wait()
+
+	sharedDBMu.Lock()
+	defer sharedDBMu.Unlock()
+	if _, open := sharedDBs[dir]; open {
+		t.Error("the shared DB is still open after all storages were closed")
+	}
+}
+
+func TestCacheSlidingTTL(t *testing.T) {
+	c := newCache(newTestCacheDB(t), "")
+	c.slidingTTL = 2 * time.Second
+
+	c.setCacheEntry(context.Background(), []byte("hot"), []byte("value"), 2*time.Second)
+	c.setCacheEntry(context.Background(), []byte("cold"), []byte("value"), 2*time.Second)
+
+	for deadline := time.Now().Add(3500 * time.Millisecond); time.Now().Before(deadline); {
+		if _, ok := c.getCacheEntry(context.Background(), []byte("hot")); !ok {
+			t.Fatal("frequently read entry expired")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, ok := c.getCacheEntry(context.Background(), []byte("cold")); ok {
+		t.Error("unread entry outlived its TTL")
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	cdb := newTestCacheDB(t)
+	plain := newCache(cdb, "")
+	compressed := newCache(cdb, "")
+	compressed.compress = true
+
+	value := bytes.Repeat([]byte("-----BEGIN CERTIFICATE-----\nMIIFazCCA1OgAwIBAgIRAIIQz7DSQONZRGPgu2OCiwAwDQYJKoZIhvcNAQELBQAw\n"), 50)
+	plain.setCacheEntry(context.Background(), []byte("plain"), value, time.Hour)
+	compressed.setCacheEntry(context.Background(), []byte("compressed"), value, time.Hour)
+
+	// Both read either kind of entry
+	for _, c := range []*cache{plain, compressed} {
+		for _, key := range []string{"plain", "compressed"} {
+			if got, ok := c.getCacheEntry(context.Background(), []byte(key)); !ok || !bytes.Equal(got, value) {
+				t.Errorf("%s entry did not round trip", key)
+			}
+		}
+	}
+
+	var size int64
+	_ = cdb.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("compressed"))
+		if err == nil {
+			size = item.ValueSize()
+		}
+		return err
+	})
+	if size == 0 || size > int64(len(value))/4 {
+		t.Errorf("expected compression to shrink %d bytes considerably, got %d", len(value), size)
+	}
+	t.Logf("compressed %d bytes to %d", len(value), size)
+}
+
+func TestCacheOverwrite(t *testing.T) {
+	for _, discard := range []bool{false, true} {
+		cdb := newTestCacheDB(t)
+		c := newCache(cdb, "")
+		c.discardVersions = discard
+
+		for i := 0; i < 500; i++ {
+			value := strconv.Itoa(i)
+			c.setCacheEntry(context.Background(), []byte("overwritten"), []byte(value), time.Hour)
+			if got, ok := c.getCacheEntry(context.Background(), []byte("overwritten")); !ok || string(got) != value {
+				t.Fatalf("discard %v: expected %q after overwrite, got %q", discard, value, got)
+			}
+		}
+
+		// Compaction must not drop the latest version either
+		if err := cdb.Flatten(1); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := c.getCacheEntry(context.Background(), []byte("overwritten")); !ok || string(got) != "499" {
+			t.Errorf("discard %v: latest value lost after compaction, got %q", discard, got)
+		}
+	}
+}
+
+func TestExportImportCache(t *testing.T) {
+	f := newFakeS3(t)
+	cdb := newTestCacheDB(t)
+	src := newTestStorage(t, f, S3Opts{CacheDB: cdb})
+	other := newTestStorage(t, f, S3Opts{CacheDB: cdb, CacheNamespace: "other"})
+	src.cache.setCacheEntry(context.Background(), []byte("export/a"), []byte("a"), time.Hour)
+	src.cache.setCacheEntry(context.Background(), []byte("export/b"), []byte("b"), time.Minute)
+	other.cache.setCacheEntry(context.Background(), []byte("export/other"), []byte("other"), time.Hour)
+
+	var buf bytes.Buffer
+	if err := src.ExportCache(&buf); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	dst := newTestStorage(t, f, S3Opts{})
+	if err := dst.ImportCache(&buf); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	for key, want := range map[string]time.Duration{"export/a": time.Hour, "export/b": time.Minute} {
+		if v, ok := dst.cache.getCacheEntry(context.Background(), []byte(key)); !ok || string(v) != key[len(key)-1:] {
+			t.Errorf("%s: expected the exported value, got %q", key, v)
+		}
+		present, _, ttl := dst.CacheEntryInfo(key)
+		if !present || ttl > want || ttl < want-5*time.Second {
+			t.Errorf("%s: expected about %v remaining, got %v", key, want, ttl)
+		}
+	}
+
+	// Entries of other namespaces are not exported
+	otherDst := newCache(dst.cache.db, "other")
+	if otherDst.isCacheEntryExistent(context.Background(), []byte("export/other")) {
+		t.Error("entry of another namespace was exported")
+	}
+}
+
+func TestCacheGC(t *testing.T) {
+	dir := t.TempDir()
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil).WithValueLogFileSize(1 << 20))
+	if err != nil {
+		t.Fatalf("opening DB failed: %v", err)
+	}
+	defer db.Close()
+	c := newCache(db, "gc")
+
+	value := bytes.Repeat([]byte("x"), 4096)
+	for i := 0; i < 2000; i++ {
+		c.setCacheEntry(context.Background(), []byte("key"+strconv.Itoa(i)), value, time.Second)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	before := valueLogSize(dir)
+	if reclaimed := runCacheGC(db, dir); reclaimed <= 0 {
+		t.Errorf("GC reclaimed %d bytes of %d", reclaimed, before)
+	}
+	if after := valueLogSize(dir); after >= before {
+		t.Errorf("value log did not shrink: %d before, %d after", before, after)
+	}
+
+	// The background GC runs once per shared DB and stops when the last storage using it is closed
+	f := newFakeS3(t)
+	for _, interval := range []time.Duration{10 * time.Millisecond, -1} {
+		opts := S3Opts{
+			Endpoint:        f.endpoint(),
+			Bucket:          f.bucket,
+			AccessKeyID:     "test-key",
+			SecretAccessKey: "test-secret",
+			CacheDir:        t.TempDir(),
+			CacheGCInterval: interval,
+		}
+		var storages []*S3Storage
+		for i := 0; i < 2; i++ {
+			gs, err := NewS3Storage(opts)
+			if err != nil {
+				t.Fatalf("creating storage failed: %v", err)
+			}
+			if gs.gcStop != nil {
+				t.Errorf("interval %v: storage runs a GC of its own on the shared DB", interval)
+			}
+			storages = append(storages, gs)
+		}
+		sharedDBMu.Lock()
+		shared := sharedDBs[opts.CacheDir]
+		sharedDBMu.Unlock()
+		if running := shared.gcStop != nil; running != (interval > 0) {
+			t.Errorf("interval %v: expected GC running to be %v", interval, interval > 0)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		for i, gs := range storages {
+			if err := gs.Close(); err != nil {
+				t.Fatalf("closing storage failed: %v", err)
+			}
+			if shared.gcDone == nil {
+				continue
+			}
+			stopped := false
+			select {
+			case <-shared.gcDone:
+				stopped = true
+			default:
+			}
+			if last := i == len(storages)-1; stopped != last {
+				t.Errorf("after closing %d of %d storages the GC is stopped: %v", i+1, len(storages), stopped)
+			}
+		}
+	}
+
+	// A DB of the storage's own is collected by the storage
+	gs, err := NewS3Storage(S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		CacheDir:        t.TempDir(),
+		CachePerProcess: true,
+		CacheGCInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("creating storage failed: %v", err)
+	}
+	if gs.gcStop == nil {
+		t.Fatal("expected the GC to run")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := gs.Close(); err != nil {
+		t.Fatalf("closing storage failed: %v", err)
+	}
+	select {
+	case <-gs.gcDone:
+	default:
+		t.Error("GC still running after Close")
+	}
+}
+
+func TestCacheContext(t *testing.T) {
+	c := newCache(newTestCacheDB(t), "ctx")
+	var errs []error
+	c.onError = func(err error) { errs = append(errs, err) }
+	c.setCacheEntry(context.Background(), []byte("key"), []byte("value"), time.Hour)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := c.getCacheEntry(canceled, []byte("key")); ok {
+		t.Error("cached entry was returned for a canceled context")
+	}
+	if c.isCacheEntryExistent(canceled, []byte("key")) {
+		t.Error("cached entry was reported for a canceled context")
+	}
+	c.setCacheEntry(canceled, []byte("other"), []byte("value"), time.Hour)
+	if c.isCacheEntryExistent(context.Background(), []byte("other")) {
+		t.Error("entry was written for a canceled context")
+	}
+	if len(errs) != 0 {
+		t.Errorf("giving up on the cache was reported as an error: %v", errs)
+	}
+
+	// A transaction stuck on a BadgerDB lock is abandoned at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	err := c.view(ctx, func(*badger.Txn) error {
+		<-release
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cache call returned after %v", elapsed)
+	}
+	if v, ok := c.getCacheEntry(context.Background(), []byte("key")); !ok || string(v) != "value" {
+		t.Errorf("expected the entry to remain cached, got %q, %v", v, ok)
+	}
+}
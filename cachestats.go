@@ -0,0 +1,70 @@
+package badgers3
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger"
+)
+
+// CacheStats describes how well the cache of a storage works.
+type CacheStats struct {
+	// Hits and Misses count the calls of Load and Stat that were answered from the cache and that went to S3
+	Hits, Misses int64
+	// Evictions counts the entries removed to stay below MaxCacheBytes
+	Evictions int64
+	// Entries is the number of entries cached right now, SizeBytes BadgerDB's estimate of their size
+	Entries   int
+	SizeBytes int64
+}
+
+// CacheStats returns the counters of the cache since the storage was created, along with its current size.
+// It is safe to call concurrently with other operations. Entries and SizeBytes are zero if the size can't be
+// determined, which is reported to the ErrorHandler.
+func (gs *S3Storage) CacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:      atomic.LoadInt64(&gs.cache.hits),
+		Misses:    atomic.LoadInt64(&gs.cache.misses),
+		Evictions: atomic.LoadInt64(&gs.cache.evictions),
+	}
+	stats.Entries, stats.SizeBytes = gs.cache.measure()
+	return stats
+}
+
+// record counts a lookup answered from the cache if hit is set, otherwise one that went to S3.
+func (c *cache) record(hit bool) {
+	if hit {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+}
+
+// measure returns the number of entries in the cache and their estimated size. The access times kept for eviction
+// count towards the size, but are not entries of their own.
+func (c *cache) measure() (entries int, size int64) {
+	if c.db == nil {
+		return 0, 0
+	}
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = c.namespace
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			size += item.EstimatedSize()
+			if !bytes.HasPrefix(item.Key()[len(c.namespace):], []byte(cacheAccessPrefix)) {
+				entries++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.handleError("measure", c.namespace, err)
+		return 0, 0
+	}
+	return entries, size
+}
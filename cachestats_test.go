@@ -0,0 +1,63 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCacheStats(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+	f.put("test/stats/a", []byte("a"))
+	f.put("test/stats/b", []byte("b"))
+
+	// Reading the stats must not race with the counters
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				gs.CacheStats()
+			}
+		}
+	}()
+
+	for _, key := range []string{"stats/a", "stats/a", "stats/b", "stats/missing"} {
+		_, _ = gs.Load(ctx, key)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := gs.Stat(ctx, "stats/a"); err != nil {
+			t.Fatalf("stat failed: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	stats := gs.CacheStats()
+	if stats.Hits != 2 || stats.Misses != 4 {
+		t.Errorf("expected 2 hits and 4 misses, got %+v", stats)
+	}
+	// a, b and their ETags plus the stat of a
+	if stats.Entries != 5 || stats.SizeBytes == 0 {
+		t.Errorf("expected 5 entries, got %+v", stats)
+	}
+
+	small := newTestStorage(t, f, S3Opts{MaxCacheBytes: 5000})
+	for i := 0; i < 10; i++ {
+		if err := small.Store(ctx, fmt.Sprintf("stats/big%d", i), bytes.Repeat([]byte("x"), 1000)); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+	if stats := small.CacheStats(); stats.Evictions == 0 || stats.SizeBytes > 5000 {
+		t.Errorf("expected entries to be evicted, got %+v", stats)
+	}
+}
@@ -0,0 +1,55 @@
+package badgers3
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// ErrChecksumMismatch is returned by Load if VerifyChecksum is set and an object doesn't match the checksum S3
+// stored for it.
+var ErrChecksumMismatch = errors.New("object does not match its checksum")
+
+// checksumAlgorithms are the additional checksum algorithms supported by S3
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"CRC32":  func() hash.Hash { return crc32.NewIEEE() },
+	"CRC32C": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+}
+
+// checksum returns the checksum of data in the encoding S3 uses for it
+func checksum(algorithm string, data []byte) string {
+	h := checksumAlgorithms[algorithm]()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checksumHeader returns the header carrying checksums of algorithm, e.g. X-Amz-Checksum-Sha256
+func checksumHeader(algorithm string) string {
+	return http.CanonicalHeaderKey("X-Amz-Checksum-" + strings.ToLower(algorithm))
+}
+
+// verifyChecksums compares raw with all checksums S3 returned for the object. Objects stored without a checksum
+// pass.
+func verifyChecksums(name string, raw []byte, oi minio.ObjectInfo) error {
+	for algorithm, sum := range map[string]string{
+		"CRC32":  oi.ChecksumCRC32,
+		"CRC32C": oi.ChecksumCRC32C,
+		"SHA1":   oi.ChecksumSHA1,
+		"SHA256": oi.ChecksumSHA256,
+	} {
+		if sum != "" && sum != checksum(algorithm, raw) {
+			return fmt.Errorf("%w: %s %s", ErrChecksumMismatch, algorithm, name)
+		}
+	}
+	return nil
+}
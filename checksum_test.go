@@ -0,0 +1,51 @@
+package badgers3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ChecksumAlgorithm: "sha256", VerifyChecksum: true})
+	ctx := context.Background()
+
+	for _, key := range []string{"checksum/good", "checksum/bad"} {
+		if err := gs.Store(ctx, key, []byte("cert")); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+
+	obj, _ := f.get("test/checksum/good")
+	sum := sha256.Sum256(obj.data)
+	puts := f.recorded(http.MethodPut, "test/checksum/good")
+	if len(puts) != 1 || puts[0].Header.Get("X-Amz-Checksum-Sha256") != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("checksum header missing or wrong: %v", puts)
+	}
+
+	// Stores write through to the cache, read with a storage that has to fetch the object
+	reader := newTestStorage(t, f, S3Opts{VerifyChecksum: true})
+	if buf, err := reader.Load(ctx, "checksum/good"); err != nil || string(buf) != "cert" {
+		t.Errorf("load failed: %q, %v", buf, err)
+	}
+	gets := f.recorded(http.MethodGet, "test/checksum/good")
+	if len(gets) == 0 || gets[len(gets)-1].Header.Get("X-Amz-Checksum-Mode") != "ENABLED" {
+		t.Error("checksums were not requested")
+	}
+
+	bad, _ := f.get("test/checksum/bad")
+	f.mu.Lock()
+	bad.data = []byte("tampered")
+	f.mu.Unlock()
+	if _, err := gs.Load(ctx, "checksum/bad"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	if err := ValidateOpts(S3Opts{Endpoint: "s3.example.com", Bucket: "b", ChecksumAlgorithm: "MD5"}); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
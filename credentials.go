@@ -0,0 +1,61 @@
+package badgers3
+
+import (
+	"net/http"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// CredentialProvider selects where the credentials for S3 come from.
+type CredentialProvider string
+
+const (
+	// CredentialsStatic uses AccessKeyID, SecretAccessKey and SessionToken. Requests are anonymous if the keys are
+	// empty.
+	CredentialsStatic CredentialProvider = "static"
+	// CredentialsIAM uses the role of the EC2 instance, ECS task or EKS service account the process runs in.
+	CredentialsIAM CredentialProvider = "iam"
+	// CredentialsEnv reads AWS_ACCESS_KEY_ID and friends from the environment, or MINIO_ROOT_USER and
+	// MINIO_ROOT_PASSWORD if those are not set.
+	CredentialsEnv CredentialProvider = "env"
+	// CredentialsFileMinio reads the configuration of the MinIO client, ~/.mc/config.json by default.
+	CredentialsFileMinio CredentialProvider = "file-minio"
+)
+
+// credentialsProvider returns the provider selected by opts. Without a provider, the static keys are used if
+// AccessKeyID is set. Otherwise the environment, the AWS and MinIO client configuration files and the IAM role
+// are tried in turn, falling back to anonymous requests.
+func credentialsProvider(opts S3Opts) credentials.Provider {
+	provider := opts.CredentialProvider
+	if provider == "" && opts.AccessKeyID != "" {
+		provider = CredentialsStatic
+	}
+
+	switch provider {
+	case CredentialsStatic:
+		return &credentials.Static{Value: credentials.Value{
+			AccessKeyID:     opts.AccessKeyID,
+			SecretAccessKey: opts.SecretAccessKey,
+			SessionToken:    opts.SessionToken,
+			SignerType:      credentials.SignatureV4,
+		}}
+	case CredentialsIAM:
+		return newIAMProvider()
+	case CredentialsEnv:
+		return &credentials.Chain{Providers: []credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}}}
+	case CredentialsFileMinio:
+		return &credentials.FileMinioClient{}
+	}
+	return &credentials.Chain{Providers: []credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.FileMinioClient{},
+		newIAMProvider(),
+	}}
+}
+
+// newIAMProvider returns a provider fetching credentials from the metadata service at the default endpoint
+func newIAMProvider() *credentials.IAM {
+	return &credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}}
+}
@@ -0,0 +1,61 @@
+package badgers3
+
+import (
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestCredentialsProvider(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts S3Opts
+		want func(credentials.Provider) bool
+	}{
+		{"static by default", S3Opts{AccessKeyID: "key", SecretAccessKey: "secret"}, func(p credentials.Provider) bool {
+			s, ok := p.(*credentials.Static)
+			return ok && s.AccessKeyID == "key" && s.SecretAccessKey == "secret"
+		}},
+		{"static", S3Opts{CredentialProvider: CredentialsStatic}, func(p credentials.Provider) bool {
+			_, ok := p.(*credentials.Static)
+			return ok
+		}},
+		{"iam", S3Opts{CredentialProvider: CredentialsIAM, AccessKeyID: "ignored"}, func(p credentials.Provider) bool {
+			iam, ok := p.(*credentials.IAM)
+			return ok && iam.Client != nil
+		}},
+		{"env", S3Opts{CredentialProvider: CredentialsEnv}, func(p credentials.Provider) bool {
+			c, ok := p.(*credentials.Chain)
+			if !ok || len(c.Providers) != 2 {
+				return false
+			}
+			_, aws := c.Providers[0].(*credentials.EnvAWS)
+			_, minio := c.Providers[1].(*credentials.EnvMinio)
+			return aws && minio
+		}},
+		{"file-minio", S3Opts{CredentialProvider: CredentialsFileMinio}, func(p credentials.Provider) bool {
+			_, ok := p.(*credentials.FileMinioClient)
+			return ok
+		}},
+		{"chain without keys", S3Opts{}, func(p credentials.Provider) bool {
+			c, ok := p.(*credentials.Chain)
+			if !ok || len(c.Providers) == 0 {
+				return false
+			}
+			_, iam := c.Providers[len(c.Providers)-1].(*credentials.IAM)
+			return iam
+		}},
+	} {
+		if p := credentialsProvider(tc.opts); !tc.want(p) {
+			t.Errorf("%s: unexpected provider %#v", tc.name, p)
+		}
+	}
+
+	// The environment is read when the credentials are retrieved
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	creds, err := credentials.New(credentialsProvider(S3Opts{CredentialProvider: CredentialsEnv})).Get()
+	if err != nil || creds.AccessKeyID != "env-key" {
+		t.Errorf("expected the key from the environment, got %+v, %v", creds, err)
+	}
+}
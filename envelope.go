@@ -0,0 +1,131 @@
+package badgers3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted objects start with a header naming the algorithm and the key they were encrypted with:
+// the magic bytes, the header version, the algorithm ID and the first bytes of the SHA-256 of the key.
+const (
+	envelopeMagic    = "BS3E"
+	envelopeVersion  = 1
+	envelopeLen      = len(envelopeMagic) + 2 + envelopeKeyIDLen
+	envelopeKeyIDLen = 4
+)
+
+// Algorithm IDs in the envelope header.
+const (
+	envelopeSecretBox        byte = 1
+	envelopeAESGCM           byte = 2
+	envelopeSecretBoxDerived byte = 3
+)
+
+// EnvelopeIO prefixes objects with a header naming the algorithm and key they were encrypted with, so that reading
+// them picks the right key instead of trying all of them. Objects without the header, e.g. written by older
+// versions, are decrypted by trying the keys in order.
+type EnvelopeIO struct {
+	entries []envelopeEntry
+}
+
+type envelopeEntry struct {
+	header []byte
+	io     IO
+}
+
+// NewEnvelopeIO returns an EnvelopeIO writing with the first of keys and reading with any of them. keys must be
+// SecretBoxIO, AESGCMIO or DerivedSecretBoxIO.
+func NewEnvelopeIO(keys ...IO) (*EnvelopeIO, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys for the envelope")
+	}
+	e := &EnvelopeIO{}
+	for _, k := range keys {
+		header, err := envelopeHeader(k)
+		if err != nil {
+			return nil, err
+		}
+		e.entries = append(e.entries, envelopeEntry{header: header, io: k})
+	}
+	return e, nil
+}
+
+// envelopeHeader returns the header of objects encrypted with iowrap.
+func envelopeHeader(iowrap IO) ([]byte, error) {
+	var (
+		alg byte
+		key [32]byte
+	)
+	switch t := iowrap.(type) {
+	case *SecretBoxIO:
+		alg, key = envelopeSecretBox, t.SecretKey
+	case *AESGCMIO:
+		alg, key = envelopeAESGCM, t.SecretKey
+	case *DerivedSecretBoxIO:
+		alg, key = envelopeSecretBoxDerived, t.MasterKey
+	default:
+		return nil, fmt.Errorf("%T can't be used in an envelope", iowrap)
+	}
+	sum := sha256.Sum256(key[:])
+	header := append([]byte(envelopeMagic), envelopeVersion, alg)
+	return append(header, sum[:envelopeKeyIDLen]...), nil
+}
+
+func (e *EnvelopeIO) ForKey(key string) IO {
+	keyed := &EnvelopeIO{entries: make([]envelopeEntry, len(e.entries))}
+	for i, entry := range e.entries {
+		keyed.entries[i] = envelopeEntry{header: entry.header, io: ioForKey(entry.io, key)}
+	}
+	return keyed
+}
+
+func (e *EnvelopeIO) WrapReader(r io.Reader) io.Reader {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	if len(raw) == 0 {
+		return bytes.NewReader(nil)
+	}
+
+	var headerErr error
+	if len(raw) >= envelopeLen && string(raw[:len(envelopeMagic)]) == envelopeMagic {
+		headerErr = fmt.Errorf("object was encrypted with an unknown key %x", raw[envelopeLen-envelopeKeyIDLen:envelopeLen])
+		for _, entry := range e.entries {
+			if !bytes.Equal(raw[:envelopeLen], entry.header) {
+				continue
+			}
+			buf, err := io.ReadAll(entry.io.WrapReader(bytes.NewReader(raw[envelopeLen:])))
+			if err == nil {
+				return bytes.NewReader(buf)
+			}
+			headerErr = err
+			break
+		}
+	}
+
+	// No header, or a legacy object that happens to start like one
+	for _, entry := range e.entries {
+		buf, err := io.ReadAll(entry.io.WrapReader(bytes.NewReader(raw)))
+		if err == nil {
+			return bytes.NewReader(buf)
+		}
+		if headerErr == nil {
+			headerErr = err
+		}
+	}
+	return Reader{nil, 0, headerErr}
+}
+
+func (e *EnvelopeIO) ByteReader(msg []byte) Reader {
+	primary := e.entries[0]
+	buf, err := io.ReadAll(primary.io.ByteReader(msg))
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	out := append(append([]byte{}, primary.header...), buf...)
+	return Reader{bytes.NewReader(out), int64(len(out)), nil}
+}
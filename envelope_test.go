@@ -0,0 +1,66 @@
+package badgers3
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEnvelopeIO(t *testing.T) {
+	var keyA, keyB [32]byte
+	copy(keyA[:], "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	copy(keyB[:], "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	msg := []byte("This is a very important message that shall be encrypted...")
+
+	for _, tc := range []struct {
+		name string
+		a, b IO
+		alg  byte
+	}{
+		{"secretbox", &SecretBoxIO{SecretKey: keyA}, &SecretBoxIO{SecretKey: keyB}, envelopeSecretBox},
+		{"aes-gcm", &AESGCMIO{SecretKey: keyA}, &AESGCMIO{SecretKey: keyB}, envelopeAESGCM},
+		{"derived", &DerivedSecretBoxIO{MasterKey: keyA}, &DerivedSecretBoxIO{MasterKey: keyB}, envelopeSecretBoxDerived},
+	} {
+		onlyA, _ := NewEnvelopeIO(tc.a)
+		rotated, err := NewEnvelopeIO(tc.b, tc.a)
+		if err != nil {
+			t.Fatalf("%s: creating envelope failed: %v", tc.name, err)
+		}
+
+		enc, err := io.ReadAll(ioForKey(onlyA, "cert").ByteReader(msg))
+		if err != nil {
+			t.Fatalf("%s: encrypting failed: %v", tc.name, err)
+		}
+		if !bytes.HasPrefix(enc, []byte(envelopeMagic)) || enc[len(envelopeMagic)] != envelopeVersion || enc[len(envelopeMagic)+1] != tc.alg {
+			t.Errorf("%s: unexpected header %x", tc.name, enc[:envelopeLen])
+		}
+		// The header names key A, which the rotated envelope knows as an older key
+		if buf, err := io.ReadAll(ioForKey(rotated, "cert").WrapReader(bytes.NewReader(enc))); err != nil || !bytes.Equal(buf, msg) {
+			t.Errorf("%s: round trip failed: %q, %v", tc.name, buf, err)
+		}
+
+		// Objects without the header are decrypted by trying the keys
+		legacy, _ := io.ReadAll(ioForKey(tc.a, "cert").ByteReader(msg))
+		if buf, err := io.ReadAll(ioForKey(rotated, "cert").WrapReader(bytes.NewReader(legacy))); err != nil || !bytes.Equal(buf, msg) {
+			t.Errorf("%s: reading a legacy object failed: %q, %v", tc.name, buf, err)
+		}
+	}
+
+	onlyB, _ := NewEnvelopeIO(&SecretBoxIO{SecretKey: keyB})
+	onlyA, _ := NewEnvelopeIO(&SecretBoxIO{SecretKey: keyA})
+	enc, _ := io.ReadAll(onlyA.ByteReader(msg))
+	if _, err := io.ReadAll(onlyB.WrapReader(bytes.NewReader(enc))); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("expected an unknown key error, got %v", err)
+	}
+	// Cleartext has no header and is not mistaken for an encrypted object
+	if _, err := io.ReadAll(onlyA.WrapReader(bytes.NewReader(msg))); err == nil {
+		t.Error("cleartext was accepted as encrypted")
+	}
+	if buf, err := io.ReadAll(onlyA.WrapReader(bytes.NewReader(nil))); err != nil || len(buf) != 0 {
+		t.Errorf("reading an empty object failed: %q, %v", buf, err)
+	}
+	if _, err := NewEnvelopeIO(&GzipIO{}); err == nil {
+		t.Error("envelope accepted an IO that doesn't encrypt")
+	}
+}
@@ -0,0 +1,157 @@
+package badgers3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// cacheAccessPrefix starts the keys of the entries holding the last access time of a cache entry. Cache keys are
+// storage keys, which never start with a NUL byte.
+const cacheAccessPrefix = "\x00atime\x00"
+
+// cacheEvictTarget is the fraction of maxBytes the cache is shrunk to once it grew past it, so that not every
+// following write has to evict again
+const cacheEvictTarget = 0.9
+
+// accessKey returns the cache key of the entry holding the last access time of key
+func accessKey(key []byte) []byte {
+	return append([]byte(cacheAccessPrefix), key...)
+}
+
+// touch records that the entry for key was just read. The access time expires together with the entry.
+func (c *cache) touch(key []byte, expiresAt uint64) {
+	var stamp [cacheStampLen]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(time.Now().UnixNano()))
+	err := c.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry(c.key(accessKey(key)), stamp[:])
+		e.ExpiresAt = expiresAt
+		return txn.SetEntry(e)
+	})
+
+	c.handleError("write", accessKey(key), err)
+}
+
+// grow accounts for n bytes written to the cache and evicts entries if that took it past maxBytes.
+// The tracked size is approximate, overwrites are counted twice until the next eviction measures it again.
+func (c *cache) grow(n int) {
+	c.sizeMu.Lock()
+	defer c.sizeMu.Unlock()
+
+	if c.sizeKnown {
+		if c.size += int64(n); c.size <= c.maxBytes {
+			return
+		}
+	}
+	size, err := c.evict()
+	if err != nil {
+		c.onError(fmt.Errorf("evicting cache entries failed: %w", err))
+		c.sizeKnown = false
+		return
+	}
+	c.size, c.sizeKnown = size, true
+}
+
+type evictionCandidate struct {
+	key      []byte
+	size     int64
+	lastUsed int64
+}
+
+// evict measures the cache and, if it is larger than maxBytes, removes the least recently used entries until it is
+// below cacheEvictTarget of it. Entries never read count as used when they were written. It returns the size left.
+func (c *cache) evict() (int64, error) {
+	var (
+		total      int64
+		candidates []evictionCandidate
+		accessed   = map[string]int64{}
+		accessSize = map[string]int64{}
+	)
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = c.namespace
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)[len(c.namespace):]
+			size := item.EstimatedSize()
+			total += size
+
+			if bytes.HasPrefix(key, []byte(cacheAccessPrefix)) {
+				err := item.Value(func(val []byte) error {
+					if len(val) == cacheStampLen {
+						accessed[string(key[len(cacheAccessPrefix):])] = int64(binary.BigEndian.Uint64(val))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				accessSize[string(key[len(cacheAccessPrefix):])] = size
+				continue
+			}
+
+			cand := evictionCandidate{key: key, size: size}
+			if item.UserMeta()&cacheMetaStamped != 0 {
+				err := item.Value(func(val []byte) error {
+					if len(val) >= cacheStampLen {
+						cand.lastUsed = int64(binary.BigEndian.Uint64(val))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			candidates = append(candidates, cand)
+		}
+		return nil
+	})
+	if err != nil || total <= c.maxBytes {
+		return total, err
+	}
+
+	for i := range candidates {
+		key := string(candidates[i].key)
+		if at := accessed[key]; at > candidates[i].lastUsed {
+			candidates[i].lastUsed = at
+		}
+		candidates[i].size += accessSize[key]
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed < candidates[j].lastUsed })
+
+	wb := c.db.NewWriteBatch()
+	defer wb.Cancel()
+	var (
+		target  = int64(float64(c.maxBytes) * cacheEvictTarget)
+		evicted int64
+	)
+	for _, cand := range candidates {
+		if total <= target {
+			break
+		}
+		if err := wb.Delete(c.key(cand.key)); err != nil {
+			return total, err
+		}
+		if _, ok := accessSize[string(cand.key)]; ok {
+			if err := wb.Delete(c.key(accessKey(cand.key))); err != nil {
+				return total, err
+			}
+		}
+		total -= cand.size
+		evicted++
+	}
+	if err := wb.Flush(); err != nil {
+		return total, err
+	}
+	atomic.AddInt64(&c.evictions, evicted)
+	return total, nil
+}
@@ -0,0 +1,42 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(newTestCacheDB(t), "evict")
+	value := bytes.Repeat([]byte("x"), 1000)
+	c.maxBytes = 10 * 1100
+
+	for i := 0; i < 8; i++ {
+		c.setCacheEntry(context.Background(), []byte(fmt.Sprintf("old/%d", i)), value, time.Hour)
+		time.Sleep(time.Millisecond)
+	}
+	// Reading an old entry makes it recently used
+	if _, ok := c.getCacheEntry(context.Background(), []byte("old/0")); !ok {
+		t.Fatal("entry missing before the cache was full")
+	}
+	for i := 0; i < 8; i++ {
+		c.setCacheEntry(context.Background(), []byte(fmt.Sprintf("new/%d", i)), value, time.Hour)
+		time.Sleep(time.Millisecond)
+	}
+
+	if size, err := c.evict(); err != nil || size > c.maxBytes {
+		t.Errorf("cache holds %d bytes, limit is %d: %v", size, c.maxBytes, err)
+	}
+	for i := 1; i < 4; i++ {
+		if c.isCacheEntryExistent(context.Background(), []byte(fmt.Sprintf("old/%d", i))) {
+			t.Errorf("old/%d was not evicted", i)
+		}
+	}
+	for _, key := range []string{"old/0", "new/5", "new/6", "new/7"} {
+		if !c.isCacheEntryExistent(context.Background(), []byte(key)) {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
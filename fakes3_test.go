@@ -0,0 +1,441 @@
+package badgers3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObject is a single object held by fakeS3.
+type fakeObject struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+func (o *fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// fakeRequest is a recorded request made against fakeS3.
+type fakeRequest struct {
+	Method string
+	Key    string
+	Query  string
+	Header http.Header
+}
+
+// fakeS3 is a minimal in-memory S3 server, good enough for the subset of
+// the API minio-go uses in this package.
+type fakeS3 struct {
+	*httptest.Server
+	bucket string
+
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	requests []fakeRequest
+
+	// reverseList makes listings come back in reverse lexicographic order.
+	reverseList bool
+
+	// undeletable holds the keys multi-object deletes fail for with AccessDenied.
+	undeletable map[string]bool
+
+	// subresources maps bucket subresources such as "versioning" to their raw XML configuration.
+	subresources map[string]string
+
+	// hook, if set, runs before the request is served. Returning true
+	// means the hook already wrote a response.
+	hook func(w http.ResponseWriter, r *http.Request, key string) bool
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := newUnstartedFakeS3()
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	// minio builds its own transport, point it at the test certificate.
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSL_CERT_FILE", certFile)
+	return f
+}
+
+// newPlainFakeS3 is newFakeS3 serving plain HTTP, its endpoint starts with http://.
+func newPlainFakeS3(t *testing.T) *fakeS3 {
+	f := newUnstartedFakeS3()
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newUnstartedFakeS3() *fakeS3 {
+	return &fakeS3{
+		bucket:       "test-bucket",
+		objects:      map[string]*fakeObject{},
+		subresources: map[string]string{},
+		undeletable:  map[string]bool{},
+	}
+}
+
+// endpoint returns the host:port of the server as expected by S3Opts.
+func (f *fakeS3) endpoint() string {
+	return strings.TrimPrefix(f.URL, "https://")
+}
+
+func (f *fakeS3) setHook(hook func(w http.ResponseWriter, r *http.Request, key string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hook = hook
+}
+
+func (f *fakeS3) setSubresource(name, config string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subresources[name] = config
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: data, header: http.Header{}, modified: time.Now()}
+}
+
+func (f *fakeS3) get(key string) (*fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	return obj, ok
+}
+
+func (f *fakeS3) remove(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, key)
+}
+
+// recorded returns all requests made for the given method and object key.
+func (f *fakeS3) recorded(method, key string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []fakeRequest
+	for _, r := range f.requests {
+		if r.Method == method && r.Key == key {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	f.mu.Lock()
+	f.requests = append(f.requests, fakeRequest{
+		Method: r.Method,
+		Key:    key,
+		Query:  r.URL.RawQuery,
+		Header: r.Header.Clone(),
+	})
+	hook := f.hook
+	f.mu.Unlock()
+
+	if hook != nil && hook(w, r, key) {
+		return
+	}
+	if bucket != f.bucket {
+		writeFakeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.URL.Query().Has("location"):
+		writeFakeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Value   string   `xml:",chardata"`
+		}{Value: "us-east-1"})
+	case key == "" && r.Method == http.MethodGet && f.serveSubresource(w, r):
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		f.serveList(w, r)
+	case key == "" && r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+		f.serveDeleteMany(w, r)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.serveCopy(w, r, key)
+	case r.Method == http.MethodPut:
+		f.servePut(w, r, key)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		f.serveGet(w, r, key)
+	case r.Method == http.MethodDelete:
+		f.remove(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) serveSubresource(w http.ResponseWriter, r *http.Request) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, config := range f.subresources {
+		if r.URL.Query().Has(name) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, config)
+			return true
+		}
+	}
+	if r.URL.Query().Has("lifecycle") {
+		writeFakeError(w, http.StatusNotFound, "NoSuchLifecycleConfiguration")
+		return true
+	}
+	return false
+}
+
+func (f *fakeS3) servePut(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		body = decodeAWSChunked(body)
+	}
+
+	obj := &fakeObject{data: body, header: http.Header{}, modified: time.Now()}
+	for k, v := range r.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-meta-") || lk == "content-type" || lk == "content-encoding" || lk == "x-amz-storage-class" || strings.HasPrefix(lk, "x-amz-checksum-") {
+			obj.header[k] = v
+		}
+	}
+
+	// Conditional writes, checked and applied atomically like S3 does
+	f.mu.Lock()
+	prev, exists := f.objects[key]
+	inm, im := r.Header.Get("If-None-Match"), r.Header.Get("If-Match")
+	if (inm == "*" && exists) || (im != "" && (!exists || strings.Trim(im, `"`) != strings.Trim(prev.etag(), `"`))) {
+		f.mu.Unlock()
+		writeFakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	f.objects[key] = obj
+	f.mu.Unlock()
+
+	w.Header().Set("ETag", obj.etag())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) serveCopy(w http.ResponseWriter, r *http.Request, key string) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	obj, ok := f.get(srcKey)
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	cp := &fakeObject{data: obj.data, header: obj.header.Clone(), modified: time.Now()}
+	f.mu.Lock()
+	f.objects[key] = cp
+	f.mu.Unlock()
+
+	writeFakeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: cp.etag(), LastModified: cp.modified.UTC().Format(time.RFC3339)})
+}
+
+func (f *fakeS3) serveGet(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := f.get(key)
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == obj.etag() {
+		w.Header().Set("ETag", obj.etag())
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	for k, v := range obj.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", obj.etag())
+	w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(obj.data)
+	}
+}
+
+type fakeListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type fakeListPrefix struct {
+	Prefix string
+}
+
+func (f *fakeS3) serveList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+
+	f.mu.Lock()
+	var (
+		contents []fakeListEntry
+		prefixes []fakeListPrefix
+		seen     = map[string]bool{}
+		reverse  = f.reverseList
+	)
+	for k, obj := range f.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				p := k[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, fakeListPrefix{p})
+				}
+				continue
+			}
+		}
+		contents = append(contents, fakeListEntry{
+			Key:          k,
+			LastModified: obj.modified.UTC().Format(time.RFC3339),
+			ETag:         obj.etag(),
+			Size:         int64(len(obj.data)),
+		})
+	}
+	f.mu.Unlock()
+
+	sort.Slice(contents, func(i, j int) bool { return (contents[i].Key < contents[j].Key) != reverse })
+	sort.Slice(prefixes, func(i, j int) bool { return (prefixes[i].Prefix < prefixes[j].Prefix) != reverse })
+
+	writeFakeXML(w, struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []fakeListEntry
+		CommonPrefixes []fakeListPrefix
+	}{
+		Name:           f.bucket,
+		Prefix:         prefix,
+		KeyCount:       len(contents) + len(prefixes),
+		MaxKeys:        1000,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	})
+}
+
+// fakeDeleteKey is an object named in a multi-object delete request or its result.
+type fakeDeleteKey struct {
+	Key string
+}
+
+// fakeDeleteError is an object a multi-object delete failed for.
+type fakeDeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+func (f *fakeS3) serveDeleteMany(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []fakeDeleteKey `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var (
+		deleted []fakeDeleteKey
+		errs    []fakeDeleteError
+	)
+	f.mu.Lock()
+	for _, obj := range req.Objects {
+		if f.undeletable[obj.Key] {
+			errs = append(errs, fakeDeleteError{Key: obj.Key, Code: "AccessDenied", Message: "Access Denied"})
+			continue
+		}
+		delete(f.objects, obj.Key)
+		deleted = append(deleted, obj)
+	}
+	f.mu.Unlock()
+
+	writeFakeXML(w, struct {
+		XMLName xml.Name          `xml:"DeleteResult"`
+		Deleted []fakeDeleteKey   `xml:"Deleted"`
+		Errors  []fakeDeleteError `xml:"Error"`
+	}{Deleted: deleted, Errors: errs})
+}
+
+func writeFakeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// decodeAWSChunked strips the aws-chunked framing minio uses for streaming
+// signatures on plain HTTP connections.
+func decodeAWSChunked(body []byte) []byte {
+	var (
+		out bytes.Buffer
+		br  = bufio.NewReader(bytes.NewReader(body))
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return out.Bytes()
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil || size == 0 {
+			return out.Bytes()
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return out.Bytes()
+		}
+		_, _ = br.Discard(2)
+	}
+}
@@ -3,16 +3,26 @@ package badgers3
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/caddyserver/certmagic"
+	"github.com/dgraph-io/badger"
 	minio "github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"io"
 	"io/fs"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,218 +31,1662 @@ type S3Opts struct {
 	Bucket          string
 	AccessKeyID     string
 	SecretAccessKey string
+	// SessionToken goes along with temporary credentials, e.g. from AWS STS or the role of an EC2 instance or ECS
+	// task. Leave it empty for long-lived keys.
+	SessionToken string
+	// CredentialProvider selects where credentials come from, e.g. CredentialsIAM to use the role of an EC2
+	// instance instead of static keys. By default the static keys are used if AccessKeyID is set, otherwise the
+	// environment, the AWS and MinIO client configuration files and the IAM role are tried in turn.
+	CredentialProvider CredentialProvider
+
+	// Region is the region requests are signed for, by default it is looked up with GetBucketLocation. Providers
+	// that don't implement that fail requests with SignatureDoesNotMatch unless it is set, e.g. Cloudflare R2
+	// needs "auto". Setting it for AWS saves the lookup.
+	Region string
 
 	ObjPrefix string
 
 	// EncryptionKey is optional. If you do not wish to encrypt your certficates and key inside the S3 bucket, leave it empty.
 	EncryptionKey []byte
+	// EncryptionKeys replaces EncryptionKey to rotate keys: the first key encrypts, and objects are decrypted with
+	// whichever of the keys authenticates them, tried in order. Move the old key behind the new one to rotate.
+	EncryptionKeys [][]byte
+	// Passphrase, if set, derives the encryption key from a passphrase of any length and PassphraseSalt, instead of
+	// setting a 32 byte EncryptionKey. See PassphraseKey. The salt must be the same everywhere the objects are read.
+	Passphrase     string
+	PassphraseSalt []byte
+
+	// KMS, if set, encrypts every object with its own data key from a key management service instead of with
+	// EncryptionKey, see KMSIO.
+	KMS KMSProvider
+
+	// SSE requests server-side encryption of stored objects, e.g. encrypt.NewSSE() for SSE-S3,
+	// encrypt.NewSSEKMS(keyID, nil) for SSE-KMS or encrypt.NewSSEC(key) for SSE-C, whose key is also sent with every
+	// read. It is independent of the client-side encryption with EncryptionKey.
+	SSE encrypt.ServerSide
+	// EncryptionAlgorithm selects the cipher used with EncryptionKey, EncryptionSecretBox by default. Objects must be
+	// read with the algorithm they were written with, use SwitchEncryption to change it.
+	EncryptionAlgorithm EncryptionAlgorithm
+
+	// CacheStaleGrace enables stale-while-revalidate for Load. Cached objects are kept for this long past their
+	// normal expiry; within that window the cached value is returned immediately while a fresh copy is fetched
+	// from S3 in the background. Zero disables it.
+	CacheStaleGrace time.Duration
+
+	// CacheTTL is how long loaded objects and their stats are cached, an hour by default. Negative values keep
+	// them cached until they are overwritten, deleted or evicted.
+	CacheTTL time.Duration
+	// CacheTTLByPrefix sets the cache TTL for keys starting with the given prefixes, e.g. a short one for
+	// "ocsp/". The longest matching prefix wins over CacheTTL. Negative values never expire like they do for
+	// CacheTTL, zero is not allowed.
+	CacheTTLByPrefix map[string]time.Duration
+
+	// CacheSlidingTTL enables sliding expiration: whenever a cached entry is read, it is kept for at least this
+	// long from then on, so frequently used entries stay cached while unused ones expire as usual.
+	// It does not apply to Load when CacheStaleGrace is set.
+	CacheSlidingTTL time.Duration
+
+	// CompressCache stores cached values gzip compressed, trading some CPU for disk space.
+	// Entries written without compression remain readable.
+	CompressCache bool
+
+	// CacheDiscardVersions lets compaction drop older versions of overwritten cache entries right away.
+	// This saves space for frequently overwritten keys, but makes BadgerDB's compaction more aggressive, so it
+	// is off by default.
+	CacheDiscardVersions bool
+
+	// MaxCacheBytes, if set, caps the approximate size of the cached data. Once it is exceeded, the least recently
+	// read entries are evicted. Reads then also record their time, which costs a write each.
+	MaxCacheBytes int64
+
+	// Metrics, if set, is told the duration and error of every exported operation that sends requests to S3, from
+	// Store, Load and Lock to BucketConfig and SwitchEncryption, see the prometheus subpackage for an adapter.
+	Metrics Metrics
+	// Tracer, if set, gets a span for each of these operations, below the span in the context passed to them. See
+	// the otel subpackage for an adapter to OpenTelemetry.
+	Tracer Tracer
+
+	// CacheGCInterval is the time between two garbage collections of the BadgerDB value log, which reclaim the disk
+	// space of expired and overwritten cache entries. It defaults to 10 minutes, a negative value disables it.
+	// Storages sharing a cache directory run a single GC at the interval of the one that opened it. A DB passed in
+	// CacheDB is left to the application.
+	CacheGCInterval time.Duration
+
+	// RecreateCacheOnCorruption wipes and recreates the cache directory if the BadgerDB in it can't be opened,
+	// e.g. after an unclean shutdown, instead of failing to create the storage. It has no effect with CacheDB.
+	RecreateCacheOnCorruption bool
+
+	// ErrorHandler is called with errors that don't fail an operation, such as BadgerDB failing to read or write
+	// the cache, in which case S3 is used instead. They are logged by default.
+	ErrorHandler func(error)
+
+	// Logger receives the messages of the storage, such as the encryption in use and warnings, and a debug record
+	// with the key, duration and cache hit of every operation. It defaults to slog.Default().
+	Logger *slog.Logger
+
+	// CacheDir is the directory of the BadgerDB, by default badger-s3 in the user cache directory. Storages with
+	// the same CacheDir share the DB, keeping their entries apart by CacheNamespace.
+	CacheDir string
+
+	// CacheTempFallback makes NewS3Storage use a BadgerDB in a temporary directory, which is removed on Close,
+	// if the cache directory can't be opened, e.g. because another process uses it. Otherwise that is an error.
+	CacheTempFallback bool
+
+	// DisableCache sends every operation to S3 instead of caching objects in a BadgerDB, e.g. behind a proxy that
+	// caches already. No DB is opened and no cache directory created, CacheDB and the other cache options are
+	// ignored.
+	DisableCache bool
+
+	// CacheDB is optional. If set, it is used for caching instead of the package's own BadgerDB, e.g. to share
+	// a DB the application already uses. The DB is never closed by this package.
+	CacheDB *badger.DB
+	// CachePerProcess gives the storage its own BadgerDB in a directory next to CacheDir that is unique
+	// to the process and storage, instead of the shared one. Badger locks its directory exclusively, so this lets
+	// several processes on one host run side by side, at the cost of not sharing cached values. It is ignored if
+	// CacheDB is set.
+	CachePerProcess bool
+
+	// CacheNamespace is prepended to all cache keys, so that several storages can share one DB without collisions.
+	// It is independent of ObjPrefix and defaults to a hash of Endpoint, Bucket and ObjPrefix.
+	CacheNamespace string
+
+	// TransferAccelerate sends requests through the AWS Transfer Acceleration endpoint, which can speed up
+	// transfers for clients far away from the bucket's region. It must be enabled on the bucket and has no
+	// effect for providers other than AWS.
+	TransferAccelerate bool
+	// TrailingHeaders enables sending checksums in trailing headers, which the provider must support.
+	TrailingHeaders bool
+	// BucketLookup chooses between path-style (https://endpoint/bucket/key) and virtual-hosted-style
+	// (https://bucket.endpoint/key) requests. By default minio picks virtual-hosted-style for AWS and a few other
+	// known providers and path-style otherwise. Set minio.BucketLookupPath for MinIO, Ceph RGW and gateways that
+	// only understand path-style.
+	BucketLookup minio.BucketLookupType
+	// Transport, if set, sends the requests to S3 instead of minio's default transport, e.g. to go through a proxy,
+	// trust additional TLS roots or tune timeouts and connection pooling. Headers and retry handling of this package
+	// are layered on top of it.
+	Transport http.RoundTripper
+	// Insecure connects to S3 with plain HTTP instead of HTTPS, e.g. to a local MinIO during development.
+	// Endpoint may then start with http://.
+	Insecure bool
+
+	// TerminalFunc decides whether a key reported by Stat is terminal, i.e. a file rather than a directory.
+	// By default existing objects are terminal and prefixes with objects below them are not.
+	TerminalFunc func(key string) bool
+
+	// LockCodec serializes lock files, by default with TextLockCodec. Set it to share locks with another storage
+	// backend using the same bucket and keys.
+	LockCodec LockCodec
+
+	// LockExpiration is the age after which a lock file that was not renewed is considered stale, LockPollInterval
+	// the time between two attempts to acquire a held lock and LockTimeout the time after which acquiring a lock is
+	// given up, negative to wait until the context is done. They default to the package variables of the same name.
+	LockExpiration   time.Duration
+	LockPollInterval time.Duration
+	LockTimeout      time.Duration
+
+	// RetryBudget bounds the retries of all requests Lock, LockLease and SwitchEncryption make to this many in
+	// total, instead of allowing minio.MaxRetry for each of them. See WithRetryBudget for other operations.
+	RetryBudget int
+
+	// OnLockStolen is called when Lock takes over an expired lock of someone else, who may still believe to hold
+	// it. previousOwner is empty for lock files written by older versions.
+	OnLockStolen func(key, previousOwner string)
+
+	// SortedList makes List return keys in lexicographic order. Most providers already list in that order,
+	// but S3 does not guarantee it.
+	SortedList bool
+
+	// EmptyObjectsMissing makes Load and Stat report empty objects as not existing. Empty objects are most
+	// likely the result of a botched write, by default they are returned as is and a warning is logged.
+	EmptyObjectsMissing bool
+
+	// CachePolicy decides whether Load and Exists confirm cached values with S3, CacheRevalidate by default.
+	// CacheStaleGrace takes precedence for Load.
+	CachePolicy CachePolicy
+
+	// IssuerPrefixes maps issuer keys as used by CertMagic, e.g. acme-v02.api.letsencrypt.org-directory, to the
+	// prefix to store their certificates and accounts under instead of ObjPrefix. Other keys stay under ObjPrefix.
+	IssuerPrefixes map[string]string
+
+	// DeriveKeys encrypts every object with its own key, derived from EncryptionKey and the object's key, instead of
+	// EncryptionKey itself. Objects encrypted before it was enabled remain readable.
+	DeriveKeys bool
+
+	// Compression compresses objects before they are encrypted, CompressionNone by default. Objects stored
+	// uncompressed remain readable after it is enabled.
+	Compression Compression
+
+	// IOLayers, if set, replaces the IO chosen by EncryptionKey with a chain of layers, applied in order when
+	// storing and in reverse order when loading, e.g. []IOLayer{GzipLayer(), SecretBoxLayer(key)} to compress
+	// before encrypting.
+	IOLayers []IOLayer
+
+	// ExtraHeaders are added to every request sent to S3, e.g. API keys or tenant IDs required by a gateway.
+	// Use WithExtraHeaders to add headers to a single call. They are added after the request was signed, so
+	// X-Amz-* headers can't be set this way.
+	ExtraHeaders http.Header
+
+	// ContentEncoding is set as Content-Encoding of stored objects, for values the application compressed itself.
+	// Use WithContentEncoding to set it for a single call. Load returns the stored bytes as is, decoding them is
+	// up to the caller. It can't be combined with EncryptionKey as the stored bytes are encrypted.
+	ContentEncoding string
+
+	// ListCacheTTL, if set, keeps the results of List in memory for this long. Stores and deletes through this
+	// storage drop the affected listings, but changes made by others only show up once they expire.
+	ListCacheTTL time.Duration
+
+	// CircuitBreakerThreshold, if set, makes all operations fail fast with ErrCircuitOpen once this many requests
+	// to S3 failed in a row, so that an outage doesn't pile up requests waiting for their timeouts. After
+	// CircuitBreakerCooldown (30s by default) a single operation is let through to probe S3. Its success closes the
+	// breaker, its failure opens it for another cooldown.
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+
+	// SlowOpThreshold, if set, logs a warning for every request to S3 that takes longer, naming the method, object
+	// and duration. Retries are requests of their own.
+	SlowOpThreshold time.Duration
+
+	// PreviousObjPrefix is the ObjPrefix used before, if it was changed. If nothing is stored under ObjPrefix and
+	// IssuerPrefixes yet but there are objects under PreviousObjPrefix, NewS3Storage warns that they won't be found.
+	PreviousObjPrefix string
+	// LegacyPrefixes are searched, in order, by Load for objects missing under their prefix, e.g. because they
+	// were stored before ObjPrefix was set. An empty string stands for objects stored without a prefix.
+	LegacyPrefixes []string
+	// MigrateLegacyObjects copies objects Load found under LegacyPrefixes to their prefix. The legacy object is
+	// left in place.
+	MigrateLegacyObjects bool
+
+	// MigratePreviousPrefix makes NewS3Storage copy the objects from PreviousObjPrefix to ObjPrefix in that case,
+	// instead of only warning. Keys of issuers in IssuerPrefixes are copied to their issuer's prefix. The objects
+	// under PreviousObjPrefix are left in place.
+	MigratePreviousPrefix bool
+
+	// ChecksumAlgorithm, one of CRC32, CRC32C, SHA1 or SHA256, makes Store send a checksum of this algorithm
+	// along with every object, which S3 verifies and keeps with the object.
+	ChecksumAlgorithm string
+	// VerifyChecksum makes Load ask S3 for the checksums of objects and fail with ErrChecksumMismatch if the
+	// object read doesn't match them. Objects stored without a checksum are accepted as is.
+	VerifyChecksum bool
+
+	// VerifyWrite makes NewS3Storage write and delete a small probe object under ObjPrefix, so that missing write
+	// permissions are reported right away instead of on the first Store.
+	VerifyWrite bool
+
+	// ConnectTimeout bounds the checks NewS3Storage runs against S3, 5s by default.
+	ConnectTimeout time.Duration
+	// SkipBucketCheck makes NewS3Storage not check that Bucket exists, for credentials that may not access the
+	// bucket itself but only objects in it.
+	SkipBucketCheck bool
+
+	// MirrorBuckets are further buckets, e.g. in another region or at another provider, that every Store, Delete
+	// and DeletePrefix is applied to as well. Load falls back to them in order if the object can't be read from
+	// this bucket, and copies what it read from a mirror back in the background. Locks, List, Stat and Exists only
+	// use this bucket. Mirrors don't cache, Logger and Tracer default to the ones of this storage.
+	MirrorBuckets []S3Opts
 }
 
 type S3Storage struct {
 	prefix   string
 	bucket   string
 	s3client *minio.Client
+	cache    *cache
 
+	// ioMu guards iowrap and prevIO, which change with SwitchEncryption
+	ioMu   sync.RWMutex
 	iowrap IO
+	// prevIO is the IO objects may still be written with while switching encryption
+	prevIO IO
+
+	staleGrace   time.Duration
+	defaultTTL   time.Duration
+	ttlByPrefix  map[string]time.Duration
+	terminalFunc func(key string) bool
+	onLockStolen func(key, previousOwner string)
+	retryBudget  int
+	lockCodec    LockCodec
+	sse          encrypt.ServerSide
+	// lockExpiration, lockPollInterval and lockTimeout are the lock timing, lockTimeout is zero to wait until the
+	// context is done
+	lockExpiration   time.Duration
+	lockPollInterval time.Duration
+	lockTimeout      time.Duration
+	cachePolicy      CachePolicy
+	// issuerPrefixes maps issuer keys to the prefix used instead of prefix for their keys
+	issuerPrefixes map[string]string
+	// emptyAsMissing makes Load and Stat treat empty objects as missing
+	emptyAsMissing bool
+	sortedList     bool
+	// contentEncoding is the default Content-Encoding of stored objects
+	contentEncoding string
+	// legacyPrefixes are searched for objects missing under their prefix
+	legacyPrefixes []string
+	migrateLegacy  bool
+	// checksumAlgorithm is the algorithm of the checksum sent with stored objects, none if empty
+	checksumAlgorithm string
+	verifyChecksum    bool
+	// breaker is nil unless CircuitBreakerThreshold is set
+	breaker *circuitBreaker
+	// listCache is nil unless ListCacheTTL is set
+	listCache *listCache
+	// cacheDir is the directory of the BadgerDB if the storage opened its own
+	cacheDir string
+	// tempCacheDir is true if cacheDir is a temporary directory to remove on Close
+	tempCacheDir bool
+	// sharedDir is the directory of the shared BadgerDB the storage holds a reference to, if any
+	sharedDir string
+	// gcStop and gcDone stop the value log GC of a BadgerDB the storage opened, they are nil if it doesn't run
+	gcStop chan struct{}
+	gcDone chan struct{}
+	// metrics is noopMetrics unless S3Opts.Metrics is set
+	metrics Metrics
+	// tracer is noopTracer unless S3Opts.Tracer is set
+	tracer Tracer
+	logger *slog.Logger
+	// mirrors are the storages of S3Opts.MirrorBuckets
+	mirrors []*S3Storage
+	// repopulating holds the keys currently being copied back from a mirror
+	repopulating sync.Map
+	// skipBucketCheck makes HealthCheck probe an object instead of the bucket
+	skipBucketCheck bool
+	closeOnce       sync.Once
+	// closed is set once Close was called
+	closed int32
+	// bgCtx is cancelled by Close, bg tracks the goroutines started with background. bgMu makes sure none is
+	// started once Close waits for them.
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+	bgMu     sync.Mutex
+	bg       sync.WaitGroup
+	// revalidating holds the keys currently being refreshed in the background
+	revalidating sync.Map
+	// locks maps the keys locked through Lock to the lease renewing their lock file
+	locks sync.Map
 }
 
 func NewS3Storage(opts S3Opts) (*S3Storage, error) {
+	if err := ValidateOpts(opts); err != nil {
+		return nil, err
+	}
+	opts.ObjPrefix = strings.Trim(opts.ObjPrefix, "/")
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Passphrase != "" {
+		opts.EncryptionKey = PassphraseKey(opts.Passphrase, opts.PassphraseSalt)
+	}
+
 	gs3 := &S3Storage{
-		prefix: opts.ObjPrefix,
-		bucket: opts.Bucket,
+		prefix:            opts.ObjPrefix,
+		bucket:            opts.Bucket,
+		staleGrace:        opts.CacheStaleGrace,
+		defaultTTL:        opts.CacheTTL,
+		ttlByPrefix:       opts.CacheTTLByPrefix,
+		terminalFunc:      opts.TerminalFunc,
+		onLockStolen:      opts.OnLockStolen,
+		checksumAlgorithm: strings.ToUpper(opts.ChecksumAlgorithm),
+		verifyChecksum:    opts.VerifyChecksum,
+		migrateLegacy:     opts.MigrateLegacyObjects,
+		retryBudget:       opts.RetryBudget,
+		lockCodec:         opts.LockCodec,
+		sse:               opts.SSE,
+		lockExpiration:    opts.LockExpiration,
+		lockPollInterval:  opts.LockPollInterval,
+		lockTimeout:       opts.LockTimeout,
+		metrics:           opts.Metrics,
+		tracer:            opts.Tracer,
+		logger:            opts.Logger,
+
+		cachePolicy:    opts.CachePolicy,
+		issuerPrefixes: map[string]string{},
+		emptyAsMissing: opts.EmptyObjectsMissing,
+		sortedList:     opts.SortedList,
+
+		contentEncoding: opts.ContentEncoding,
+	}
+	gs3.bgCtx, gs3.bgCancel = context.WithCancel(context.Background())
+	if gs3.cachePolicy == "" {
+		gs3.cachePolicy = CacheRevalidate
+	}
+	if gs3.metrics == nil {
+		gs3.metrics = noopMetrics{}
+	}
+	if gs3.tracer == nil {
+		gs3.tracer = noopTracer{}
+	}
+	if gs3.defaultTTL == 0 {
+		gs3.defaultTTL = defaultCacheTTL
+	}
+	if gs3.lockCodec == nil {
+		gs3.lockCodec = TextLockCodec{}
+	}
+	if gs3.lockExpiration == 0 {
+		gs3.lockExpiration = LockExpiration
+	}
+	if gs3.lockPollInterval == 0 {
+		gs3.lockPollInterval = LockPollInterval
+	}
+	switch {
+	case gs3.lockTimeout == 0:
+		gs3.lockTimeout = LockTimeout
+	case gs3.lockTimeout < 0:
+		gs3.lockTimeout = 0
+	}
+	for _, prefix := range opts.LegacyPrefixes {
+		gs3.legacyPrefixes = append(gs3.legacyPrefixes, strings.Trim(prefix, "/"))
+	}
+	for issuer, prefix := range opts.IssuerPrefixes {
+		gs3.issuerPrefixes[issuer] = strings.Trim(prefix, "/")
+	}
+	if opts.ListCacheTTL > 0 {
+		gs3.listCache = newListCache(opts.ListCacheTTL)
+	}
+
+	cacheDb := opts.CacheDB
+	if opts.DisableCache {
+		cacheDb = nil
+	}
+	gcInterval := opts.CacheGCInterval
+	if gcInterval == 0 {
+		gcInterval = defaultCacheGCInterval
+	}
+	var openErr error
+	if cacheDb == nil && !opts.DisableCache {
+		baseDir := opts.CacheDir
+		if baseDir == "" {
+			baseDir = defaultCacheDir()
+		}
+		if opts.CachePerProcess {
+			dir := processCacheDir(baseDir)
+			if cacheDb, openErr = openCacheDB(dir, opts.RecreateCacheOnCorruption, opts.Logger); openErr == nil {
+				gs3.cacheDir = dir
+			} else {
+				openErr = fmt.Errorf("opening cache in %s failed: %w", dir, openErr)
+			}
+		} else if cacheDb, openErr = acquireSharedDB(baseDir, opts.RecreateCacheOnCorruption, gcInterval, opts.Logger); openErr == nil {
+			gs3.sharedDir = baseDir
+		}
+	}
+	if openErr != nil {
+		if !opts.CacheTempFallback {
+			return nil, openErr
+		}
+		opts.Logger.Warn("Using a temporary cache instead", "error", openErr)
+		db, dir, err := openTempCacheDB()
+		if err != nil {
+			return nil, fmt.Errorf("opening temporary cache failed: %w", err)
+		}
+		cacheDb, gs3.cacheDir, gs3.tempCacheDir = db, dir, true
+	}
+	// Don't hold on to the cache if the storage can't be created
+	created := false
+	defer func() {
+		if !created {
+			_ = gs3.Close()
+		}
+	}()
+
+	namespace := opts.CacheNamespace
+	if namespace == "" {
+		namespace = defaultCacheNamespace(opts)
+	}
+	gs3.cache = newCache(cacheDb, namespace)
+	gs3.cache.slidingTTL = opts.CacheSlidingTTL
+	gs3.cache.compress = opts.CompressCache
+	gs3.cache.discardVersions = opts.CacheDiscardVersions
+	gs3.cache.maxBytes = opts.MaxCacheBytes
+	gs3.cache.onError = func(err error) { opts.Logger.Warn("Cache error", "error", err) }
+	if opts.ErrorHandler != nil {
+		gs3.cache.onError = opts.ErrorHandler
 	}
 
-	if opts.EncryptionKey == nil || len(opts.EncryptionKey) == 0 {
-		log.Println("Clear text certificate storage active")
+	if len(opts.IOLayers) > 0 {
+		ch, err := NewChainIO(opts.IOLayers...)
+		if err != nil {
+			return nil, err
+		}
+		opts.Logger.Info("Certificate storage with IO layers active", "layers", len(ch.Layers))
+		gs3.iowrap = ch
+	} else if opts.KMS != nil {
+		opts.Logger.Info("Encrypted certificate storage with KMS data keys active")
+		gs3.iowrap = &KMSIO{Provider: opts.KMS}
+	} else if keys := encryptionKeys(opts); len(keys) == 0 {
+		opts.Logger.Info("Clear text certificate storage active")
 		gs3.iowrap = &CleartextIO{}
-	} else if len(opts.EncryptionKey) != 32 {
-		return nil, errors.New("encryption key must have exactly 32 bytes")
 	} else {
-		log.Println("Encrypted certificate storage active")
-		sb := &SecretBoxIO{}
-		copy(sb.SecretKey[:], opts.EncryptionKey)
-		gs3.iowrap = sb
+		if opts.DeriveKeys {
+			opts.Logger.Info("Encrypted certificate storage with per-object keys active")
+		} else if opts.EncryptionAlgorithm == EncryptionAESGCM {
+			opts.Logger.Info("Encrypted certificate storage with AES-GCM active")
+		} else {
+			opts.Logger.Info("Encrypted certificate storage active")
+		}
+		if len(keys) > 1 {
+			opts.Logger.Info("Decrypting with older encryption keys as well", "keys", len(keys)-1)
+		}
+		keyIOs := make([]IO, len(keys))
+		for i, key := range keys {
+			keyIOs[i] = newKeyIO(opts, key)
+		}
+		env, err := NewEnvelopeIO(keyIOs...)
+		if err != nil {
+			return nil, err
+		}
+		gs3.iowrap = env
+	}
+	if opts.Compression == CompressionGzip {
+		if _, ok := gs3.iowrap.(*CleartextIO); ok {
+			gs3.iowrap = &GzipIO{}
+		} else {
+			gs3.iowrap = &ChainIO{Layers: []IO{&GzipIO{}, gs3.iowrap}}
+		}
 	}
 
 	var err error
-	gs3.s3client, err = minio.New(opts.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(opts.AccessKeyID, opts.SecretAccessKey, ""),
-		Secure: true,
-	})
+	if opts.CircuitBreakerThreshold > 0 {
+		gs3.breaker = newCircuitBreaker(opts.CircuitBreakerThreshold, opts.CircuitBreakerCooldown)
+	}
+	gs3.s3client, err = newS3Client(opts, gs3.breaker)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	timeout := opts.ConnectTimeout
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	ok, err := gs3.s3client.BucketExists(ctx, opts.Bucket)
-	if err != nil {
+	gs3.skipBucketCheck = opts.SkipBucketCheck
+	if !opts.SkipBucketCheck {
+		ok, err := gs3.s3client.BucketExists(ctx, opts.Bucket)
+		if minio.ToErrorResponse(err).Code == "AccessDenied" {
+			return nil, fmt.Errorf("checking S3 bucket %s failed, set SkipBucketCheck if the credentials only grant access to objects: %w", opts.Bucket, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("S3 bucket %s does not exist", opts.Bucket)
+		}
+	}
+
+	if opts.VerifyWrite {
+		if err := gs3.verifyWrite(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PreviousObjPrefix != "" {
+		// Copying may take longer than the checks above
+		if err := gs3.checkPreviousPrefix(context.Background(), opts.PreviousObjPrefix, opts.MigratePreviousPrefix); err != nil {
+			return nil, err
+		}
+	}
+	if err := gs3.openMirrors(opts); err != nil {
 		return nil, err
 	}
-	if !ok {
-		return nil, fmt.Errorf("S3 bucket %s does not exist", opts.Bucket)
+	// The GC of a shared cache is run by acquireSharedDB
+	if gs3.cacheDir != "" && gcInterval > 0 {
+		gs3.gcStop, gs3.gcDone = make(chan struct{}), make(chan struct{})
+		go collectCacheGarbage(cacheDb, gs3.cacheDir, gcInterval, gs3.gcStop, gs3.gcDone, opts.Logger)
 	}
+	created = true
 	return gs3, nil
 }
 
-var (
-	LockExpiration   = 2 * time.Minute
-	LockPollInterval = 1 * time.Second
-	LockTimeout      = 15 * time.Second
-)
+// encryptionKeys returns the keys to encrypt with, the one to write with first, or nil to store cleartext.
+func encryptionKeys(opts S3Opts) [][]byte {
+	if len(opts.EncryptionKeys) > 0 {
+		return opts.EncryptionKeys
+	}
+	if len(opts.EncryptionKey) > 0 {
+		return [][]byte{opts.EncryptionKey}
+	}
+	return nil
+}
 
-func (gs *S3Storage) Lock(ctx context.Context, key string) error {
-	// There is no need to lock any file if it is cached so we return if it is cached
-	if isCacheEntryExistent([]byte(key)) {
-		return nil
+// newKeyIO returns the IO encrypting with key as configured by opts.
+func newKeyIO(opts S3Opts, key []byte) IO {
+	switch {
+	case opts.DeriveKeys:
+		d := &DerivedSecretBoxIO{}
+		copy(d.MasterKey[:], key)
+		return d
+	case opts.EncryptionAlgorithm == EncryptionAESGCM:
+		ag := &AESGCMIO{}
+		copy(ag.SecretKey[:], key)
+		return ag
 	}
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], key)
+	return sb
+}
 
-	var startedAt = time.Now()
+// defaultConnectTimeout bounds the checks of NewS3Storage unless ConnectTimeout is set
+const defaultConnectTimeout = 5 * time.Second
 
-	for {
-		obj, err := gs.s3client.GetObject(ctx, gs.bucket, gs.objLockName(key), minio.GetObjectOptions{})
-		if err == nil {
-			return gs.putLockFile(key)
+// writeProbeKey is the key of the object written by verifyWrite
+const writeProbeKey = ".badger-s3-write-probe"
+
+// verifyWrite checks that objects can be stored and deleted under the prefix.
+func (gs *S3Storage) verifyWrite(ctx context.Context) error {
+	name := gs.objName(writeProbeKey)
+	_, err := gs.s3client.PutObject(ctx, gs.bucket, name, strings.NewReader("probe"), 5, minio.PutObjectOptions{ServerSideEncryption: gs.sse})
+	if err != nil {
+		return fmt.Errorf("S3 bucket %s is not writable, storing %s failed: %w", gs.bucket, name, err)
+	}
+	if err := gs.s3client.RemoveObject(ctx, gs.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("S3 bucket %s does not allow deletes, removing %s failed: %w", gs.bucket, name, err)
+	}
+	return nil
+}
+
+// ValidateOpts checks opts for mistakes without connecting to S3 or opening a cache. NewS3Storage calls it first.
+// A leading or trailing slash in ObjPrefix is not an error, NewS3Storage strips it.
+func ValidateOpts(opts S3Opts) error {
+	if _, err := normalizeEndpoint(opts.Endpoint, opts.Insecure); err != nil {
+		return err
+	}
+	if opts.Bucket == "" {
+		return errors.New("S3 bucket is empty, set Bucket to the name of an existing bucket")
+	}
+	if (opts.AccessKeyID == "") != (opts.SecretAccessKey == "") {
+		return errors.New("AccessKeyID and SecretAccessKey must be set together, set both or neither for anonymous access")
+	}
+	switch opts.CredentialProvider {
+	case "", CredentialsStatic, CredentialsIAM, CredentialsEnv, CredentialsFileMinio:
+	default:
+		return fmt.Errorf("unknown CredentialProvider %q, use %q, %q, %q or %q", opts.CredentialProvider,
+			CredentialsStatic, CredentialsIAM, CredentialsEnv, CredentialsFileMinio)
+	}
+	if strings.Contains(strings.Trim(opts.ObjPrefix, "/"), "//") {
+		return fmt.Errorf("ObjPrefix %q contains an empty path segment", opts.ObjPrefix)
+	}
+	for k := range opts.ExtraHeaders {
+		if signedHeader(k) {
+			return fmt.Errorf("ExtraHeaders can't contain %s, X-Amz-* headers must be signed and extra headers aren't", k)
 		}
-		buf, err := ioutil.ReadAll(obj)
-		if err != nil {
-			// Retry
-			continue
+	}
+
+	if len(opts.EncryptionKey) > 0 && len(opts.EncryptionKeys) > 0 {
+		return errors.New("EncryptionKey and EncryptionKeys can't both be set, put EncryptionKey into EncryptionKeys")
+	}
+	if opts.Passphrase != "" {
+		if len(opts.EncryptionKey) > 0 || len(opts.EncryptionKeys) > 0 {
+			return errors.New("Passphrase can't be combined with EncryptionKey or EncryptionKeys")
 		}
-		lt, err := time.Parse(time.RFC3339, string(buf))
-		if err != nil {
-			// Lock file does not make sense, overwrite.
-			return gs.putLockFile(key)
+		if len(opts.PassphraseSalt) < minPassphraseSaltLen {
+			return fmt.Errorf("Passphrase requires a PassphraseSalt of at least %d bytes, got %d", minPassphraseSaltLen, len(opts.PassphraseSalt))
 		}
-		if lt.Add(LockTimeout).Before(time.Now()) {
-			// Existing lock file expired, overwrite.
-			return gs.putLockFile(key)
+		// The derived key is checked like any other key below
+		opts.EncryptionKey = make([]byte, 32)
+	}
+	keys := encryptionKeys(opts)
+	for _, key := range keys {
+		if len(key) != 32 {
+			return fmt.Errorf("encryption key must have exactly 32 bytes, got %d", len(key))
+		}
+	}
+	if opts.DeriveKeys && len(keys) == 0 {
+		return errors.New("DeriveKeys requires EncryptionKey to be set")
+	}
+	switch opts.EncryptionAlgorithm {
+	case "", EncryptionSecretBox:
+	case EncryptionAESGCM:
+		if opts.DeriveKeys {
+			return errors.New("DeriveKeys is only supported with EncryptionSecretBox")
 		}
+	default:
+		return fmt.Errorf("unknown EncryptionAlgorithm %q, use %q or %q", opts.EncryptionAlgorithm, EncryptionSecretBox, EncryptionAESGCM)
+	}
+	if opts.SSE != nil && opts.SSE.Type() == encrypt.SSEC && opts.Insecure {
+		return errors.New("SSE-C sends the encryption key with every request and requires HTTPS, it can't be combined with Insecure")
+	}
+	switch opts.Compression {
+	case CompressionNone, CompressionGzip:
+	default:
+		return fmt.Errorf("unknown Compression %q, use %q", opts.Compression, CompressionGzip)
+	}
+	if opts.Compression != CompressionNone && len(opts.IOLayers) > 0 {
+		return errors.New("Compression can't be combined with IOLayers, use GzipLayer instead")
+	}
+	if len(keys) > 0 && len(opts.IOLayers) > 0 {
+		return errors.New("EncryptionKey can't be combined with IOLayers, use SecretBoxLayer instead")
+	}
+	if opts.KMS != nil && (len(keys) > 0 || len(opts.IOLayers) > 0) {
+		return errors.New("KMS can't be combined with EncryptionKey or IOLayers")
+	}
+	if opts.ContentEncoding != "" && (len(keys) > 0 || len(opts.IOLayers) > 0 || opts.KMS != nil) {
+		return ErrContentEncodingEncrypted
+	}
+
+	switch opts.CachePolicy {
+	case "", CacheRevalidate, CacheTrustCache, CacheTrustS3:
+	default:
+		return fmt.Errorf("unknown CachePolicy %q, use %q, %q or %q", opts.CachePolicy, CacheRevalidate, CacheTrustCache, CacheTrustS3)
+	}
 
-		if startedAt.Add(LockTimeout).Before(time.Now()) {
-			return errors.New("acquiring lock failed")
+	for name, d := range map[string]time.Duration{
+		"ConnectTimeout":   opts.ConnectTimeout,
+		"LockExpiration":   opts.LockExpiration,
+		"LockPollInterval": opts.LockPollInterval,
+		"CacheStaleGrace":  opts.CacheStaleGrace,
+		"CacheSlidingTTL":  opts.CacheSlidingTTL,
+		"ListCacheTTL":     opts.ListCacheTTL,
+		"SlowOpThreshold":  opts.SlowOpThreshold,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative, got %v", name, d)
+		}
+	}
+	if _, ok := checksumAlgorithms[strings.ToUpper(opts.ChecksumAlgorithm)]; !ok && opts.ChecksumAlgorithm != "" {
+		return fmt.Errorf("unknown ChecksumAlgorithm %q, use CRC32, CRC32C, SHA1 or SHA256", opts.ChecksumAlgorithm)
+	}
+	if opts.RetryBudget < 0 {
+		return fmt.Errorf("RetryBudget must not be negative, got %d", opts.RetryBudget)
+	}
+	if opts.MaxCacheBytes < 0 {
+		return fmt.Errorf("MaxCacheBytes must not be negative, got %d", opts.MaxCacheBytes)
+	}
+	for prefix, ttl := range opts.CacheTTLByPrefix {
+		if ttl == 0 {
+			return fmt.Errorf("CacheTTLByPrefix for %q must not be zero", prefix)
+		}
+	}
+	for _, mirror := range opts.MirrorBuckets {
+		if len(mirror.MirrorBuckets) > 0 {
+			return fmt.Errorf("mirror bucket %s can't have MirrorBuckets of its own", mirror.Bucket)
+		}
+		if err := ValidateOpts(mirror); err != nil {
+			return fmt.Errorf("mirror bucket %s: %w", mirror.Bucket, err)
 		}
-		time.Sleep(LockPollInterval)
 	}
-	return errors.New("locking failed")
+	return nil
 }
 
-func (gs *S3Storage) putLockFile(key string) error {
-	// Object does not exist, we're creating a lock file.
-	r := bytes.NewReader([]byte(time.Now().Format(time.RFC3339)))
-	_, err := gs.s3client.PutObject(context.Background(), gs.bucket, gs.objLockName(key), r, int64(r.Len()), minio.PutObjectOptions{})
-	return err
+// defaultCacheNamespace derives a cache namespace from the location of the objects, so that storages for
+// different buckets or prefixes never see each other's entries.
+func defaultCacheNamespace(opts S3Opts) string {
+	endpoint, err := normalizeEndpoint(opts.Endpoint, opts.Insecure)
+	if err != nil {
+		endpoint = opts.Endpoint
+	}
+	sum := sha256.Sum256([]byte(endpoint + "\x00" + opts.Bucket + "\x00" + opts.ObjPrefix))
+	return hex.EncodeToString(sum[:8])
 }
 
-func (gs *S3Storage) Unlock(ctx context.Context, key string) error {
-	// There is no need to unlock any file if it is cached so we return if it is cached
-	if isCacheEntryExistent([]byte(key)) {
-		return nil
+// s3AccelerateEndpoint is the AWS Transfer Acceleration endpoint
+const s3AccelerateEndpoint = "s3-accelerate.amazonaws.com"
+
+// newS3Client creates the minio client described by opts. The breaker is optional.
+func newS3Client(opts S3Opts, breaker *circuitBreaker) (*minio.Client, error) {
+	endpoint, err := normalizeEndpoint(opts.Endpoint, opts.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	mopts, err := minioOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if breaker != nil {
+		mopts.Transport = &breakerTransport{base: mopts.Transport, breaker: breaker}
 	}
+	// Outermost, so that every request sent again is charged to the retry budget and counted by the breaker
+	mopts.Transport = &retryAfterTransport{base: mopts.Transport}
 
-	return gs.s3client.RemoveObject(ctx, gs.bucket, gs.objLockName(key), minio.RemoveObjectOptions{})
+	client, err := minio.New(endpoint, mopts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", opts.Endpoint, err)
+	}
+	if opts.TransferAccelerate {
+		// This is silently ignored for endpoints other than AWS
+		client.SetS3TransferAccelerate(s3AccelerateEndpoint)
+	}
+	return client, nil
+}
+
+// minioOptions returns the minio client options for opts.
+func minioOptions(opts S3Opts) (*minio.Options, error) {
+	base := opts.Transport
+	if base == nil {
+		tr, err := minio.DefaultTransport(!opts.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		base = tr
+	}
+	if opts.SlowOpThreshold > 0 {
+		base = &slowOpTransport{base: base, threshold: opts.SlowOpThreshold, logger: opts.Logger}
+	}
+
+	return &minio.Options{
+		Creds:           credentials.New(credentialsProvider(opts)),
+		Secure:          !opts.Insecure,
+		Transport:       &headerTransport{base: &budgetTransport{base: base}, headers: opts.ExtraHeaders.Clone()},
+		TrailingHeaders: opts.TrailingHeaders,
+		Region:          opts.Region,
+		BucketLookup:    opts.BucketLookup,
+	}, nil
+}
+
+// normalizeEndpoint turns common ways of writing the endpoint into the plain host[:port] minio expects,
+// e.g. "https://s3.example.com/" becomes "s3.example.com". With insecure, the scheme has to be http:// instead.
+func normalizeEndpoint(endpoint string, insecure bool) (string, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return "", errors.New("S3 endpoint is empty, set it to the host name of your provider, e.g. s3.amazonaws.com")
+	}
+	scheme := "https://"
+	switch {
+	case insecure && strings.HasPrefix(endpoint, "https://"):
+		return "", fmt.Errorf("S3 endpoint %q uses https://, but Insecure is set", endpoint)
+	case insecure:
+		scheme = "http://"
+	case strings.HasPrefix(endpoint, "http://"):
+		return "", fmt.Errorf("S3 endpoint %q uses http://, only HTTPS endpoints are supported unless Insecure is set", endpoint)
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(endpoint, scheme), "/")
+	if strings.Contains(host, "/") {
+		return "", fmt.Errorf("S3 endpoint %q must not contain a path, set only the host name and put the bucket into Bucket", endpoint)
+	}
+	return host, nil
+}
+
+type contentEncodingKey struct{}
+
+// WithContentEncoding returns a context that makes Store set the given Content-Encoding instead of the one
+// configured in S3Opts.ContentEncoding.
+func WithContentEncoding(ctx context.Context, encoding string) context.Context {
+	return context.WithValue(ctx, contentEncodingKey{}, encoding)
+}
+
+// ErrClosed is returned by operations on a storage after Close was called.
+var ErrClosed = errors.New("storage is closed")
+
+// ErrContentEncodingEncrypted is returned when a Content-Encoding is requested while EncryptionKey is set.
+var ErrContentEncodingEncrypted = errors.New("encrypted objects can't have a content encoding")
+
+func (gs *S3Storage) Store(ctx context.Context, key string, value []byte) (err error) {
+	ctx, op := gs.startOp(ctx, "Store", key)
+	defer op.end(&err)
+	op.span.SetAttribute(AttrBytes, int64(len(value)))
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	return gs.toMirrors(gs.storeObject(ctx, key, value), func(m *S3Storage) error {
+		return m.storeObject(ctx, key, value)
+	})
+}
+
+// storeObject writes value to the object of key in this storage's bucket and caches it.
+func (gs *S3Storage) storeObject(ctx context.Context, key string, value []byte) error {
+	info, err := gs.putObject(ctx, key, value)
+	gs.invalidateListings(key)
+	// Whatever was cached for key is outdated now, or may be if the write failed half way. Stat looks up size and
+	// modification time again on its next call.
+	gs.deleteCacheEntry(key)
+	if err != nil {
+		return err
+	}
+
+	// Write through, so that the new value is served right away instead of once the old one expired
+	if len(value) > 0 || !gs.emptyAsMissing {
+		gs.cacheValue(ctx, key, value, info.ETag)
+	}
+	return nil
 }
 
-func (gs *S3Storage) Store(ctx context.Context, key string, value []byte) error {
-	r := gs.iowrap.ByteReader(value)
-	_, err := gs.s3client.PutObject(ctx,
-		gs.bucket,
-		gs.objName(key),
-		r,
-		int64(r.Len()),
-		minio.PutObjectOptions{},
+// putObject encodes value and writes it to the object of key, without touching the cache.
+func (gs *S3Storage) putObject(ctx context.Context, key string, value []byte) (minio.UploadInfo, error) {
+	encoding := gs.contentEncoding
+	if e, ok := ctx.Value(contentEncodingKey{}).(string); ok {
+		encoding = e
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return minio.UploadInfo{}, err
+	}
+	iowrap, _ := gs.ioSchemes()
+	body, size, putOpts, err := gs.encodeObject(ctx, iowrap, key, value, encoding)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return gs.s3client.PutObject(ctx, gs.bucket, gs.objName(key), body, size, putOpts)
+}
+
+// encodeObject encodes value for key with iowrap and returns the body to upload together with its size and the
+// options recording how it was written, its checksum and Content-Encoding.
+func (gs *S3Storage) encodeObject(ctx context.Context, iowrap IO, key string, value []byte, encoding string) (io.Reader, int64, minio.PutObjectOptions, error) {
+	if _, ok := iowrap.(*CleartextIO); !ok && encoding != "" {
+		return nil, 0, minio.PutObjectOptions{}, ErrContentEncodingEncrypted
+	}
+
+	r := ioFor(ctx, iowrap, key).ByteReader(value)
+	var (
+		body    io.Reader = r
+		putOpts           = minio.PutObjectOptions{ContentEncoding: encoding, UserMetadata: schemeMetadata(iowrap), ServerSideEncryption: gs.sse}
 	)
-	return err
+	if gs.checksumAlgorithm != "" {
+		// The checksum is sent up front, so the stored bytes have to be known in advance
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return nil, 0, putOpts, err
+		}
+		if putOpts.UserMetadata == nil {
+			putOpts.UserMetadata = map[string]string{}
+		}
+		putOpts.UserMetadata[checksumHeader(gs.checksumAlgorithm)] = checksum(gs.checksumAlgorithm, buf)
+		body = bytes.NewReader(buf)
+	}
+	return body, r.Len(), putOpts, nil
 }
 
-func (gs *S3Storage) Load(ctx context.Context, key string) ([]byte, error) {
+func (gs *S3Storage) Load(ctx context.Context, key string) (buf []byte, err error) {
+	ctx, op := gs.startOp(ctx, "Load", key)
+	defer func() {
+		op.span.SetAttribute(AttrBytes, int64(len(buf)))
+		op.end(&err)
+	}()
+	if err := gs.checkClosed(); err != nil {
+		return nil, err
+	}
+	if gs.staleGrace > 0 {
+		// The entry outlives its TTL by the grace period, anything past the TTL is stale but still served
+		if buf, expiresAt, ok := gs.cache.getCacheEntryWithExpiry(ctx, []byte(key)); ok {
+			if !expiresAt.IsZero() && time.Until(expiresAt) < gs.staleGrace {
+				gs.revalidate(key)
+			}
+			gs.recordCache(ctx, true)
+			return buf, nil
+		}
+		gs.recordCache(ctx, false)
+		return gs.loadFromS3(ctx, key)
+	}
+
+	if gs.cachePolicy == CacheTrustS3 {
+		// Revalidates the cached copy, if there is one, with a conditional GET
+		gs.recordCache(ctx, false)
+		return gs.loadFromS3(ctx, key)
+	}
+
 	// We try to get the cached file from our storage here
-	if isCacheEntryExistent([]byte(key)) {
-		// Get the key info
-		rawKi := getCacheEntry([]byte(key))
-		if rawKi != nil {
-			// We have the cached file, return it as a byte array
-			return []byte(*rawKi), nil
+	if cached, ok := gs.cache.getCacheEntry(ctx, []byte(key)); ok {
+		if gs.cachePolicy == CacheRevalidate {
+			if fresh, err := gs.revalidateCached(ctx, key); err != nil {
+				return nil, err
+			} else if !fresh {
+				gs.recordCache(ctx, false)
+				return gs.loadFromS3(ctx, key)
+			}
 		}
+		// We have the cached file
+		gs.recordCache(ctx, true)
+		return cached, nil
+	}
+	gs.recordCache(ctx, false)
+	return gs.loadFromS3(ctx, key)
+}
+
+// CachePolicy decides how a cached value is trusted when S3 may have changed since it was cached.
+type CachePolicy string
+
+const (
+	// CacheRevalidate checks with a HEAD request that a cached object still exists unchanged before it is served.
+	// The cached copy is still served if S3 can't be reached. This is the default.
+	CacheRevalidate CachePolicy = "revalidate"
+	// CacheTrustCache serves cached values without asking S3 until they expire.
+	CacheTrustCache CachePolicy = "trust-cache"
+	// CacheTrustS3 always asks S3 and only avoids downloading unchanged objects again.
+	CacheTrustS3 CachePolicy = "trust-s3"
+)
+
+// revalidateCached checks whether the cached copy of key still matches S3. It returns fs.ErrNotExist and drops the
+// cached copy if the object was deleted.
+func (gs *S3Storage) revalidateCached(ctx context.Context, key string) (bool, error) {
+	if gs.checkCircuit() != nil {
+		return true, nil
+	}
+	oi, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), gs.statOptions())
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		gs.deleteCacheEntry(key)
+		if len(gs.mirrors) > 0 {
+			// A mirror may still have it, e.g. if the write to this bucket failed
+			return false, nil
+		}
+		return false, fs.ErrNotExist
+	}
+	if err != nil {
+		// S3 is unavailable, the cached copy is better than nothing
+		return true, nil
+	}
+	etag, _, ok := gs.cache.getCacheEntryWithExpiry(ctx, []byte(key+"_etag"))
+	return !ok || len(etag) == 0 || string(etag) == oi.ETag, nil
+}
+
+// revalidate refreshes the cached copy of key from S3 in the background, at most once at a time per key.
+func (gs *S3Storage) revalidate(key string) {
+	if _, running := gs.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	started := gs.background(func(ctx context.Context) {
+		defer gs.revalidating.Delete(key)
+		ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+		defer cancel()
+		_, _ = gs.loadFromS3(ctx, key)
+	})
+	if !started {
+		gs.revalidating.Delete(key)
+	}
+}
+
+// background runs fn in a goroutine that Close cancels through ctx and waits for. It returns false without running
+// fn if the storage is closed.
+func (gs *S3Storage) background(fn func(ctx context.Context)) bool {
+	gs.bgMu.Lock()
+	defer gs.bgMu.Unlock()
+	if gs.checkClosed() != nil {
+		return false
+	}
+	gs.bg.Add(1)
+	go func() {
+		defer gs.bg.Done()
+		fn(gs.bgCtx)
+	}()
+	return true
+}
+
+// revalidateTimeout bounds a background refresh started by revalidate
+const revalidateTimeout = 30 * time.Second
+
+// loadFromS3 fetches key from S3 and caches the result, falling back to the mirrors if it can't be read from this
+// storage's bucket.
+func (gs *S3Storage) loadFromS3(ctx context.Context, key string) ([]byte, error) {
+	buf, err := gs.loadObject(ctx, key)
+	if err != nil && len(gs.mirrors) > 0 && ctx.Err() == nil {
+		return gs.loadFromMirrors(ctx, key, err)
+	}
+	return buf, err
+}
+
+// loadObject fetches key from this storage's bucket and caches the result. If a copy of key is still cached, e.g.
+// one that is being revalidated, it is only downloaded again if its ETag changed.
+func (gs *S3Storage) loadObject(ctx context.Context, key string) ([]byte, error) {
+	if err := gs.checkCircuit(); err != nil {
+		return nil, err
+	}
+	var getOpts minio.GetObjectOptions
+	cached, _, haveCached := gs.cache.getCacheEntryWithExpiry(ctx, []byte(key))
+	etag, _, haveETag := gs.cache.getCacheEntryWithExpiry(ctx, []byte(key+"_etag"))
+	conditional := haveCached && haveETag && len(etag) > 0
+	if conditional {
+		_ = getOpts.SetMatchETagExcept(string(etag))
+	}
+	if gs.verifyChecksum {
+		getOpts.Set("X-Amz-Checksum-Mode", "ENABLED")
+	}
+
+	raw, oi, err := gs.readObject(ctx, gs.objName(key), getOpts)
+	if conditional && minio.ToErrorResponse(err).StatusCode == http.StatusNotModified {
+		// Unchanged, the cached copy is good for another TTL
+		gs.cacheValue(ctx, key, cached, string(etag))
+		return cached, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) && len(gs.legacyPrefixes) > 0 {
+		raw, oi, err = gs.readLegacyObject(ctx, key)
 	}
-	r, err := gs.s3client.GetObject(ctx, gs.bucket, gs.objName(key), minio.GetObjectOptions{})
 	if err != nil {
 		return nil, fs.ErrNotExist
 	}
-	defer r.Close()
-	buf, err := io.ReadAll(gs.iowrap.WrapReader(r))
+	if gs.verifyChecksum {
+		if err := verifyChecksums(gs.objName(key), raw, oi); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := gs.decode(ctx, key, raw, oi)
 	if err != nil {
 		return nil, fs.ErrNotExist
 	}
+	if len(buf) == 0 && gs.emptyObject(key) {
+		return nil, fs.ErrNotExist
+	}
 
 	// We have gotten a file from S3, let's cache it, no need to do any marshalling here!
-	setCacheEntry([]byte(key), buf, time.Hour*1)
+	gs.cacheValue(ctx, key, buf, oi.ETag)
 
 	return buf, nil
 }
 
-func (gs *S3Storage) Delete(ctx context.Context, key string) error {
-	return gs.s3client.RemoveObject(ctx, gs.bucket, gs.objName(key), minio.RemoveObjectOptions{})
+// ioSchemes returns the IO used for writing and, while switching encryption, the one used before.
+func (gs *S3Storage) ioSchemes() (current, prev IO) {
+	gs.ioMu.RLock()
+	defer gs.ioMu.RUnlock()
+	return gs.iowrap, gs.prevIO
+}
+
+// decode unwraps the object stored for key as read from S3.
+func (gs *S3Storage) decode(ctx context.Context, key string, raw []byte, oi minio.ObjectInfo) ([]byte, error) {
+	buf, _, err := gs.decodeScheme(ctx, key, raw, oi)
+	return buf, err
+}
+
+// decodeScheme unwraps an object as stored in S3 and returns the IO it was written with. While switching
+// encryption, objects may have been written with either the current or the previous IO. If the object records the
+// scheme it was written with, that IO is tried first. Otherwise authenticated schemes are tried first, as they fail
+// reliably on data they didn't write, while cleartext accepts anything.
+func (gs *S3Storage) decodeScheme(ctx context.Context, key string, raw []byte, oi minio.ObjectInfo) ([]byte, IO, error) {
+	current, prev := gs.ioSchemes()
+	schemes := []IO{current}
+	if prev != nil {
+		if _, ok := current.(*CleartextIO); ok {
+			schemes = []IO{prev, current}
+		} else {
+			schemes = append(schemes, prev)
+		}
+	}
+	if stored := oi.UserMetadata[schemeMetaKey]; stored != "" {
+		schemes = orderSchemes(schemes, stored)
+	}
+
+	if len(schemes) == 0 {
+		return nil, nil, fmt.Errorf("%s was written with %s, which is not configured", key, oi.UserMetadata[schemeMetaKey])
+	}
+
+	var err error
+	for _, iowrap := range schemes {
+		var buf []byte
+		if buf, err = io.ReadAll(ioFor(ctx, iowrap, key).WrapReader(bytes.NewReader(raw))); err == nil {
+			return buf, iowrap, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// orderSchemes moves the IOs named stored to the front. An object that records being written with anything else
+// than cleartext is never returned as is, even though cleartext would accept it.
+func orderSchemes(schemes []IO, stored string) []IO {
+	var named, others []IO
+	for _, iowrap := range schemes {
+		switch ioScheme(iowrap) {
+		case stored:
+			named = append(named, iowrap)
+		case "cleartext":
+		default:
+			others = append(others, iowrap)
+		}
+	}
+	return append(named, others...)
+}
+
+// cacheValue caches the value of key together with the ETag of the object it was loaded from.
+// The ETag is only ever written along with the value, so that it always describes the cached copy.
+func (gs *S3Storage) cacheValue(ctx context.Context, key string, value []byte, etag string) {
+	ttl := gs.cacheTTL(key)
+	if ttl > 0 {
+		// Entries that never expire are never stale either
+		ttl += gs.staleGrace
+	}
+	gs.cache.setCacheEntry(ctx, []byte(key), value, ttl)
+	gs.cache.setCacheEntry(ctx, []byte(key+"_etag"), []byte(etag), ttl)
+}
+
+// Close releases the cache and stops renewing the locks held through Lock. The shared BadgerDB is closed once the
+// last storage using it is closed, a DB passed in S3Opts.CacheDB is left open. Operations fail with ErrClosed
+// afterwards, closing again does nothing.
+func (gs *S3Storage) Close() error {
+	var err error
+	gs.closeOnce.Do(func() {
+		gs.bgMu.Lock()
+		atomic.StoreInt32(&gs.closed, 1)
+		gs.bgMu.Unlock()
+		// Background work must not touch the cache once it is released
+		gs.bgCancel()
+		gs.bg.Wait()
+		// Locks still held are no longer renewed and go stale, unless they are released before
+		gs.locks.Range(func(_, l interface{}) bool {
+			l.(*Lease).stopRenewing()
+			return true
+		})
+		if gs.gcStop != nil {
+			close(gs.gcStop)
+			<-gs.gcDone
+		}
+		for _, m := range gs.mirrors {
+			_ = m.Close()
+		}
+
+		switch {
+		case gs.sharedDir != "":
+			err = releaseSharedDB(gs.sharedDir)
+		case gs.cacheDir != "":
+			err = gs.cache.db.Close()
+			if gs.tempCacheDir {
+				_ = os.RemoveAll(gs.cacheDir)
+			}
+		}
+	})
+	return err
+}
+
+// checkClosed returns ErrClosed once the storage was closed.
+func (gs *S3Storage) checkClosed() error {
+	if atomic.LoadInt32(&gs.closed) != 0 {
+		return ErrClosed
+	}
+	return nil
+}
+
+// CacheEntryInfo reports whether key is cached, how long ago it was cached and how long until the entry expires.
+// The age is zero for entries cached by older versions, the remaining TTL is zero for entries that don't expire.
+func (gs *S3Storage) CacheEntryInfo(key string) (present bool, age, ttlRemaining time.Duration) {
+	written, expiresAt, ok := gs.cache.getCacheEntryInfo([]byte(key))
+	if !ok {
+		return false, 0, 0
+	}
+	if !written.IsZero() {
+		age = time.Since(written)
+	}
+	if !expiresAt.IsZero() {
+		ttlRemaining = time.Until(expiresAt)
+	}
+	return true, age, ttlRemaining
+}
+
+// ExportCache writes the entries cached by this storage to w, so that another node can start with a warm cache by
+// passing them to ImportCache. Expiry times are kept. This is a BadgerDB backup, not a copy of the objects in S3.
+func (gs *S3Storage) ExportCache(w io.Writer) error {
+	return gs.cache.exportTo(w)
+}
+
+// ImportCache adds the entries written by ExportCache to the cache. The exporting storage must have used the same
+// CacheNamespace, which is the case by default if both use the same endpoint, bucket and prefix.
+func (gs *S3Storage) ImportCache(r io.Reader) error {
+	return gs.cache.importFrom(r)
+}
+
+func (gs *S3Storage) Delete(ctx context.Context, key string) (err error) {
+	ctx, op := gs.startOp(ctx, "Delete", key)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	return gs.toMirrors(gs.deleteObject(ctx, key), func(m *S3Storage) error {
+		return m.deleteObject(ctx, key)
+	})
+}
+
+// deleteObject removes the object of key from this storage's bucket and drops it from the cache.
+func (gs *S3Storage) deleteObject(ctx context.Context, key string) error {
+	if err := gs.checkCircuit(); err != nil {
+		return err
+	}
+	err := gs.s3client.RemoveObject(ctx, gs.bucket, gs.objName(key), minio.RemoveObjectOptions{})
+	// Even a failed delete may have removed the object
+	gs.deleteCacheEntry(key)
+	gs.invalidateListings(key)
+	return err
+}
+
+// deleteCacheEntry drops everything cached for key: the value, its ETag and the results of Stat and StatFull.
+func (gs *S3Storage) deleteCacheEntry(key string) {
+	for _, suffix := range []string{"", "_etag", "_ki", "_oi"} {
+		gs.cache.deleteCacheEntry([]byte(key + suffix))
+	}
 }
 
 func (gs *S3Storage) Exists(ctx context.Context, key string) bool {
-	_, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), minio.StatObjectOptions{})
-	return err == nil
+	ctx, op := gs.startOp(ctx, "Exists", key)
+	defer op.end(nil)
+	if gs.checkClosed() != nil {
+		return false
+	}
+	if gs.cachePolicy == CacheTrustCache && gs.cache.isCacheEntryExistent(ctx, []byte(key)) {
+		return true
+	}
+	if gs.checkCircuit() != nil {
+		return false
+	}
+	exists, _ := gs.objectExists(ctx, gs.objName(key))
+	return exists
 }
 
-func (gs *S3Storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+// List returns the keys starting with prefix, which like the returned keys doesn't include ObjPrefix, so that they
+// can be passed to Load and the other methods as they are. Without recursive, keys below the next slash after
+// prefix are returned as a single key for their directory, ending with a slash.
+func (gs *S3Storage) List(ctx context.Context, prefix string, recursive bool) (_ []string, err error) {
+	ctx, op := gs.startOp(ctx, "List", prefix)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return nil, err
+	}
+	if gs.listCache != nil {
+		if keys, ok := gs.listCache.get(prefix, recursive); ok {
+			return keys, nil
+		}
+	}
+
+	if err := gs.checkCircuit(); err != nil {
+		return nil, err
+	}
+
 	var keys []string
-	for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
-		Prefix:    prefix,
-		Recursive: recursive,
-	}) {
-		keys = append(keys, obj.Key)
+	err = gs.listKeys(ctx, prefix, recursive, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		// A partial listing would look like keys were deleted
+		return nil, err
+	}
+	if gs.sortedList {
+		sort.Strings(keys)
+	}
+	if gs.listCache != nil {
+		gs.listCache.set(prefix, recursive, keys)
 	}
 	return keys, nil
 }
 
-func (gs *S3Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+// ListStream lists like List does, but delivers the keys while they are listed instead of collecting them first,
+// so that large listings don't have to fit into memory. The keys channel is closed once the listing ends, the error
+// channel then receives the error that ended it, if any, and is closed as well. Cancelling ctx stops the listing.
+// ListCacheTTL and SortedList don't apply, keys come in the order S3 lists them.
+func (gs *S3Storage) ListStream(ctx context.Context, prefix string, recursive bool) (<-chan string, <-chan error) {
+	ctx, op := gs.startOp(ctx, "ListStream", prefix)
+	keys := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		err := gs.listStream(ctx, prefix, recursive, keys)
+		op.end(&err)
+		close(keys)
+		if err != nil {
+			errs <- err
+		}
+		close(errs)
+	}()
+	return keys, errs
+}
+
+func (gs *S3Storage) listStream(ctx context.Context, prefix string, recursive bool, keys chan<- string) error {
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return err
+	}
+
+	err := gs.listKeys(ctx, prefix, recursive, func(key string) error {
+		select {
+		case keys <- key:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// listKeys calls fn with the keys starting with prefix, listed from every object prefix that can hold them. Keys
+// of issuers with a prefix of their own are stored apart from the others, directories above them, such as
+// certificates/, exist under several prefixes and are only reported once.
+func (gs *S3Storage) listKeys(ctx context.Context, prefix string, recursive bool, fn func(key string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	// Stops the listing if fn fails
+	defer cancel()
+
+	dirs := map[string]bool{}
+	for _, objPrefix := range gs.listPrefixes(prefix) {
+		for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
+			Prefix:    objPrefix + "/" + prefix,
+			Recursive: recursive,
+		}) {
+			if obj.Err != nil {
+				return obj.Err
+			}
+			key := strings.TrimPrefix(obj.Key, objPrefix+"/")
+			if strings.HasSuffix(key, "/") {
+				if dirs[key] || !slices.Contains(gs.listPrefixes(key), objPrefix) {
+					continue
+				}
+				dirs[key] = true
+			} else if gs.objName(key) != obj.Key {
+				// Objects of nested prefixes are listed with their own prefix
+				continue
+			}
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listPrefixes returns the object prefixes that can hold keys starting with prefix: the one of the key itself and
+// those of the issuers whose keys start with prefix.
+func (gs *S3Storage) listPrefixes(prefix string) []string {
+	var prefixes []string
+	for _, objPrefix := range gs.objPrefixes() {
+		if objPrefix == gs.keyPrefix(prefix) || gs.holdsIssuerKeys(objPrefix, prefix) {
+			prefixes = append(prefixes, objPrefix)
+		}
+	}
+	return prefixes
+}
+
+// holdsIssuerKeys reports whether keys starting with prefix of an issuer are stored under objPrefix.
+func (gs *S3Storage) holdsIssuerKeys(objPrefix, prefix string) bool {
+	for issuer, p := range gs.issuerPrefixes {
+		if p == objPrefix && (strings.HasPrefix("certificates/"+issuer+"/", prefix) || strings.HasPrefix("acme/"+issuer+"/", prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateListings drops the cached listings key may be part of. Even a failed write may have changed the object.
+func (gs *S3Storage) invalidateListings(key string) {
+	if gs.listCache != nil {
+		gs.listCache.invalidate(key)
+	}
+}
+
+func (gs *S3Storage) Stat(ctx context.Context, key string) (_ certmagic.KeyInfo, err error) {
+	ctx, op := gs.startOp(ctx, "Stat", key)
+	defer op.end(&err)
 	var ki certmagic.KeyInfo
+	if err := gs.checkClosed(); err != nil {
+		return ki, err
+	}
 
 	// First we check if we've already cached the stat data for the file
-	if isCacheEntryExistent([]byte(key + "_ki")) {
-		// Get the key info
-		rawKi := getCacheEntry([]byte(key + "_ki"))
-		if rawKi != nil {
-			// Ensure that we only continue the cache fetch process if the key exists
-
-			// Deserialize
-			err := json.Unmarshal([]byte(*rawKi), &ki)
-			if err == nil {
-				// Only return if we had no errors with deserialization and actually got the value
-				return ki, nil
-			}
+	if rawKi, ok := gs.cache.getCacheEntry(ctx, []byte(key+"_ki")); ok {
+		// Deserialize
+		ki, err := decodeKeyInfo(rawKi)
+		if err == nil {
+			// Only return if we had no errors with deserialization and actually got the value
+			gs.recordCache(ctx, true)
+			return ki, nil
 		}
 	}
+	gs.recordCache(ctx, false)
 
 	// This is the normal flow and will contact S3 for the data and then cache it afterwards
-	oi, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), minio.StatObjectOptions{})
-	if err != nil {
+	if err := gs.checkCircuit(); err != nil {
 		return ki, err
 	}
-	ki.Key = key
-	ki.Size = oi.Size
-	ki.Modified = oi.LastModified
-	ki.IsTerminal = true
+	oi, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), gs.statOptions())
+	if err == nil && oi.Size == 0 && gs.emptyObject(key) {
+		return ki, fs.ErrNotExist
+	}
+	if err == nil {
+		ki.Key = key
+		ki.Size = oi.Size
+		ki.Modified = oi.LastModified
+		ki.IsTerminal = true
+	} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return ki, err
+	} else if gs.hasChildren(ctx, key) {
+		// There is no such object, but it is a directory
+		ki.Key = key
+		ki.IsTerminal = false
+	} else {
+		return ki, fs.ErrNotExist
+	}
+
+	if gs.terminalFunc != nil {
+		ki.IsTerminal = gs.terminalFunc(key)
+	}
 
 	// Store the info in the cache storage so we don't have to contact S3 again for a while
-	jsonKi, err := json.Marshal(ki)
+	rawKi, err := encodeKeyInfo(ki)
 	if err == nil {
-		// Only set when we know the JSON data is valid
-		setCacheEntry([]byte(key+"_ki"), jsonKi, time.Hour*1)
+		// Only set when we know the encoded data is valid
+		gs.cache.setCacheEntry(ctx, []byte(key+"_ki"), rawKi, gs.cacheTTL(key))
 	}
 
 	// Return
 	return ki, nil
 }
 
+// ObjectInfo is what StatFull returns, KeyInfo together with the attributes of the object in S3.
+type ObjectInfo struct {
+	certmagic.KeyInfo
+	ContentType string
+	ETag        string
+	// Metadata is the user metadata of the object, without the X-Amz-Meta- prefix
+	Metadata map[string]string
+	// StorageClass is empty for the standard storage class
+	StorageClass string
+}
+
+// StatFull is like Stat, but also returns the content type, ETag, user metadata and storage class of the object.
+// Unlike Stat it only works for objects, directories are reported as fs.ErrNotExist.
+func (gs *S3Storage) StatFull(ctx context.Context, key string) (_ ObjectInfo, err error) {
+	ctx, op := gs.startOp(ctx, "StatFull", key)
+	defer op.end(&err)
+	var info ObjectInfo
+	if err := gs.checkClosed(); err != nil {
+		return info, err
+	}
+
+	if raw, ok := gs.cache.getCacheEntry(ctx, []byte(key+"_oi")); ok {
+		if err := json.Unmarshal(raw, &info); err == nil {
+			return info, nil
+		}
+	}
+
+	if err := gs.checkCircuit(); err != nil {
+		return info, err
+	}
+	oi, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(key), gs.statOptions())
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return info, fs.ErrNotExist
+	}
+	if err != nil {
+		return info, err
+	}
+	if oi.Size == 0 && gs.emptyObject(key) {
+		return info, fs.ErrNotExist
+	}
+
+	info.Key = key
+	info.Size = oi.Size
+	info.Modified = oi.LastModified
+	info.IsTerminal = true
+	if gs.terminalFunc != nil {
+		info.IsTerminal = gs.terminalFunc(key)
+	}
+	info.ContentType = oi.ContentType
+	info.ETag = oi.ETag
+	info.Metadata = oi.UserMetadata
+	// StatObject doesn't parse the storage class, S3 only sends it for classes other than STANDARD
+	info.StorageClass = oi.Metadata.Get("X-Amz-Storage-Class")
+
+	if raw, err := json.Marshal(info); err == nil {
+		gs.cache.setCacheEntry(ctx, []byte(key+"_oi"), raw, gs.cacheTTL(key))
+	}
+	return info, nil
+}
+
+// defaultCacheTTL is how long loaded objects and their stats are cached for, unless CacheTTL is set
+const defaultCacheTTL = time.Hour
+
+// cacheTTL returns the cache TTL for key, taken from the longest matching prefix in CacheTTLByPrefix.
+func (gs *S3Storage) cacheTTL(key string) time.Duration {
+	var (
+		ttl     = gs.defaultTTL
+		longest = -1
+	)
+	for prefix, prefixTTL := range gs.ttlByPrefix {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			ttl, longest = prefixTTL, len(prefix)
+		}
+	}
+	return ttl
+}
+
+// emptyObject handles finding an empty object for key, which is most likely the result of a botched write.
+// It returns true if the object should be treated as missing.
+func (gs *S3Storage) emptyObject(key string) bool {
+	if gs.emptyAsMissing {
+		return true
+	}
+	gs.logger.Warn("Object is empty", "object", gs.objName(key))
+	return false
+}
+
+// readObject reads the whole object name and its metadata from a single response. Client.GetObject is avoided, as
+// its Stat may send another request once the body was read, which can describe a newer object.
+// A missing object is turned into fs.ErrNotExist, other errors are returned as they come from minio.
+func (gs *S3Storage) readObject(ctx context.Context, name string, opts minio.GetObjectOptions) ([]byte, minio.ObjectInfo, error) {
+	opts.ServerSideEncryption = encrypt.SSE(gs.sse)
+	body, oi, _, err := minio.Core{Client: gs.s3client}.GetObject(ctx, gs.bucket, name, opts)
+	if err == nil {
+		defer body.Close()
+		var buf []byte
+		if buf, err = io.ReadAll(body); err == nil {
+			return buf, oi, nil
+		}
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		err = fs.ErrNotExist
+	}
+	return nil, minio.ObjectInfo{}, err
+}
+
+// statOptions returns the options for StatObject, which carry the customer key with SSE-C.
+func (gs *S3Storage) statOptions() minio.StatObjectOptions {
+	return minio.StatObjectOptions{ServerSideEncryption: encrypt.SSE(gs.sse)}
+}
+
+// objectExists reports whether the object name exists. Errors other than the object missing are returned.
+func (gs *S3Storage) objectExists(ctx context.Context, name string) (bool, error) {
+	_, err := gs.s3client.StatObject(ctx, gs.bucket, name, gs.statOptions())
+	if err == nil {
+		return true, nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
+	}
+	return false, err
+}
+
+// hasChildren returns true if there is at least one object below key.
+func (gs *S3Storage) hasChildren(ctx context.Context, key string) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	// Stops the listing after the first object
+	defer cancel()
+
+	// Directories above the keys of issuers with a prefix of their own exist under several prefixes
+	for _, objPrefix := range gs.listPrefixes(key + "/") {
+		for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
+			Prefix:  objPrefix + "/" + key + "/",
+			MaxKeys: 1,
+		}) {
+			if obj.Err == nil {
+				return true
+			}
+			break
+		}
+	}
+	return false
+}
+
 func (gs *S3Storage) objName(key string) string {
-	return gs.prefix + "/" + key
+	return gs.keyPrefix(key) + "/" + key
+}
+
+// keyPrefix returns the prefix the object for key is stored under, which is ObjPrefix unless IssuerPrefixes has one
+// for the issuer the key belongs to.
+func (gs *S3Storage) keyPrefix(key string) string {
+	if prefix, ok := gs.issuerPrefixes[keyIssuer(key)]; ok {
+		return prefix
+	}
+	return gs.prefix
+}
+
+// keyIssuer returns the issuer segment of CertMagic's issuer specific keys, e.g. acme-v02.api.letsencrypt.org-directory
+// for certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt. It is empty for other keys.
+func keyIssuer(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 || (parts[0] != "certificates" && parts[0] != "acme") {
+		return ""
+	}
+	return parts[1]
+}
+
+// objPrefixes returns all prefixes objects are stored under.
+func (gs *S3Storage) objPrefixes() []string {
+	prefixes := []string{gs.prefix}
+	seen := map[string]bool{gs.prefix: true}
+	for _, prefix := range gs.issuerPrefixes {
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes[1:])
+	return prefixes
 }
 
 func (gs *S3Storage) objLockName(key string) string {
@@ -0,0 +1,1511 @@
+package badgers3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// newTestStorage creates a storage backed by the given fake S3 server.
+func newTestStorage(t *testing.T, f *fakeS3, opts S3Opts) *S3Storage {
+	t.Helper()
+	opts.Endpoint = f.endpoint()
+	opts.Bucket = f.bucket
+	opts.AccessKeyID = "test-key"
+	opts.SecretAccessKey = "test-secret"
+	if opts.ObjPrefix == "" {
+		opts.ObjPrefix = "test"
+	}
+
+	if opts.CacheDB == nil {
+		opts.CacheDB = newTestCacheDB(t)
+	}
+
+	gs, err := NewS3Storage(opts)
+	if err != nil {
+		t.Fatalf("creating storage failed: %v", err)
+	}
+	return gs
+}
+
+// newTestCacheDB opens an empty BadgerDB that is closed at the end of the test.
+func newTestCacheDB(t *testing.T) *badger.DB {
+	t.Helper()
+	cdb, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("opening cache failed: %v", err)
+	}
+	t.Cleanup(func() { cdb.Close() })
+	return cdb
+}
+
+func TestExtraHeaders(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{
+		ExtraHeaders: http.Header{"X-Api-Key": []string{"secret"}},
+	})
+
+	ctx := WithExtraHeaders(context.Background(), http.Header{"X-Tenant-Id": []string{"tenant-a"}})
+	if err := gs.Store(ctx, "headers/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if !gs.Exists(context.Background(), "headers/cert") {
+		t.Fatal("stored object does not exist")
+	}
+
+	puts := f.recorded(http.MethodPut, "test/headers/cert")
+	if len(puts) != 1 {
+		t.Fatalf("expected 1 PUT, got %d", len(puts))
+	}
+	if got := puts[0].Header.Get("X-Api-Key"); got != "secret" {
+		t.Errorf("PUT is missing the global header, got %q", got)
+	}
+	if got := puts[0].Header.Get("X-Tenant-Id"); got != "tenant-a" {
+		t.Errorf("PUT is missing the per-call header, got %q", got)
+	}
+
+	heads := f.recorded(http.MethodHead, "test/headers/cert")
+	if len(heads) != 1 {
+		t.Fatalf("expected 1 HEAD, got %d", len(heads))
+	}
+	if got := heads[0].Header.Get("X-Api-Key"); got != "secret" {
+		t.Errorf("HEAD is missing the global header, got %q", got)
+	}
+	if got := heads[0].Header.Get("X-Tenant-Id"); got != "" {
+		t.Errorf("per-call header leaked into another call: %q", got)
+	}
+}
+
+func TestExtraHeadersCanonical(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	ctx := WithExtraHeaders(context.Background(), http.Header{
+		"content-type":    {"application/x-pem-file"},
+		"x-amz-meta-note": {"unsigned"},
+	})
+	if err := gs.Store(ctx, "headers/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	puts := f.recorded(http.MethodPut, "test/headers/cert")
+	if len(puts) != 1 {
+		t.Fatalf("expected 1 PUT, got %d", len(puts))
+	}
+	if got := puts[0].Header.Values("Content-Type"); len(got) != 1 || got[0] != "application/x-pem-file" {
+		t.Errorf("expected the per-call header to replace the one set by the client, got %q", got)
+	}
+	if got := puts[0].Header.Get("X-Amz-Meta-Note"); got != "" {
+		t.Errorf("expected the X-Amz-* header to be left out, got %q", got)
+	}
+}
+
+func TestLoadStaleWhileRevalidate(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CacheStaleGrace: time.Hour})
+
+	// Past its TTL but within the grace period
+	gs.cache.setCacheEntry(context.Background(), []byte("swr/cert"), []byte("old"), 2*time.Second)
+	f.put("test/swr/cert", []byte("new"))
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		time.Sleep(200 * time.Millisecond)
+		return false
+	})
+
+	start := time.Now()
+	buf, err := gs.Load(context.Background(), "swr/cert")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if string(buf) != "old" {
+		t.Errorf("expected the stale value, got %q", buf)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("load blocked on S3 for %v", d)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if v, ok := gs.cache.getCacheEntry(context.Background(), []byte("swr/cert")); ok && string(v) == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background refresh did not update the cache")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLoadExpiringCacheEntry(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CachePolicy: CacheTrustCache})
+	f.put("test/expiring/cert", []byte("fresh"))
+	gs.cache.setCacheEntry(context.Background(), []byte("expiring/cert"), []byte("cached"), time.Second)
+
+	// Keep loading while the entry expires, every load has to find it or go to S3
+	var last string
+	for deadline := time.Now().Add(2500 * time.Millisecond); time.Now().Before(deadline); {
+		buf, err := gs.Load(context.Background(), "expiring/cert")
+		if err != nil || (string(buf) != "cached" && string(buf) != "fresh") {
+			t.Fatalf("load failed: %q, %v", buf, err)
+		}
+		last = string(buf)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if last != "fresh" {
+		t.Errorf("expired entry was still served")
+	}
+}
+
+func TestLoadConditional(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CacheStaleGrace: time.Hour})
+	ctx := context.Background()
+	f.put("test/etag/cert", []byte("cert"))
+
+	if _, err := gs.Load(ctx, "etag/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	obj, _ := f.get("test/etag/cert")
+	if etag, ok := gs.cache.getCacheEntry(context.Background(), []byte("etag/cert_etag")); !ok || `"`+string(etag)+`"` != obj.etag() {
+		t.Fatalf("expected ETag %s to be cached, got %q", obj.etag(), etag)
+	}
+
+	// Unchanged, the refresh is answered with 304 and keeps the cached copy
+	if buf, err := gs.loadFromS3(ctx, "etag/cert"); err != nil || string(buf) != "cert" {
+		t.Fatalf("expected the cached value, got %q, %v", buf, err)
+	}
+	gets := f.recorded(http.MethodGet, "test/etag/cert")
+	if len(gets) != 2 || gets[1].Header.Get("If-None-Match") != obj.etag() {
+		t.Fatalf("expected a conditional GET, got %+v", gets)
+	}
+
+	// Changed, the new value is downloaded
+	f.put("test/etag/cert", []byte("renewed"))
+	if buf, err := gs.loadFromS3(ctx, "etag/cert"); err != nil || string(buf) != "renewed" {
+		t.Fatalf("expected the new value, got %q, %v", buf, err)
+	}
+	if buf, _ := gs.Load(ctx, "etag/cert"); string(buf) != "renewed" {
+		t.Errorf("expected the new value to be cached, got %q", buf)
+	}
+}
+
+func TestReadObject(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+	f.put("test/read/present", []byte("value"))
+
+	buf, oi, err := gs.readObject(ctx, "test/read/present", minio.GetObjectOptions{})
+	if err != nil || string(buf) != "value" || oi.ETag == "" {
+		t.Errorf("expected the object, got %q, %+v, %v", buf, oi, err)
+	}
+	if _, _, err := gs.readObject(ctx, "test/read/missing", minio.GetObjectOptions{}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	if ok, err := gs.objectExists(ctx, "test/read/present"); !ok || err != nil {
+		t.Errorf("expected the object to exist, got %v, %v", ok, err)
+	}
+	if ok, err := gs.objectExists(ctx, "test/read/missing"); ok || err != nil {
+		t.Errorf("expected the object to be missing, got %v, %v", ok, err)
+	}
+
+	// Other failures must not be mistaken for a missing object
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		writeFakeError(w, http.StatusForbidden, "AccessDenied")
+		return true
+	})
+	if _, _, err := gs.readObject(ctx, "test/read/present", minio.GetObjectOptions{}); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected AccessDenied, got %v", err)
+	}
+	if _, err := gs.objectExists(ctx, "test/read/present"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"s3.example.com", "https://s3.example.com/", "s3.example.com/", " https://s3.example.com "} {
+		got, err := normalizeEndpoint(endpoint, false)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", endpoint, err)
+		} else if got != "s3.example.com" {
+			t.Errorf("%q: expected s3.example.com, got %q", endpoint, got)
+		}
+	}
+	for _, endpoint := range []string{"localhost:9000", "http://localhost:9000/"} {
+		if got, err := normalizeEndpoint(endpoint, true); err != nil || got != "localhost:9000" {
+			t.Errorf("%q: expected localhost:9000 with Insecure, got %q, %v", endpoint, got, err)
+		}
+	}
+
+	for _, endpoint := range []string{"", "http://s3.example.com", "s3.example.com/bucket"} {
+		if _, err := normalizeEndpoint(endpoint, false); err == nil {
+			t.Errorf("%q: expected an error", endpoint)
+		}
+	}
+	if _, err := normalizeEndpoint("https://s3.example.com", true); err == nil {
+		t.Error("expected an error for an HTTPS endpoint with Insecure")
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	f := newPlainFakeS3(t)
+	if !strings.HasPrefix(f.endpoint(), "http://") {
+		t.Fatalf("expected a plain HTTP endpoint, got %s", f.endpoint())
+	}
+	gs := newTestStorage(t, f, S3Opts{Insecure: true})
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "insecure/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if obj, ok := f.get("test/insecure/cert"); !ok || string(obj.data) != "cert" {
+		t.Fatalf("object was not stored over plain HTTP: %+v", obj)
+	}
+	reader := newTestStorage(t, f, S3Opts{Insecure: true})
+	if buf, err := reader.Load(ctx, "insecure/cert"); err != nil || string(buf) != "cert" {
+		t.Errorf("load failed: %q, %v", buf, err)
+	}
+
+	// Secure by default
+	_, err := NewS3Storage(S3Opts{Endpoint: f.endpoint(), Bucket: f.bucket, CacheDB: newTestCacheDB(t)})
+	if err == nil || !strings.Contains(err.Error(), "only HTTPS") {
+		t.Errorf("expected plain HTTP to be refused without Insecure, got %v", err)
+	}
+}
+
+func TestDeriveKeys(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{EncryptionKey: []byte("12345678123456781234567812345678"), DeriveKeys: true})
+	ctx := context.Background()
+
+	for _, key := range []string{"derive/a", "derive/b"} {
+		if err := gs.Store(ctx, key, []byte("same value")); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+		if buf, err := gs.loadFromS3(ctx, key); err != nil || string(buf) != "same value" {
+			t.Errorf("%s: round trip failed: %q, %v", key, buf, err)
+		}
+	}
+
+	// Swapping objects must not go unnoticed
+	a, _ := f.get("test/derive/a")
+	f.put("test/derive/b", a.data)
+	if _, err := gs.loadFromS3(ctx, "derive/b"); err == nil {
+		t.Error("object was readable under another key")
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	f := newFakeS3(t)
+	salt := []byte("badger-s3 salt")
+	gs := newTestStorage(t, f, S3Opts{Passphrase: "correct horse battery staple", PassphraseSalt: salt})
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "passphrase/cert", []byte("value")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	keyed := newTestStorage(t, f, S3Opts{EncryptionKey: PassphraseKey("correct horse battery staple", salt)})
+	if buf, err := keyed.loadFromS3(ctx, "passphrase/cert"); err != nil || string(buf) != "value" {
+		t.Errorf("loading with the derived key failed: %q, %v", buf, err)
+	}
+	obj, _ := f.get("test/passphrase/cert")
+	if bytes.Contains(obj.data, []byte("value")) {
+		t.Error("object was stored in cleartext")
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	keyA := []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	keyB := []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	ctx := context.Background()
+
+	for _, derive := range []bool{false, true} {
+		f := newFakeS3(t)
+		old := newTestStorage(t, f, S3Opts{EncryptionKey: keyA, DeriveKeys: derive})
+		if err := old.Store(ctx, "rotate/old", []byte("old value")); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+
+		rotated := newTestStorage(t, f, S3Opts{EncryptionKeys: [][]byte{keyB, keyA}, DeriveKeys: derive})
+		if buf, err := rotated.loadFromS3(ctx, "rotate/old"); err != nil || string(buf) != "old value" {
+			t.Errorf("derive %v: loading an object written with the old key failed: %q, %v", derive, buf, err)
+		}
+		if err := rotated.Store(ctx, "rotate/new", []byte("new value")); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+
+		// New objects are written with the new key only
+		onlyB := newTestStorage(t, f, S3Opts{EncryptionKey: keyB, DeriveKeys: derive})
+		if buf, err := onlyB.loadFromS3(ctx, "rotate/new"); err != nil || string(buf) != "new value" {
+			t.Errorf("derive %v: loading with the new key failed: %q, %v", derive, buf, err)
+		}
+		if _, err := old.loadFromS3(ctx, "rotate/new"); err == nil {
+			t.Errorf("derive %v: object written after the rotation was readable with the old key", derive)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	f := newFakeS3(t)
+	key := []byte("12345678123456781234567812345678")
+	bundle := testCertBundle(t)
+	ctx := context.Background()
+
+	// Written before compression was enabled
+	plain := newTestStorage(t, f, S3Opts{EncryptionKey: key})
+	if err := plain.Store(ctx, "compress/legacy", bundle); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+
+	gs := newTestStorage(t, f, S3Opts{EncryptionKey: key, Compression: CompressionGzip})
+	if err := gs.Store(ctx, "compress/cert", bundle); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	for _, k := range []string{"compress/cert", "compress/legacy"} {
+		if buf, err := gs.loadFromS3(ctx, k); err != nil || !bytes.Equal(buf, bundle) {
+			t.Errorf("%s: round trip failed: %v", k, err)
+		}
+	}
+
+	compressed, _ := f.get("test/compress/cert")
+	legacy, _ := f.get("test/compress/legacy")
+	if len(compressed.data) >= len(legacy.data) {
+		t.Errorf("compressed object is not smaller: %d bytes, %d uncompressed", len(compressed.data), len(legacy.data))
+	}
+	if got := compressed.header.Get("X-Amz-Meta-Badger-S3-Scheme"); got != "gzip+secretbox" {
+		t.Errorf("expected the object to record gzip+secretbox, got %q", got)
+	}
+}
+
+func TestEncryptionAlgorithm(t *testing.T) {
+	f := newFakeS3(t)
+	key := []byte("12345678123456781234567812345678")
+	gs := newTestStorage(t, f, S3Opts{EncryptionKey: key, EncryptionAlgorithm: EncryptionAESGCM})
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "gcm/cert", []byte("value")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	obj, _ := f.get("test/gcm/cert")
+	if got := obj.header.Get("X-Amz-Meta-Badger-S3-Scheme"); got != "aes-gcm" {
+		t.Errorf("expected the object to record aes-gcm, got %q", got)
+	}
+	if buf, err := gs.loadFromS3(ctx, "gcm/cert"); err != nil || string(buf) != "value" {
+		t.Errorf("round trip failed: %q, %v", buf, err)
+	}
+
+	// The same key with the default algorithm can't read it
+	sb := newTestStorage(t, f, S3Opts{EncryptionKey: key})
+	if _, err := sb.loadFromS3(ctx, "gcm/cert"); err == nil {
+		t.Error("object written with AES-GCM was readable with SecretBox")
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	kms, _ := encrypt.NewSSEKMS("my-key", nil)
+	ssec, _ := encrypt.NewSSEC([]byte("12345678123456781234567812345678"))
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name   string
+		sse    encrypt.ServerSide
+		header string
+		value  string
+		onRead bool
+	}{
+		{"SSE-S3", encrypt.NewSSE(), "X-Amz-Server-Side-Encryption", "AES256", false},
+		{"SSE-KMS", kms, "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", "my-key", false},
+		{"SSE-C", ssec, "X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256", true},
+	} {
+		f := newFakeS3(t)
+		gs := newTestStorage(t, f, S3Opts{SSE: tc.sse})
+		if err := gs.Store(ctx, "sse/cert", []byte("value")); err != nil {
+			t.Fatalf("%s: store failed: %v", tc.name, err)
+		}
+		if err := gs.Lock(ctx, "sse/cert"); err != nil {
+			t.Fatalf("%s: lock failed: %v", tc.name, err)
+		}
+		if _, err := gs.loadFromS3(ctx, "sse/cert"); err != nil {
+			t.Fatalf("%s: load failed: %v", tc.name, err)
+		}
+		if _, err := gs.StatFull(ctx, "sse/cert"); err != nil {
+			t.Fatalf("%s: stat failed: %v", tc.name, err)
+		}
+
+		for _, req := range append(f.recorded(http.MethodPut, "test/sse/cert"), f.recorded(http.MethodPut, "test/sse/cert.lock")...) {
+			if got := req.Header.Get(tc.header); got != tc.value {
+				t.Errorf("%s: expected %s: %s on the PUT of %s, got %q", tc.name, tc.header, tc.value, req.Key, got)
+			}
+		}
+		// Only SSE-C needs the key to read, S3 rejects the other headers on reads
+		reads := append(f.recorded(http.MethodGet, "test/sse/cert"), f.recorded(http.MethodHead, "test/sse/cert")...)
+		if len(reads) < 2 {
+			t.Errorf("%s: expected a GET and a HEAD, got %d reads", tc.name, len(reads))
+		}
+		for _, req := range reads {
+			if got := req.Header.Get(tc.header); (got != "") != tc.onRead {
+				t.Errorf("%s: unexpected %s: %q on the %s of %s", tc.name, tc.header, got, req.Method, req.Key)
+			}
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	setLockTiming(t, 200*time.Millisecond, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	dir := t.TempDir()
+	open := func() *S3Storage {
+		gs, err := NewS3Storage(S3Opts{
+			Endpoint:        f.endpoint(),
+			Bucket:          f.bucket,
+			AccessKeyID:     "test-key",
+			SecretAccessKey: "test-secret",
+			ObjPrefix:       "test",
+			CacheDir:        dir,
+		})
+		if err != nil {
+			t.Fatalf("creating storage failed: %v", err)
+		}
+		return gs
+	}
+	ctx := context.Background()
+
+	gs := open()
+	if err := gs.Store(ctx, "close/cert", []byte("value")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if err := gs.Lock(ctx, "close/cert"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := gs.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if err := gs.Close(); err != nil {
+		t.Errorf("closing again failed: %v", err)
+	}
+
+	if _, err := gs.Load(ctx, "close/cert"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected Load to fail with ErrClosed, got %v", err)
+	}
+	if err := gs.Store(ctx, "close/cert", []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected Store to fail with ErrClosed, got %v", err)
+	}
+	if err := gs.Lock(ctx, "close/other"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected Lock to fail with ErrClosed, got %v", err)
+	}
+	if gs.Exists(ctx, "close/cert") {
+		t.Error("Exists reported a key on a closed storage")
+	}
+
+	// The lock is no longer renewed
+	renewals := len(f.recorded(http.MethodPut, "test/close/cert.lock"))
+	time.Sleep(300 * time.Millisecond)
+	if got := len(f.recorded(http.MethodPut, "test/close/cert.lock")); got != renewals {
+		t.Errorf("lock was renewed %d times after close", got-renewals)
+	}
+
+	// The cache directory can be opened again
+	reopened := open()
+	defer reopened.Close()
+	if buf, err := reopened.Load(ctx, "close/cert"); err != nil || string(buf) != "value" {
+		t.Errorf("load after reopening failed: %q, %v", buf, err)
+	}
+}
+
+func TestCloseWaitsForBackgroundWork(t *testing.T) {
+	f := newFakeS3(t)
+	var handled []error
+	gs, err := NewS3Storage(S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		ObjPrefix:       "test",
+		CacheDir:        t.TempDir(),
+		CacheStaleGrace: time.Hour,
+		ErrorHandler:    func(err error) { handled = append(handled, err) },
+	})
+	if err != nil {
+		t.Fatalf("creating storage failed: %v", err)
+	}
+
+	// The refresh hangs until the client gives up on it
+	gs.cache.setCacheEntry(context.Background(), []byte("bg/cert"), []byte("old"), 2*time.Second)
+	f.put("test/bg/cert", []byte("new"))
+	refreshing := make(chan struct{})
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key == "test/bg/cert" {
+			close(refreshing)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return true
+		}
+		return false
+	})
+	if _, err := gs.Load(context.Background(), "bg/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	<-refreshing
+
+	start := time.Now()
+	if err := gs.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("close waited %v for the refresh instead of cancelling it", d)
+	}
+	if _, running := gs.revalidating.Load("bg/cert"); running {
+		t.Error("close returned while the refresh was still running")
+	}
+	gs.revalidate("bg/other")
+	if _, running := gs.revalidating.Load("bg/other"); running {
+		t.Error("a refresh was started after close")
+	}
+	if len(handled) > 0 {
+		t.Errorf("background work failed on the closed cache: %v", handled)
+	}
+}
+
+func TestValidateOpts(t *testing.T) {
+	valid := S3Opts{Endpoint: "s3.example.com", Bucket: "bucket", AccessKeyID: "key", SecretAccessKey: "secret", ObjPrefix: "/certs/"}
+	if err := ValidateOpts(valid); err != nil {
+		t.Fatalf("valid options rejected: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*S3Opts)
+		want   string
+	}{
+		{"no endpoint", func(o *S3Opts) { o.Endpoint = "" }, "endpoint is empty"},
+		{"http endpoint", func(o *S3Opts) { o.Endpoint = "http://s3.example.com" }, "only HTTPS"},
+		{"no bucket", func(o *S3Opts) { o.Bucket = "" }, "bucket is empty"},
+		{"no secret", func(o *S3Opts) { o.SecretAccessKey = "" }, "must be set together"},
+		{"no access key", func(o *S3Opts) { o.AccessKeyID = "" }, "must be set together"},
+		{"empty prefix segment", func(o *S3Opts) { o.ObjPrefix = "certs//a" }, "empty path segment"},
+		{"signed extra header", func(o *S3Opts) { o.ExtraHeaders = http.Header{"x-amz-security-token": {"token"}} }, "can't contain x-amz-security-token"},
+		{"short key", func(o *S3Opts) { o.EncryptionKey = make([]byte, 16) }, "exactly 32 bytes, got 16"},
+		{"short rotated key", func(o *S3Opts) { o.EncryptionKeys = [][]byte{make([]byte, 32), make([]byte, 16)} }, "exactly 32 bytes, got 16"},
+		{"key and keys", func(o *S3Opts) {
+			o.EncryptionKey = make([]byte, 32)
+			o.EncryptionKeys = [][]byte{make([]byte, 32)}
+		}, "can't both be set"},
+		{"passphrase and key", func(o *S3Opts) {
+			o.EncryptionKey = make([]byte, 32)
+			o.Passphrase = "secret"
+			o.PassphraseSalt = []byte("some salt")
+		}, "Passphrase can't be combined"},
+		{"passphrase without salt", func(o *S3Opts) { o.Passphrase = "secret" }, "PassphraseSalt of at least 8 bytes"},
+		{"key and layers", func(o *S3Opts) {
+			o.EncryptionKey = make([]byte, 32)
+			o.IOLayers = []IOLayer{GzipLayer()}
+		}, "use SecretBoxLayer"},
+		{"encoding and key", func(o *S3Opts) {
+			o.EncryptionKey = make([]byte, 32)
+			o.ContentEncoding = "gzip"
+		}, ErrContentEncodingEncrypted.Error()},
+		{"unknown credential provider", func(o *S3Opts) { o.CredentialProvider = "vault" }, `unknown CredentialProvider "vault"`},
+		{"unknown encryption algorithm", func(o *S3Opts) { o.EncryptionAlgorithm = "rot13" }, `unknown EncryptionAlgorithm "rot13"`},
+		{"derived aes-gcm", func(o *S3Opts) {
+			o.EncryptionKey = make([]byte, 32)
+			o.EncryptionAlgorithm = EncryptionAESGCM
+			o.DeriveKeys = true
+		}, "only supported with EncryptionSecretBox"},
+		{"SSE-C without TLS", func(o *S3Opts) {
+			o.Endpoint = "http://s3.example.com"
+			o.Insecure = true
+			o.SSE, _ = encrypt.NewSSEC(make([]byte, 32))
+		}, "requires HTTPS"},
+		{"unknown compression", func(o *S3Opts) { o.Compression = "zstd" }, `unknown Compression "zstd"`},
+		{"compression and layers", func(o *S3Opts) {
+			o.Compression = CompressionGzip
+			o.IOLayers = []IOLayer{GzipLayer()}
+		}, "use GzipLayer"},
+		{"unknown cache policy", func(o *S3Opts) { o.CachePolicy = "sometimes" }, `unknown CachePolicy "sometimes"`},
+		{"negative grace", func(o *S3Opts) { o.CacheStaleGrace = -time.Second }, "CacheStaleGrace must not be negative"},
+		{"negative list ttl", func(o *S3Opts) { o.ListCacheTTL = -time.Second }, "ListCacheTTL must not be negative"},
+		{"negative poll interval", func(o *S3Opts) { o.LockPollInterval = -time.Second }, "LockPollInterval must not be negative"},
+		{"zero prefix ttl", func(o *S3Opts) { o.CacheTTLByPrefix = map[string]time.Duration{"ocsp/": 0} }, `"ocsp/" must not be zero`},
+	} {
+		opts := valid
+		tc.modify(&opts)
+		if err := ValidateOpts(opts); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestNewS3StorageNormalizesEndpoint(t *testing.T) {
+	f := newFakeS3(t)
+	for _, endpoint := range []string{"https://" + f.endpoint() + "/", f.endpoint() + "/"} {
+		gs, err := NewS3Storage(S3Opts{
+			Endpoint:        endpoint,
+			Bucket:          f.bucket,
+			AccessKeyID:     "test-key",
+			SecretAccessKey: "test-secret",
+			CacheDB:         newTestCacheDB(t),
+		})
+		if err != nil {
+			t.Errorf("%q: creating storage failed: %v", endpoint, err)
+		} else {
+			gs.Close()
+		}
+	}
+}
+
+func TestVerifyWrite(t *testing.T) {
+	f := newFakeS3(t)
+	newTestStorage(t, f, S3Opts{VerifyWrite: true})
+	if _, ok := f.get("test/" + writeProbeKey); ok {
+		t.Error("probe object was left behind")
+	}
+
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodPut {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	})
+	_, err := NewS3Storage(S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		ObjPrefix:       "test",
+		CacheDB:         newTestCacheDB(t),
+		VerifyWrite:     true,
+	})
+	var errResp minio.ErrorResponse
+	if err == nil || !strings.Contains(err.Error(), "not writable") || !errors.As(err, &errResp) || errResp.Code != "AccessDenied" {
+		t.Errorf("expected a descriptive AccessDenied error, got %v", err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	f := newFakeS3(t)
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key == "" {
+			time.Sleep(time.Second)
+		}
+		return false
+	})
+
+	start := time.Now()
+	_, err := NewS3Storage(S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		CacheDB:         newTestCacheDB(t),
+		ConnectTimeout:  100 * time.Millisecond,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the bucket check to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("the bucket check took %v despite the timeout", elapsed)
+	}
+}
+
+func TestSkipBucketCheck(t *testing.T) {
+	f := newFakeS3(t)
+	var bucketChecks int32
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key == "" && r.Method == http.MethodHead {
+			atomic.AddInt32(&bucketChecks, 1)
+			writeFakeError(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	})
+
+	opts := S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		CacheDB:         newTestCacheDB(t),
+	}
+	if _, err := NewS3Storage(opts); err == nil {
+		t.Fatal("expected the bucket check to fail")
+	}
+
+	atomic.StoreInt32(&bucketChecks, 0)
+	opts.SkipBucketCheck = true
+	gs, err := NewS3Storage(opts)
+	if err != nil {
+		t.Fatalf("creating storage failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&bucketChecks); n != 0 {
+		t.Errorf("bucket was checked %d times despite SkipBucketCheck", n)
+	}
+	if err := gs.Store(context.Background(), "skip/cert", []byte("cert")); err != nil {
+		t.Errorf("store failed: %v", err)
+	}
+}
+
+func TestLeastPrivilegeCredentials(t *testing.T) {
+	f := newFakeS3(t)
+	// Only objects under the prefix may be accessed, the bucket itself can't be checked, located or listed
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if !strings.HasPrefix(key, "test/") {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	})
+	opts := S3Opts{
+		Endpoint:        f.endpoint(),
+		Bucket:          f.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		ObjPrefix:       "test",
+		CacheDB:         newTestCacheDB(t),
+		VerifyWrite:     true,
+	}
+	if _, err := NewS3Storage(opts); err == nil || !strings.Contains(err.Error(), "SkipBucketCheck") {
+		t.Errorf("expected the error to point at SkipBucketCheck, got %v", err)
+	}
+
+	opts.SkipBucketCheck = true
+	gs, err := NewS3Storage(opts)
+	if err != nil {
+		t.Fatalf("creating storage failed: %v", err)
+	}
+	ctx := context.Background()
+	if err := gs.Store(ctx, "least/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	reader := newTestStorage(t, f, S3Opts{SkipBucketCheck: true})
+	if buf, err := reader.Load(ctx, "least/cert"); err != nil || string(buf) != "cert" {
+		t.Errorf("load failed: %q, %v", buf, err)
+	}
+	if ki, err := reader.Stat(ctx, "least/cert"); err != nil || ki.Size != 4 {
+		t.Errorf("stat failed: %+v, %v", ki, err)
+	}
+	if err := gs.Lock(ctx, "least/cert"); err != nil {
+		t.Errorf("lock failed: %v", err)
+	}
+	if err := gs.Unlock(ctx, "least/cert"); err != nil {
+		t.Errorf("unlock failed: %v", err)
+	}
+	if err := gs.Delete(ctx, "least/cert"); err != nil {
+		t.Errorf("delete failed: %v", err)
+	}
+}
+
+func TestSharedCacheDB(t *testing.T) {
+	f := newFakeS3(t)
+	cdb := newTestCacheDB(t)
+	a := newTestStorage(t, f, S3Opts{ObjPrefix: "a", CacheDB: cdb, CacheNamespace: "a"})
+	b := newTestStorage(t, f, S3Opts{ObjPrefix: "b", CacheDB: cdb, CacheNamespace: "b"})
+	f.put("a/shared/cert", []byte("cert a"))
+	f.put("b/shared/cert", []byte("cert b"))
+
+	for _, tc := range []struct {
+		gs   *S3Storage
+		want string
+	}{{a, "cert a"}, {b, "cert b"}, {a, "cert a"}, {b, "cert b"}} {
+		buf, err := tc.gs.Load(context.Background(), "shared/cert")
+		if err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+		if string(buf) != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, buf)
+		}
+	}
+
+	// Entries of other users of the DB are left alone
+	if err := cdb.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("shared/cert"), []byte("foreign"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := a.Load(context.Background(), "shared/cert"); string(buf) != "cert a" {
+		t.Errorf("namespaced entry was shadowed by a foreign one: %q", buf)
+	}
+}
+
+func TestCacheNamespace(t *testing.T) {
+	f := newFakeS3(t)
+	cdb := newTestCacheDB(t)
+	a := newTestStorage(t, f, S3Opts{CacheDB: cdb, CacheNamespace: "a"})
+	b := newTestStorage(t, f, S3Opts{CacheDB: cdb, CacheNamespace: "b"})
+	f.put("test/namespace/cert", []byte("cert"))
+
+	if _, err := a.Load(context.Background(), "namespace/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !a.cache.isCacheEntryExistent(context.Background(), []byte("namespace/cert")) {
+		t.Error("entry was not cached")
+	}
+	if b.cache.isCacheEntryExistent(context.Background(), []byte("namespace/cert")) {
+		t.Error("entry is shared between cache namespaces")
+	}
+
+	// The default depends on where the objects live
+	opts := S3Opts{Endpoint: "s3.example.com", Bucket: "bucket", ObjPrefix: "a"}
+	if defaultCacheNamespace(opts) != defaultCacheNamespace(S3Opts{Endpoint: "https://s3.example.com/", Bucket: "bucket", ObjPrefix: "a"}) {
+		t.Error("default namespace depends on how the endpoint is written")
+	}
+	for _, other := range []S3Opts{
+		{Endpoint: "s3.example.org", Bucket: "bucket", ObjPrefix: "a"},
+		{Endpoint: "s3.example.com", Bucket: "other", ObjPrefix: "a"},
+		{Endpoint: "s3.example.com", Bucket: "bucket", ObjPrefix: "b"},
+	} {
+		if defaultCacheNamespace(opts) == defaultCacheNamespace(other) {
+			t.Errorf("%+v shares the default namespace of %+v", other, opts)
+		}
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	mopts, err := minioOptions(S3Opts{
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		SessionToken:    "test-token",
+		TrailingHeaders: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mopts.TrailingHeaders {
+		t.Error("TrailingHeaders was not forwarded")
+	}
+	if creds, err := mopts.Creds.Get(); err != nil || creds.SessionToken != "test-token" || creds.AccessKeyID != "test-key" {
+		t.Errorf("session token was not forwarded: %+v, %v", creds, err)
+	}
+
+	// With a region, requests are signed for it without asking the provider
+	client, err := newS3Client(S3Opts{
+		Endpoint:        "s3.example.com",
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		Region:          "eu-central-1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := client.PresignedGetObject(context.Background(), "test-bucket", "cert", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred := u.Query().Get("X-Amz-Credential"); !strings.Contains(cred, "/eu-central-1/s3/") {
+		t.Errorf("expected requests to be signed for eu-central-1, got %s", cred)
+	}
+
+	for lookup, wantHost := range map[minio.BucketLookupType]string{
+		minio.BucketLookupAuto: "s3.example.com",
+		minio.BucketLookupPath: "s3.example.com",
+		minio.BucketLookupDNS:  "test-bucket.s3.example.com",
+	} {
+		client, err := newS3Client(S3Opts{
+			Endpoint:        "s3.example.com",
+			AccessKeyID:     "test-key",
+			SecretAccessKey: "test-secret",
+			Region:          "eu-west-1",
+			BucketLookup:    lookup,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := client.PresignedGetObject(context.Background(), "test-bucket", "cert", time.Minute, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Host != wantHost {
+			t.Errorf("lookup %v: expected requests to go to %s, got %s", lookup, wantHost, u.Host)
+		}
+	}
+
+	client, err = newS3Client(S3Opts{
+		Endpoint:           "s3.eu-west-1.amazonaws.com",
+		AccessKeyID:        "test-key",
+		SecretAccessKey:    "test-secret",
+		TransferAccelerate: true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = client.PresignedGetObject(context.Background(), "test-bucket", "cert", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "test-bucket."+s3AccelerateEndpoint {
+		t.Errorf("expected requests to go to the accelerate endpoint, got %s", u.Host)
+	}
+}
+
+func TestStatTerminal(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+	f.put("test/stat/example.com/example.com.crt", []byte("cert"))
+
+	ki, err := gs.Stat(ctx, "stat/example.com/example.com.crt")
+	if err != nil || !ki.IsTerminal || ki.Size != 4 {
+		t.Errorf("expected a terminal key of size 4, got %+v, %v", ki, err)
+	}
+	ki, err = gs.Stat(ctx, "stat/example.com")
+	if err != nil || ki.IsTerminal {
+		t.Errorf("expected a directory, got %+v, %v", ki, err)
+	}
+	if _, err := gs.Stat(ctx, "stat/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestStatTerminalFunc(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{
+		TerminalFunc: func(key string) bool { return !strings.HasSuffix(key, ".d") },
+	})
+	ctx := context.Background()
+	f.put("test/stat/cert.crt", []byte("cert"))
+	f.put("test/stat/bundle.d", []byte("bundle"))
+
+	if ki, err := gs.Stat(ctx, "stat/cert.crt"); err != nil || !ki.IsTerminal {
+		t.Errorf("expected a terminal key, got %+v, %v", ki, err)
+	}
+	if ki, err := gs.Stat(ctx, "stat/bundle.d"); err != nil || ki.IsTerminal {
+		t.Errorf("expected a non-terminal key, got %+v, %v", ki, err)
+	}
+}
+
+func TestStatFull(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+	r := strings.NewReader("cert")
+	_, err := gs.s3client.PutObject(ctx, "test-bucket", "test/full/cert.crt", r, r.Size(), minio.PutObjectOptions{
+		ContentType:  "application/x-pem-file",
+		UserMetadata: map[string]string{"Issuer": "acme"},
+		StorageClass: "REDUCED_REDUNDANCY",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := gs.StatFull(ctx, "full/cert.crt")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	obj, _ := f.get("test/full/cert.crt")
+	if info.Key != "full/cert.crt" || info.Size != 4 || !info.IsTerminal || info.ContentType != "application/x-pem-file" ||
+		`"`+info.ETag+`"` != obj.etag() || info.Metadata["Issuer"] != "acme" || info.StorageClass != "REDUCED_REDUNDANCY" {
+		t.Errorf("incomplete info: %+v", info)
+	}
+
+	heads := len(f.recorded(http.MethodHead, "test/full/cert.crt"))
+	cached, err := gs.StatFull(ctx, "full/cert.crt")
+	if err != nil || cached.ContentType != info.ContentType || cached.Metadata["Issuer"] != "acme" {
+		t.Errorf("cached info differs: %+v, %v", cached, err)
+	}
+	if len(f.recorded(http.MethodHead, "test/full/cert.crt")) != heads {
+		t.Error("cached info was not used")
+	}
+
+	if _, err := gs.StatFull(ctx, "full/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestDeleteDropsCache(t *testing.T) {
+	f := newFakeS3(t)
+	// Trusting the cache would serve a stale entry for as long as it lives
+	gs := newTestStorage(t, f, S3Opts{CachePolicy: CacheTrustCache})
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "deleted/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if _, err := gs.Load(ctx, "deleted/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, err := gs.Stat(ctx, "deleted/cert"); err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+
+	if err := gs.Delete(ctx, "deleted/cert"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if buf, err := gs.Load(ctx, "deleted/cert"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %q, %v", buf, err)
+	}
+	if ki, err := gs.Stat(ctx, "deleted/cert"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %+v, %v", ki, err)
+	}
+}
+
+func TestStoreWritesThrough(t *testing.T) {
+	f := newFakeS3(t)
+	// Trusting the cache would serve the previous value for as long as it lives
+	gs := newTestStorage(t, f, S3Opts{CachePolicy: CacheTrustCache})
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "renewed/cert", []byte("old")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if _, err := gs.Load(ctx, "renewed/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, err := gs.Stat(ctx, "renewed/cert"); err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+
+	if err := gs.Store(ctx, "renewed/cert", []byte("renewed")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	gets := len(f.recorded(http.MethodGet, "test/renewed/cert"))
+	if buf, err := gs.Load(ctx, "renewed/cert"); err != nil || string(buf) != "renewed" {
+		t.Errorf("expected the new value, got %q, %v", buf, err)
+	}
+	if n := len(f.recorded(http.MethodGet, "test/renewed/cert")); n != gets {
+		t.Errorf("the stored value was fetched again instead of served from the cache")
+	}
+	if ki, err := gs.Stat(ctx, "renewed/cert"); err != nil || ki.Size != int64(len("renewed")) {
+		t.Errorf("expected the size of the new value, got %+v, %v", ki, err)
+	}
+}
+
+func TestEmptyObjects(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	f.put("test/empty/cert", nil)
+
+	gs := newTestStorage(t, f, S3Opts{})
+	if buf, err := gs.Load(ctx, "empty/cert"); err != nil || len(buf) != 0 {
+		t.Errorf("expected an empty value, got %q, %v", buf, err)
+	}
+
+	// An encrypted storage finds the same empty object, there is nothing to decrypt
+	gs = newTestStorage(t, f, S3Opts{EncryptionKey: []byte("12345678123456781234567812345678")})
+	if buf, err := gs.Load(ctx, "empty/cert"); err != nil || len(buf) != 0 {
+		t.Errorf("expected an empty value from the encrypted storage, got %q, %v", buf, err)
+	}
+
+	gs = newTestStorage(t, f, S3Opts{EmptyObjectsMissing: true})
+	if _, err := gs.Load(ctx, "empty/cert"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected Load to return fs.ErrNotExist, got %v", err)
+	}
+	if _, err := gs.Stat(ctx, "empty/cert"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected Stat to return fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestCacheTTLByPrefix(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{
+		CacheTTLByPrefix: map[string]time.Duration{
+			"ocsp/":               time.Second,
+			"certificates/":       time.Hour,
+			"certificates/short/": time.Second,
+		},
+	})
+	ctx := context.Background()
+
+	keys := []string{"ocsp/example.com", "certificates/example.com.crt", "certificates/short/example.com.crt"}
+	for _, key := range keys {
+		f.put("test/"+key, []byte("value"))
+		if _, err := gs.Load(ctx, key); err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+	for i, cached := range []bool{false, true, false} {
+		if got := gs.cache.isCacheEntryExistent(context.Background(), []byte(keys[i])); got != cached {
+			t.Errorf("%s: expected cached to be %v, got %v", keys[i], cached, got)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CacheTTL: time.Second})
+	ctx := context.Background()
+
+	key := "ttl/example.com.crt"
+	f.put("test/"+key, []byte("value"))
+	if _, err := gs.Load(ctx, key); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !gs.cache.isCacheEntryExistent(ctx, []byte(key)) {
+		t.Fatal("expected the object to be cached")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if gs.cache.isCacheEntryExistent(ctx, []byte(key)) {
+		t.Error("expected the object to expire after CacheTTL")
+	}
+
+	// Lock files are always read from S3 and never cached
+	if err := gs.Lock(ctx, "ttl/example.com"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if gs.cache.isCacheEntryExistent(ctx, []byte("ttl/example.com.lock")) {
+		t.Error("expected the lock file not to be cached")
+	}
+	if err := gs.Unlock(ctx, "ttl/example.com"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+
+	// Unset, entries are cached for an hour
+	gs = newTestStorage(t, f, S3Opts{})
+	if ttl := gs.cacheTTL(key); ttl != time.Hour {
+		t.Errorf("expected the default TTL of an hour, got %v", ttl)
+	}
+}
+
+func TestCacheTTLNoExpiry(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name    string
+		opts    S3Opts
+		key     string
+		expires time.Duration
+	}{
+		{"positive", S3Opts{CacheTTL: time.Minute}, "ttl/example.com.crt", time.Minute},
+		{"zero", S3Opts{}, "ttl/example.com.crt", time.Hour},
+		{"negative", S3Opts{CacheTTL: -1, CacheStaleGrace: time.Minute}, "ttl/example.com.crt", 0},
+		{"negative prefix", S3Opts{CacheTTLByPrefix: map[string]time.Duration{"ocsp/": -1}}, "ocsp/example.com", 0},
+	} {
+		gs := newTestStorage(t, f, tc.opts)
+		f.put("test/"+tc.key, []byte("value"))
+		if _, err := gs.Load(ctx, tc.key); err != nil {
+			t.Fatalf("%s: load failed: %v", tc.name, err)
+		}
+		if _, err := gs.Stat(ctx, tc.key); err != nil {
+			t.Fatalf("%s: stat failed: %v", tc.name, err)
+		}
+
+		for _, entry := range []string{tc.key, tc.key + "_ki"} {
+			_, expiresAt, ok := gs.cache.getCacheEntryWithExpiry(ctx, []byte(entry))
+			switch {
+			case !ok:
+				t.Errorf("%s: %s was not cached", tc.name, entry)
+			case tc.expires == 0 && !expiresAt.IsZero():
+				t.Errorf("%s: expected %s not to expire, expires at %v", tc.name, entry, expiresAt)
+			case tc.expires != 0 && time.Until(expiresAt).Round(time.Minute) < tc.expires:
+				t.Errorf("%s: expected %s to expire in %v, expires at %v", tc.name, entry, tc.expires, expiresAt)
+			}
+		}
+	}
+}
+
+func TestSortedList(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{SortedList: true})
+	f.mu.Lock()
+	f.reverseList = true
+	f.mu.Unlock()
+	for _, key := range []string{"test/b", "test/c", "test/a"} {
+		f.put(key, []byte("value"))
+	}
+
+	keys, err := gs.List(context.Background(), "", true)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if !sort.StringsAreSorted(keys) || len(keys) != 3 {
+		t.Errorf("expected 3 sorted keys, got %v", keys)
+	}
+}
+
+func TestListLoad(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+	stored := map[string]string{"certs/a.crt": "a", "certs/b.crt": "b", "certs/sub/c.crt": "c", "other/d": "d"}
+	for key, value := range stored {
+		if err := gs.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+
+	keys, err := gs.List(ctx, "certs/", true)
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("expected 3 keys, got %v, %v", keys, err)
+	}
+	for _, key := range keys {
+		if buf, err := gs.Load(ctx, key); err != nil || string(buf) != stored[key] {
+			t.Errorf("loading listed key %s failed: %q, %v", key, buf, err)
+		}
+	}
+
+	keys, err = gs.List(ctx, "certs/", false)
+	sort.Strings(keys)
+	if want := []string{"certs/a.crt", "certs/b.crt", "certs/sub/"}; err != nil || fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v, %v", want, keys, err)
+	}
+}
+
+func TestListError(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ListCacheTTL: time.Minute})
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key != "" || r.Method != http.MethodGet || !r.URL.Query().Has("list-type") {
+			return false
+		}
+		if r.URL.Query().Get("continuation-token") != "" {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		// The first page is fine, the listing fails on the second one
+		writeFakeXML(w, struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			Name                  string
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []fakeListEntry
+		}{
+			Name:                  f.bucket,
+			IsTruncated:           true,
+			NextContinuationToken: "page-2",
+			Contents:              []fakeListEntry{{Key: "test/a", LastModified: time.Now().UTC().Format(time.RFC3339)}},
+		})
+		return true
+	})
+
+	keys, err := gs.List(context.Background(), "", true)
+	if minio.ToErrorResponse(err).Code != "AccessDenied" {
+		t.Errorf("expected the listing error, got %v with %v", err, keys)
+	}
+	f.setHook(nil)
+	if keys, err := gs.List(context.Background(), "", true); err != nil || len(keys) != 0 {
+		t.Errorf("the partial listing was cached: %v, %v", keys, err)
+	}
+}
+
+func TestListStream(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	const total = 2000
+	for i := 0; i < total; i++ {
+		f.put(fmt.Sprintf("test/stream/%04d", i), []byte("value"))
+	}
+
+	keys, errs := gs.ListStream(context.Background(), "stream/", true)
+	n := 0
+	for key := range keys {
+		if want := fmt.Sprintf("stream/%04d", n); key != want {
+			t.Fatalf("expected %s, got %s", want, key)
+		}
+		n++
+	}
+	if err := <-errs; err != nil || n != total {
+		t.Errorf("expected %d keys, got %d: %v", total, n, err)
+	}
+
+	// Cancelling stops the listing
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keys, errs = gs.ListStream(ctx, "stream/", true)
+	<-keys
+	cancel()
+	n = 1
+	for range keys {
+		n++
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the listing to be cancelled, got %v", err)
+	}
+	if n >= total {
+		t.Errorf("all %d keys were listed after cancelling", n)
+	}
+}
+
+func TestCacheEntryInfo(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	f.put("test/info/cert", []byte("cert"))
+
+	if present, _, _ := gs.CacheEntryInfo("info/cert"); present {
+		t.Fatal("entry reported before it was cached")
+	}
+	if _, err := gs.Load(context.Background(), "info/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	present, age, ttl := gs.CacheEntryInfo("info/cert")
+	if !present {
+		t.Fatal("cached entry not reported")
+	}
+	if age < 200*time.Millisecond || age > time.Second {
+		t.Errorf("expected an age of about 200ms, got %v", age)
+	}
+	// Badger keeps expiry times in whole seconds
+	if ttl < defaultCacheTTL-2*time.Second || ttl > defaultCacheTTL {
+		t.Errorf("expected about %v remaining, got %v", defaultCacheTTL, ttl)
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ContentEncoding: "gzip"})
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte("cert"))
+	_ = zw.Close()
+	compressed := buf.Bytes()
+
+	if err := gs.Store(ctx, "encoding/gzip", compressed); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if err := gs.Store(WithContentEncoding(ctx, ""), "encoding/plain", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	for key, want := range map[string]string{"test/encoding/gzip": "gzip", "test/encoding/plain": ""} {
+		if obj, _ := f.get(key); obj.header.Get("Content-Encoding") != want {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", key, want, obj.header.Get("Content-Encoding"))
+		}
+	}
+
+	// Nobody on the way decodes the object, Load returns what was stored
+	got, err := gs.Load(ctx, "encoding/gzip")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !bytes.Equal(got, compressed) {
+		t.Errorf("expected the stored gzip bytes, got %q", got)
+	}
+
+	enc := newTestStorage(t, f, S3Opts{EncryptionKey: make([]byte, 32)})
+	if err := enc.Store(WithContentEncoding(ctx, "gzip"), "encoding/enc", compressed); !errors.Is(err, ErrContentEncodingEncrypted) {
+		t.Errorf("expected ErrContentEncodingEncrypted, got %v", err)
+	}
+}
+
+func TestIssuerPrefixes(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{IssuerPrefixes: map[string]string{
+		"acme-v02.api.letsencrypt.org-directory": "/le/",
+		"acme.zerossl.com-v2-dv90":               "zerossl",
+	}})
+	ctx := context.Background()
+
+	for key, name := range map[string]string{
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt": "le/certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+		"acme/acme.zerossl.com-v2-dv90/users/admin/admin.json":                            "zerossl/acme/acme.zerossl.com-v2-dv90/users/admin/admin.json",
+		"certificates/other-ca/example.com/example.com.crt":                               "test/certificates/other-ca/example.com/example.com.crt",
+		"ocsp/example.com": "test/ocsp/example.com",
+	} {
+		if err := gs.Store(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+		if _, ok := f.get(name); !ok {
+			t.Errorf("%s was not stored as %s", key, name)
+		}
+		if buf, err := gs.loadFromS3(ctx, key); err != nil || string(buf) != key {
+			t.Errorf("%s: round trip failed: %q, %v", key, buf, err)
+		}
+	}
+}
+
+func TestIssuerPrefixesList(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{IssuerPrefixes: map[string]string{"acme-a": "le"}, SortedList: true})
+	ctx := context.Background()
+	f.put("le/certificates/acme-a/a.example.com/a.example.com.crt", []byte("cert"))
+	f.put("test/acme/acme-b/users/admin/admin.json", []byte("account"))
+
+	for _, tc := range []struct {
+		prefix    string
+		recursive bool
+		want      []string
+	}{
+		{"", false, []string{"acme/", "certificates/"}},
+		{"certificates", true, []string{"certificates/acme-a/a.example.com/a.example.com.crt"}},
+		{"certificates/", false, []string{"certificates/acme-a/"}},
+		{"certificates/acme-a/", true, []string{"certificates/acme-a/a.example.com/a.example.com.crt"}},
+		{"acme/", false, []string{"acme/acme-b/"}},
+	} {
+		keys, err := gs.List(ctx, tc.prefix, tc.recursive)
+		if err != nil {
+			t.Fatalf("%q: list failed: %v", tc.prefix, err)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(tc.want) {
+			t.Errorf("%q, recursive %v: expected %v, got %v", tc.prefix, tc.recursive, tc.want, keys)
+		}
+	}
+
+	// The directories above the issuer's keys only exist under its prefix
+	for _, key := range []string{"certificates", "certificates/acme-a"} {
+		ki, err := gs.Stat(ctx, key)
+		if err != nil || ki.IsTerminal {
+			t.Errorf("%s: expected a directory, got %+v, %v", key, ki, err)
+		}
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		policy     CachePolicy
+		wantLoad   error
+		wantExists bool
+	}{
+		{"", fs.ErrNotExist, false},
+		{CacheRevalidate, fs.ErrNotExist, false},
+		{CacheTrustCache, nil, true},
+		{CacheTrustS3, fs.ErrNotExist, false},
+	} {
+		gs := newTestStorage(t, f, S3Opts{CachePolicy: tc.policy})
+		f.put("test/policy/cert", []byte("cert"))
+		if _, err := gs.Load(ctx, "policy/cert"); err != nil {
+			t.Fatalf("%q: load failed: %v", tc.policy, err)
+		}
+
+		f.remove("test/policy/cert")
+		buf, err := gs.Load(ctx, "policy/cert")
+		if !errors.Is(err, tc.wantLoad) || (err == nil && string(buf) != "cert") {
+			t.Errorf("%q: expected %v after the object was deleted, got %q, %v", tc.policy, tc.wantLoad, buf, err)
+		}
+		if got := gs.Exists(ctx, "policy/cert"); got != tc.wantExists {
+			t.Errorf("%q: expected Exists to return %v, got %v", tc.policy, tc.wantExists, got)
+		}
+	}
+
+	// A changed object is loaded again
+	gs := newTestStorage(t, f, S3Opts{})
+	f.put("test/policy/cert", []byte("cert"))
+	if _, err := gs.Load(ctx, "policy/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	f.put("test/policy/cert", []byte("renewed"))
+	if buf, err := gs.Load(ctx, "policy/cert"); err != nil || string(buf) != "renewed" {
+		t.Errorf("expected the changed object, got %q, %v", buf, err)
+	}
+
+	// The cached copy is served while S3 is unavailable
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		writeFakeError(w, http.StatusForbidden, "AccessDenied")
+		return true
+	})
+	if buf, err := gs.Load(ctx, "policy/cert"); err != nil || string(buf) != "renewed" {
+		t.Errorf("expected the cached copy, got %q, %v", buf, err)
+	}
+}
@@ -1,12 +1,23 @@
 package badgers3
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"reflect"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
@@ -53,9 +64,8 @@ func (sb *SecretBoxIO) readNonce(r io.Reader) ([24]byte, error) {
 		nonce = make([]byte, 24)
 		n     [24]byte
 	)
-	l, err := r.Read(nonce)
-	if l != 24 || err != nil {
-		return n, nil
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return n, err
 	}
 	copy(n[:], nonce)
 	return n, nil
@@ -69,11 +79,15 @@ func (sb *SecretBoxIO) makeNonce() ([24]byte, error) {
 
 func (sb *SecretBoxIO) WrapReader(r io.Reader) io.Reader {
 	nonce, err := sb.readNonce(r)
+	if err == io.EOF {
+		// Nothing was stored, so there is nothing to decrypt
+		return bytes.NewReader(nil)
+	}
 	if err != nil {
 		return Reader{nil, 0, err}
 	}
 
-	buf, _ := ioutil.ReadAll(r)
+	buf, _ := io.ReadAll(r)
 	bout, ok := secretbox.Open(nil, buf, &nonce, &sb.SecretKey)
 	if !ok {
 		return Reader{nil, 0, errors.New("decryption failed")}
@@ -88,3 +102,392 @@ func (sb *SecretBoxIO) ByteReader(msg []byte) Reader {
 	out = secretbox.Seal(out, msg, &nonce, &sb.SecretKey)
 	return Reader{bytes.NewReader(out), int64(len(out)), err}
 }
+
+// AESGCMIO encrypts objects with AES-256-GCM, for deployments that need a FIPS approved algorithm. Objects start
+// with the random 12 byte nonce, followed by the ciphertext and tag.
+type AESGCMIO struct {
+	SecretKey [32]byte
+}
+
+func (ag *AESGCMIO) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(ag.SecretKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (ag *AESGCMIO) WrapReader(r io.Reader) io.Reader {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	if len(buf) == 0 {
+		return bytes.NewReader(nil)
+	}
+	aead, err := ag.aead()
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	if len(buf) < aead.NonceSize() {
+		return Reader{nil, 0, errors.New("decryption failed")}
+	}
+	bout, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], nil)
+	if err != nil {
+		return Reader{nil, 0, errors.New("decryption failed")}
+	}
+	return bytes.NewReader(bout)
+}
+
+func (ag *AESGCMIO) ByteReader(msg []byte) Reader {
+	aead, err := ag.aead()
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return Reader{nil, 0, err}
+	}
+	out := aead.Seal(nonce, nonce, msg, nil)
+	return Reader{bytes.NewReader(out), int64(len(out)), nil}
+}
+
+// EncryptionAlgorithm selects the cipher objects are encrypted with when EncryptionKey is set.
+type EncryptionAlgorithm string
+
+const (
+	// EncryptionSecretBox encrypts with NaCl SecretBox (XSalsa20-Poly1305). This is the default.
+	EncryptionSecretBox EncryptionAlgorithm = "secretbox"
+	// EncryptionAESGCM encrypts with AES-256-GCM.
+	EncryptionAESGCM EncryptionAlgorithm = "aes-gcm"
+)
+
+// GzipIO compresses objects with gzip. It is meant to be combined with other layers, see IOLayers and Compression.
+// Objects that don't start with the gzip header, e.g. stored before compression was enabled, are read as they are.
+type GzipIO struct{}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (gz *GzipIO) WrapReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return br
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	return zr
+}
+
+// Compression selects how objects are compressed before they are encrypted and stored.
+type Compression string
+
+const (
+	// CompressionNone stores objects uncompressed. This is the default.
+	CompressionNone Compression = ""
+	// CompressionGzip compresses objects with gzip.
+	CompressionGzip Compression = "gzip"
+)
+
+func (gz *GzipIO) ByteReader(msg []byte) Reader {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(msg)
+	if err == nil {
+		err = zw.Close()
+	}
+	return Reader{bytes.NewReader(buf.Bytes()), int64(buf.Len()), err}
+}
+
+// IOLayer creates one layer of an IO chain.
+type IOLayer func() (IO, error)
+
+// GzipLayer returns a layer compressing objects.
+func GzipLayer() IOLayer {
+	return func() (IO, error) { return &GzipIO{}, nil }
+}
+
+// SecretBoxLayer returns a layer encrypting objects with key, which must have exactly 32 bytes.
+func SecretBoxLayer(key []byte) IOLayer {
+	return func() (IO, error) {
+		if len(key) != 32 {
+			return nil, errors.New("encryption key must have exactly 32 bytes")
+		}
+		sb := &SecretBoxIO{}
+		copy(sb.SecretKey[:], key)
+		return sb, nil
+	}
+}
+
+// AESGCMLayer returns a layer encrypting objects with AES-256-GCM and key, which must have exactly 32 bytes.
+func AESGCMLayer(key []byte) IOLayer {
+	return func() (IO, error) {
+		if len(key) != 32 {
+			return nil, errors.New("encryption key must have exactly 32 bytes")
+		}
+		ag := &AESGCMIO{}
+		copy(ag.SecretKey[:], key)
+		return ag, nil
+	}
+}
+
+// minPassphraseSaltLen is the shortest PassphraseSalt accepted
+const minPassphraseSaltLen = 8
+
+// PassphraseKey derives a 32 byte encryption key from passphrase and salt with Argon2id, as NewS3Storage does for
+// S3Opts.Passphrase. The same passphrase and salt always give the same key.
+func PassphraseKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, 3, 64*1024, 4, 32)
+}
+
+// ChainIO applies several IOs in order when storing, e.g. compress then encrypt, and in reverse order when loading.
+type ChainIO struct {
+	Layers []IO
+}
+
+// NewChainIO builds the chain from layers and checks that data survives a round trip through it.
+func NewChainIO(layers ...IOLayer) (*ChainIO, error) {
+	ch := &ChainIO{}
+	for _, layer := range layers {
+		l, err := layer()
+		if err != nil {
+			return nil, err
+		}
+		ch.Layers = append(ch.Layers, l)
+	}
+
+	probe := []byte("badger-s3 round trip probe")
+	r := ch.ByteReader(probe)
+	buf, err := io.ReadAll(ch.WrapReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("IO chain does not round trip: %w", err)
+	}
+	if !bytes.Equal(buf, probe) {
+		return nil, errors.New("IO chain does not round trip: data changed")
+	}
+	return ch, nil
+}
+
+func (ch *ChainIO) ForKey(key string) IO {
+	keyed := &ChainIO{Layers: make([]IO, len(ch.Layers))}
+	for i, l := range ch.Layers {
+		keyed.Layers[i] = ioForKey(l, key)
+	}
+	return keyed
+}
+
+func (ch *ChainIO) WithContext(ctx context.Context) IO {
+	bound := &ChainIO{Layers: make([]IO, len(ch.Layers))}
+	for i, l := range ch.Layers {
+		bound.Layers[i] = ioWithContext(ctx, l)
+	}
+	return bound
+}
+
+func (ch *ChainIO) WrapReader(r io.Reader) io.Reader {
+	for i := len(ch.Layers) - 1; i >= 0; i-- {
+		r = ch.Layers[i].WrapReader(r)
+	}
+	return r
+}
+
+func (ch *ChainIO) ByteReader(msg []byte) Reader {
+	for _, l := range ch.Layers {
+		buf, err := io.ReadAll(l.ByteReader(msg))
+		if err != nil {
+			return Reader{nil, 0, err}
+		}
+		msg = buf
+	}
+	return Reader{bytes.NewReader(msg), int64(len(msg)), nil}
+}
+
+// KeyedIO is an IO that wraps every object differently, depending on its key.
+type KeyedIO interface {
+	IO
+	// ForKey returns the IO for the object stored for key.
+	ForKey(key string) IO
+}
+
+// ioForKey returns the IO to use for the object stored for key.
+func ioForKey(iowrap IO, key string) IO {
+	if kio, ok := iowrap.(KeyedIO); ok {
+		return kio.ForKey(key)
+	}
+	return iowrap
+}
+
+// ContextIO is an IO that calls out to another service, such as KMSIO does, and needs the context of the storage
+// operation it runs in to give up along with it.
+type ContextIO interface {
+	IO
+	// WithContext returns the IO to use within an operation running under ctx.
+	WithContext(ctx context.Context) IO
+}
+
+// ioWithContext returns the IO to use within an operation running under ctx.
+func ioWithContext(ctx context.Context, iowrap IO) IO {
+	if cio, ok := iowrap.(ContextIO); ok {
+		return cio.WithContext(ctx)
+	}
+	return iowrap
+}
+
+// ioFor returns the IO to use for the object stored for key, within an operation running under ctx.
+func ioFor(ctx context.Context, iowrap IO, key string) IO {
+	return ioWithContext(ctx, ioForKey(iowrap, key))
+}
+
+// DerivedSecretBoxIO encrypts every object with SecretBox under its own subkey, derived from MasterKey and the
+// object's key with HKDF-SHA256. A leaked subkey only exposes a single object. Objects encrypted with the master key
+// itself, like SecretBoxIO does, can still be read.
+type DerivedSecretBoxIO struct {
+	MasterKey [32]byte
+}
+
+// subkey derives the encryption key for the object stored for key.
+func (d *DerivedSecretBoxIO) subkey(key string) ([32]byte, error) {
+	var sub [32]byte
+	_, err := io.ReadFull(hkdf.New(sha256.New, d.MasterKey[:], nil, []byte("badger-s3 object key "+key)), sub[:])
+	return sub, err
+}
+
+func (d *DerivedSecretBoxIO) ForKey(key string) IO {
+	sub, err := d.subkey(key)
+	if err != nil {
+		return &failedIO{err}
+	}
+	return &fallbackIO{
+		primary:  &SecretBoxIO{SecretKey: sub},
+		fallback: &SecretBoxIO{SecretKey: d.MasterKey},
+	}
+}
+
+// WrapReader and ByteReader use the master key, for callers that don't know the object's key.
+func (d *DerivedSecretBoxIO) WrapReader(r io.Reader) io.Reader {
+	return (&SecretBoxIO{SecretKey: d.MasterKey}).WrapReader(r)
+}
+
+func (d *DerivedSecretBoxIO) ByteReader(msg []byte) Reader {
+	return (&SecretBoxIO{SecretKey: d.MasterKey}).ByteReader(msg)
+}
+
+// fallbackIO writes with primary and reads with primary or, if that fails, fallback.
+type fallbackIO struct {
+	primary, fallback IO
+}
+
+func (f *fallbackIO) ForKey(key string) IO {
+	return &fallbackIO{primary: ioForKey(f.primary, key), fallback: ioForKey(f.fallback, key)}
+}
+
+func (f *fallbackIO) WrapReader(r io.Reader) io.Reader {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	if buf, err := io.ReadAll(f.primary.WrapReader(bytes.NewReader(raw))); err == nil {
+		return bytes.NewReader(buf)
+	}
+	return f.fallback.WrapReader(bytes.NewReader(raw))
+}
+
+func (f *fallbackIO) ByteReader(msg []byte) Reader {
+	return f.primary.ByteReader(msg)
+}
+
+// failedIO fails every read and write with err.
+type failedIO struct {
+	err error
+}
+
+func (f *failedIO) WrapReader(io.Reader) io.Reader { return Reader{nil, 0, f.err} }
+func (f *failedIO) ByteReader([]byte) Reader       { return Reader{nil, 0, f.err} }
+
+// Object metadata recording how an object was written. Objects stored by older versions lack it.
+const (
+	schemeMetaKey    = "Badger-S3-Scheme"
+	ioVersionMetaKey = "Badger-S3-Io-Version"
+	ioVersion        = "1"
+)
+
+// ioScheme returns the name recorded for objects written with iowrap, e.g. "secretbox" or "gzip+secretbox" for a
+// chain. IOs implemented outside this package have no name.
+func ioScheme(iowrap IO) string {
+	switch t := iowrap.(type) {
+	case *CleartextIO:
+		return "cleartext"
+	case *SecretBoxIO:
+		return "secretbox"
+	case *DerivedSecretBoxIO:
+		return "secretbox-derived"
+	case *AESGCMIO:
+		return "aes-gcm"
+	case *KMSIO:
+		return "kms"
+	case *fallbackIO:
+		return ioScheme(t.primary)
+	case *EnvelopeIO:
+		return ioScheme(t.entries[0].io)
+	case *GzipIO:
+		return "gzip"
+	case *ChainIO:
+		names := make([]string, len(t.Layers))
+		for i, l := range t.Layers {
+			if names[i] = ioScheme(l); names[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(names, "+")
+	}
+	return ""
+}
+
+// sameIO reports whether a and b write objects the same way. IOs of this package are told apart by ioIdentity.
+// Others are compared with == only if their dynamic type allows it, as == panics for e.g. structs holding a slice,
+// and are considered different otherwise.
+func sameIO(a, b IO) bool {
+	if idA, idB := ioIdentity(a), ioIdentity(b); idA != "" || idB != "" {
+		return idA == idB
+	}
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.ValueOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// ioIdentity names the scheme and key objects written with iowrap are encrypted with, e.g. the envelope header of a
+// SecretBoxIO. It is empty for KMSIO, whose key is up to the provider, and IOs implemented outside this package.
+func ioIdentity(iowrap IO) string {
+	switch t := iowrap.(type) {
+	case *CleartextIO, *GzipIO:
+		return ioScheme(iowrap)
+	case *SecretBoxIO, *AESGCMIO, *DerivedSecretBoxIO:
+		header, _ := envelopeHeader(t)
+		return hex.EncodeToString(header)
+	case *EnvelopeIO:
+		return "envelope:" + hex.EncodeToString(t.entries[0].header)
+	case *fallbackIO:
+		return ioIdentity(t.primary)
+	case *ChainIO:
+		ids := make([]string, len(t.Layers))
+		for i, l := range t.Layers {
+			if ids[i] = ioIdentity(l); ids[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(ids, "+")
+	}
+	return ""
+}
+
+// schemeMetadata returns the user metadata recording that an object was written with iowrap, nil if iowrap has no
+// name.
+func schemeMetadata(iowrap IO) map[string]string {
+	name := ioScheme(iowrap)
+	if name == "" {
+		return nil
+	}
+	return map[string]string{schemeMetaKey: name, ioVersionMetaKey: ioVersion}
+}
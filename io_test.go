@@ -2,8 +2,17 @@ package badgers3
 
 import (
 	"bytes"
-	"io/ioutil"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -19,7 +28,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	msg := []byte("This is a very important message that shall be encrypted...")
 	r := sb.ByteReader(msg)
 
-	buf, err := ioutil.ReadAll(r)
+	buf, err := io.ReadAll(r)
 	if err != nil {
 		t.Errorf("encrypting failed: %v", err)
 	}
@@ -27,7 +36,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	w := bytes.NewReader(buf)
 	wb := sb.WrapReader(w)
 
-	buf, err = ioutil.ReadAll(wb)
+	buf, err = io.ReadAll(wb)
 	if err != nil {
 		t.Errorf("decrypting failed: %v", err)
 	}
@@ -37,13 +46,33 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
+func TestDecryptShortReads(t *testing.T) {
+	sb := SecretBoxIO{}
+	msg := []byte("certificate")
+	enc, err := io.ReadAll(sb.ByteReader(msg))
+	if err != nil {
+		t.Fatalf("encrypting failed: %v", err)
+	}
+
+	// Network readers may return the nonce in several reads
+	buf, err := io.ReadAll(sb.WrapReader(iotest.OneByteReader(bytes.NewReader(enc))))
+	if err != nil || string(buf) != string(msg) {
+		t.Errorf("expected %q, got %q, %v", msg, buf, err)
+	}
+
+	// An object that ends within the nonce is not empty, it is broken
+	if _, err := io.ReadAll(sb.WrapReader(bytes.NewReader(enc[:10]))); err == nil {
+		t.Error("expected a truncated object to fail")
+	}
+}
+
 func TestIOWrap(t *testing.T) {
 	empty := bytes.NewReader(nil)
 
 	sb := SecretBoxIO{}
 	wr := sb.WrapReader(empty)
 
-	buf, err := ioutil.ReadAll(wr)
+	buf, err := io.ReadAll(wr)
 	if err != nil {
 		t.Errorf("reading failed: %s", err)
 	}
@@ -51,3 +80,203 @@ func TestIOWrap(t *testing.T) {
 		t.Errorf("Buffer should be empty, got: %v", buf)
 	}
 }
+
+func TestChainIO(t *testing.T) {
+	key := []byte("12345678123456781234567812345678")
+	msg := bytes.Repeat([]byte("This is a very important message that shall be compressed and encrypted..."), 20)
+
+	ch, err := NewChainIO(GzipLayer(), SecretBoxLayer(key))
+	if err != nil {
+		t.Fatalf("building chain failed: %v", err)
+	}
+	stored, err := io.ReadAll(ch.ByteReader(msg))
+	if err != nil {
+		t.Fatalf("storing failed: %v", err)
+	}
+
+	// Compressed first, so the ciphertext is much smaller than the message
+	if len(stored) >= len(msg)/4 {
+		t.Errorf("expected compression before encryption, stored %d of %d bytes", len(stored), len(msg))
+	}
+	sb := ch.Layers[1].(*SecretBoxIO)
+	compressed, err := io.ReadAll(sb.WrapReader(bytes.NewReader(stored)))
+	if err != nil {
+		t.Fatalf("outer layer is not encryption: %v", err)
+	}
+	if _, err := io.ReadAll((&GzipIO{}).WrapReader(bytes.NewReader(compressed))); err != nil {
+		t.Errorf("inner layer is not compression: %v", err)
+	}
+
+	buf, err := io.ReadAll(ch.WrapReader(bytes.NewReader(stored)))
+	if err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("round trip failed: %v", err)
+	}
+
+	if _, err := NewChainIO(GzipLayer(), SecretBoxLayer(key[:16])); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
+
+func TestDerivedSecretBoxIO(t *testing.T) {
+	d := &DerivedSecretBoxIO{}
+	copy(d.MasterKey[:], "12345678123456781234567812345678")
+	msg := []byte("This is a very important message that shall be encrypted...")
+
+	a1, _ := d.subkey("a.example.com/a.example.com.key")
+	a2, _ := d.subkey("a.example.com/a.example.com.key")
+	b, _ := d.subkey("b.example.com/b.example.com.key")
+	if a1 != a2 {
+		t.Error("subkey derivation is not deterministic")
+	}
+	if a1 == b || a1 == d.MasterKey {
+		t.Error("objects share a key")
+	}
+
+	stored, err := io.ReadAll(d.ForKey("a.example.com/a.example.com.key").ByteReader(msg))
+	if err != nil {
+		t.Fatalf("encrypting failed: %v", err)
+	}
+	buf, err := io.ReadAll(d.ForKey("a.example.com/a.example.com.key").WrapReader(bytes.NewReader(stored)))
+	if err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("round trip failed: %q, %v", buf, err)
+	}
+	if _, err := io.ReadAll(d.ForKey("b.example.com/b.example.com.key").WrapReader(bytes.NewReader(stored))); err == nil {
+		t.Error("object was decrypted with the key of another object")
+	}
+	if _, err := io.ReadAll(d.WrapReader(bytes.NewReader(stored))); err == nil {
+		t.Error("object was decrypted with the master key")
+	}
+
+	// Written before keys were derived
+	legacy, _ := io.ReadAll((&SecretBoxIO{SecretKey: d.MasterKey}).ByteReader(msg))
+	buf, err = io.ReadAll(d.ForKey("a.example.com/a.example.com.key").WrapReader(bytes.NewReader(legacy)))
+	if err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("object encrypted with the master key can't be read: %q, %v", buf, err)
+	}
+}
+
+func TestAESGCMIO(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "12345678123456781234567812345678")
+	ag := &AESGCMIO{SecretKey: key}
+	sb := &SecretBoxIO{SecretKey: key}
+	msg := []byte("This is a very important message that shall be encrypted...")
+
+	for _, iowrap := range []IO{ag, sb} {
+		enc, err := io.ReadAll(iowrap.ByteReader(msg))
+		if err != nil {
+			t.Fatalf("%s: encrypting failed: %v", ioScheme(iowrap), err)
+		}
+		if buf, err := io.ReadAll(iowrap.WrapReader(bytes.NewReader(enc))); err != nil || !bytes.Equal(buf, msg) {
+			t.Errorf("%s: round trip failed: %q, %v", ioScheme(iowrap), buf, err)
+		}
+
+		// Neither algorithm must accept what the other one wrote
+		other := IO(sb)
+		if iowrap == IO(sb) {
+			other = ag
+		}
+		if _, err := io.ReadAll(other.WrapReader(bytes.NewReader(enc))); err == nil {
+			t.Errorf("%s read data written with %s", ioScheme(other), ioScheme(iowrap))
+		}
+	}
+
+	if buf, err := io.ReadAll(ag.WrapReader(bytes.NewReader(nil))); err != nil || len(buf) != 0 {
+		t.Errorf("reading an empty object failed: %q, %v", buf, err)
+	}
+	if _, err := io.ReadAll(ag.WrapReader(bytes.NewReader([]byte("short")))); err == nil {
+		t.Error("reading a truncated object succeeded")
+	}
+}
+
+// testCertBundle returns a PEM encoded chain of a leaf, an intermediate and a root certificate, like CertMagic stores.
+func testCertBundle(tb testing.TB) []byte {
+	var (
+		bundle    bytes.Buffer
+		parent    *x509.Certificate
+		parentKey *ecdsa.PrivateKey
+		chain     [][]byte
+		names     = []string{"Test Root CA", "Test Intermediate CA", "www.example.com"}
+		notBefore = time.Now()
+		serial    int64
+	)
+	for _, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			tb.Fatalf("generating key failed: %v", err)
+		}
+		serial++
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name, Organization: []string{"badger-s3 tests"}},
+			NotBefore:             notBefore,
+			NotAfter:              notBefore.Add(90 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  name != "www.example.com",
+		}
+		if !tmpl.IsCA {
+			tmpl.DNSNames = []string{name, "example.com"}
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			tb.Fatalf("creating certificate failed: %v", err)
+		}
+		parent, parentKey = tmpl, key
+		chain = append([][]byte{der}, chain...)
+	}
+	for _, der := range chain {
+		_ = pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return bundle.Bytes()
+}
+
+func TestPassphraseKey(t *testing.T) {
+	salt := []byte("badger-s3 salt")
+	key := PassphraseKey("correct horse battery staple", salt)
+	if len(key) != 32 {
+		t.Fatalf("expected a 32 byte key, got %d bytes", len(key))
+	}
+	if again := PassphraseKey("correct horse battery staple", salt); !bytes.Equal(again, key) {
+		t.Error("the same passphrase and salt gave different keys")
+	}
+	if other := PassphraseKey("correct horse battery staple", []byte("another salt...")); bytes.Equal(other, key) {
+		t.Error("different salts gave the same key")
+	}
+	if other := PassphraseKey("correct horse battery stapler", salt); bytes.Equal(other, key) {
+		t.Error("different passphrases gave the same key")
+	}
+}
+
+func TestGzipIOLegacy(t *testing.T) {
+	gz := &GzipIO{}
+	for _, stored := range [][]byte{nil, []byte("x"), []byte("-----BEGIN CERTIFICATE-----")} {
+		if buf, err := io.ReadAll(gz.WrapReader(bytes.NewReader(stored))); err != nil || !bytes.Equal(buf, stored) {
+			t.Errorf("reading uncompressed %q failed: %q, %v", stored, buf, err)
+		}
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	bundle := testCertBundle(b)
+	var key [32]byte
+	for _, iowrap := range []IO{
+		&CleartextIO{},
+		&GzipIO{},
+		&SecretBoxIO{SecretKey: key},
+		&ChainIO{Layers: []IO{&GzipIO{}, &SecretBoxIO{SecretKey: key}}},
+	} {
+		b.Run(ioScheme(iowrap), func(b *testing.B) {
+			var stored []byte
+			for i := 0; i < b.N; i++ {
+				stored, _ = io.ReadAll(iowrap.ByteReader(bundle))
+			}
+			b.ReportMetric(float64(len(stored)), "stored-bytes")
+			b.ReportMetric(float64(len(stored))/float64(len(bundle)), "ratio")
+		})
+	}
+}
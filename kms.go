@@ -0,0 +1,104 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KMSProvider manages the master key of envelope encryption with KMSIO, e.g. backed by AWS KMS or Vault's transit
+// engine. The master key never leaves the provider, only data keys wrapped by it are stored with the objects.
+type KMSProvider interface {
+	// GenerateDataKey returns a new random 32 byte data key, in plaintext and wrapped by the current master key.
+	GenerateDataKey(ctx context.Context) (plaintext, wrapped []byte, err error)
+	// Decrypt unwraps a data key returned by GenerateDataKey. It must keep working for data keys wrapped by master
+	// keys that were rotated since.
+	Decrypt(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// Objects written by KMSIO start with the magic bytes and the format version, followed by the length of the wrapped
+// data key as a big endian uint16, the wrapped data key and the object encrypted with AES-256-GCM under the data key.
+const (
+	kmsMagic   = "BS3K"
+	kmsVersion = 1
+)
+
+// KMSIO encrypts every object with its own data key from Provider and stores the data key, wrapped by the
+// provider's master key, in front of it. Reading an object asks the provider to unwrap its data key.
+type KMSIO struct {
+	Provider KMSProvider
+
+	// ctx is the context of the storage operation the provider is called for, see WithContext
+	ctx context.Context
+}
+
+// WithContext returns a KMSIO calling the provider with ctx, so that a KMS that doesn't answer fails the storage
+// operation once ctx is done instead of blocking it.
+func (k *KMSIO) WithContext(ctx context.Context) IO {
+	return &KMSIO{Provider: k.Provider, ctx: ctx}
+}
+
+func (k *KMSIO) context() context.Context {
+	if k.ctx == nil {
+		return context.Background()
+	}
+	return k.ctx
+}
+
+func (k *KMSIO) WrapReader(r io.Reader) io.Reader {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+	if len(raw) == 0 {
+		return bytes.NewReader(nil)
+	}
+
+	header := len(kmsMagic) + 1 + 2
+	if len(raw) < header || string(raw[:len(kmsMagic)]) != kmsMagic || raw[len(kmsMagic)] != kmsVersion {
+		return Reader{nil, 0, errors.New("object was not encrypted with a KMS data key")}
+	}
+	wrappedLen := int(binary.BigEndian.Uint16(raw[len(kmsMagic)+1:]))
+	if len(raw) < header+wrappedLen {
+		return Reader{nil, 0, errors.New("decryption failed")}
+	}
+
+	dataKey, err := k.Provider.Decrypt(k.context(), raw[header:header+wrappedLen])
+	if err != nil {
+		return Reader{nil, 0, fmt.Errorf("unwrapping data key failed: %w", err)}
+	}
+	if len(dataKey) != 32 {
+		return Reader{nil, 0, fmt.Errorf("KMS returned a data key of %d bytes, expected 32", len(dataKey))}
+	}
+	ag := &AESGCMIO{}
+	copy(ag.SecretKey[:], dataKey)
+	return ag.WrapReader(bytes.NewReader(raw[header+wrappedLen:]))
+}
+
+func (k *KMSIO) ByteReader(msg []byte) Reader {
+	dataKey, wrapped, err := k.Provider.GenerateDataKey(k.context())
+	if err != nil {
+		return Reader{nil, 0, fmt.Errorf("generating data key failed: %w", err)}
+	}
+	if len(dataKey) != 32 {
+		return Reader{nil, 0, fmt.Errorf("KMS returned a data key of %d bytes, expected 32", len(dataKey))}
+	}
+	if len(wrapped) > 0xffff {
+		return Reader{nil, 0, fmt.Errorf("KMS returned a wrapped data key of %d bytes, at most 65535 are supported", len(wrapped))}
+	}
+
+	ag := &AESGCMIO{}
+	copy(ag.SecretKey[:], dataKey)
+	enc, err := io.ReadAll(ag.ByteReader(msg))
+	if err != nil {
+		return Reader{nil, 0, err}
+	}
+
+	out := append([]byte(kmsMagic), kmsVersion, 0, 0)
+	binary.BigEndian.PutUint16(out[len(kmsMagic)+1:], uint16(len(wrapped)))
+	out = append(append(out, wrapped...), enc...)
+	return Reader{bytes.NewReader(out), int64(len(out)), nil}
+}
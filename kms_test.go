@@ -0,0 +1,175 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKMS wraps data keys with SecretBox under a master key, which can be rotated. The first byte of a wrapped key
+// names the master key.
+type fakeKMS struct {
+	mu      sync.Mutex
+	masters []*SecretBoxIO
+	calls   int
+	// hang makes every call block until its context is done
+	hang bool
+}
+
+func newFakeKMS() *fakeKMS {
+	k := &fakeKMS{}
+	k.rotate()
+	return k
+}
+
+func (k *fakeKMS) rotate() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	master := &SecretBoxIO{}
+	_, _ = io.ReadFull(rand.Reader, master.SecretKey[:])
+	k.masters = append(k.masters, master)
+}
+
+func (k *fakeKMS) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	if err := k.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.calls++
+	dataKey := make([]byte, 32)
+	_, _ = io.ReadFull(rand.Reader, dataKey)
+	wrapped, err := io.ReadAll(k.masters[len(k.masters)-1].ByteReader(dataKey))
+	return dataKey, append([]byte{byte(len(k.masters) - 1)}, wrapped...), err
+}
+
+func (k *fakeKMS) Decrypt(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if err := k.wait(ctx); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.calls++
+	if len(wrapped) == 0 || int(wrapped[0]) >= len(k.masters) {
+		return nil, errors.New("unknown master key")
+	}
+	return io.ReadAll(k.masters[wrapped[0]].WrapReader(bytes.NewReader(wrapped[1:])))
+}
+
+// wait blocks until ctx is done if the KMS hangs.
+func (k *fakeKMS) wait(ctx context.Context) error {
+	k.mu.Lock()
+	hang := k.hang
+	k.mu.Unlock()
+	if !hang {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestKMSIO(t *testing.T) {
+	kms := newFakeKMS()
+	kio := &KMSIO{Provider: kms}
+	msg := []byte("This is a very important message that shall be encrypted...")
+
+	enc, err := io.ReadAll(kio.ByteReader(msg))
+	if err != nil {
+		t.Fatalf("encrypting failed: %v", err)
+	}
+	if bytes.Contains(enc, msg) {
+		t.Error("object was stored in cleartext")
+	}
+
+	// Objects encrypted under the previous master key remain readable after a rotation
+	kms.rotate()
+	rotated, _ := io.ReadAll(kio.ByteReader(msg))
+	for _, stored := range [][]byte{enc, rotated} {
+		if buf, err := io.ReadAll(kio.WrapReader(bytes.NewReader(stored))); err != nil || !bytes.Equal(buf, msg) {
+			t.Errorf("round trip failed: %q, %v", buf, err)
+		}
+	}
+	if enc[len(kmsMagic)+3] == rotated[len(kmsMagic)+3] {
+		t.Error("data key was not wrapped with the new master key")
+	}
+
+	// Another KMS can't unwrap the data key
+	if _, err := io.ReadAll((&KMSIO{Provider: newFakeKMS()}).WrapReader(bytes.NewReader(rotated))); err == nil {
+		t.Error("object was readable with another master key")
+	}
+	legacy, _ := io.ReadAll((&SecretBoxIO{}).ByteReader(msg))
+	if _, err := io.ReadAll(kio.WrapReader(bytes.NewReader(legacy))); err == nil {
+		t.Error("object not written by KMSIO was accepted")
+	}
+	if buf, err := io.ReadAll(kio.WrapReader(bytes.NewReader(nil))); err != nil || len(buf) != 0 {
+		t.Errorf("reading an empty object failed: %q, %v", buf, err)
+	}
+}
+
+func TestKMSStorage(t *testing.T) {
+	f := newFakeS3(t)
+	kms := newFakeKMS()
+	gs := newTestStorage(t, f, S3Opts{KMS: kms})
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "kms/cert", []byte("value")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	kms.rotate()
+	if err := gs.Store(ctx, "kms/key", []byte("other value")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	for key, want := range map[string]string{"kms/cert": "value", "kms/key": "other value"} {
+		if buf, err := gs.loadFromS3(ctx, key); err != nil || string(buf) != want {
+			t.Errorf("%s: round trip failed: %q, %v", key, buf, err)
+		}
+	}
+	obj, _ := f.get("test/kms/cert")
+	if got := obj.header.Get("X-Amz-Meta-Badger-S3-Scheme"); got != "kms" {
+		t.Errorf("expected the object to record kms, got %q", got)
+	}
+
+	if err := ValidateOpts(S3Opts{Endpoint: "s3.example.com", Bucket: "bucket", KMS: kms, EncryptionKey: make([]byte, 32)}); err == nil {
+		t.Error("KMS and EncryptionKey were accepted together")
+	}
+}
+
+func TestKMSContext(t *testing.T) {
+	f := newFakeS3(t)
+	kms := newFakeKMS()
+	gs := newTestStorage(t, f, S3Opts{KMS: kms, CachePolicy: CacheTrustS3})
+	if err := gs.Store(context.Background(), "kms/cert", []byte("value")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	gs.deleteCacheEntry("kms/cert")
+
+	// A KMS that doesn't answer fails the operation once its context is done
+	kms.mu.Lock()
+	kms.hang = true
+	kms.mu.Unlock()
+	for name, op := range map[string]func(ctx context.Context) error{
+		"store": func(ctx context.Context) error { return gs.Store(ctx, "kms/cert", []byte("other value")) },
+		"load": func(ctx context.Context) error {
+			_, err := gs.Load(ctx, "kms/cert")
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		done := make(chan error, 1)
+		go func() { done <- op(ctx) }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s succeeded without the KMS", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s blocked on the KMS after its context was done", name)
+		}
+		cancel()
+	}
+}
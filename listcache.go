@@ -0,0 +1,74 @@
+package badgers3
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type listCacheKey struct {
+	prefix    string
+	recursive bool
+}
+
+type listCacheEntry struct {
+	keys    []string
+	expires time.Time
+}
+
+// listCache keeps the results of List for a short time. Unlike values, listings are only kept in memory, as they
+// have to be dropped whenever anything below their prefix changes.
+type listCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[listCacheKey]listCacheEntry
+}
+
+func newListCache(ttl time.Duration) *listCache {
+	return &listCache{ttl: ttl, entries: map[listCacheKey]listCacheEntry{}}
+}
+
+// get returns a copy of the cached listing for prefix, if there is one that didn't expire yet. An expired one is
+// dropped.
+func (lc *listCache) get(prefix string, recursive bool) ([]string, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	k := listCacheKey{prefix, recursive}
+	e, ok := lc.entries[k]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(lc.entries, k)
+		return nil, false
+	}
+	return append([]string(nil), e.keys...), true
+}
+
+// set caches the listing for prefix and drops the expired ones, so that prefixes listed only once don't pile up.
+func (lc *listCache) set(prefix string, recursive bool, keys []string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	now := time.Now()
+	for k, e := range lc.entries {
+		if now.After(e.expires) {
+			delete(lc.entries, k)
+		}
+	}
+	lc.entries[listCacheKey{prefix, recursive}] = listCacheEntry{
+		keys:    append([]string(nil), keys...),
+		expires: now.Add(lc.ttl),
+	}
+}
+
+// invalidate drops all listings key may be part of.
+func (lc *listCache) invalidate(key string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for k := range lc.entries {
+		if strings.HasPrefix(key, k.prefix) {
+			delete(lc.entries, k)
+		}
+	}
+}
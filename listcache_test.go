@@ -0,0 +1,79 @@
+package badgers3
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListCache(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ListCacheTTL: time.Hour, SortedList: true})
+	ctx := context.Background()
+	f.put("test/list/a", []byte("a"))
+	f.put("test/other/b", []byte("b"))
+
+	listings := func() int { return len(f.recorded(http.MethodGet, "")) }
+	list := func(prefix string, want int) {
+		t.Helper()
+		keys, err := gs.List(ctx, prefix, true)
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		if len(keys) != want {
+			t.Errorf("expected %d keys below %s, got %v", want, prefix, keys)
+		}
+	}
+
+	list("list/", 1)
+	list("other/", 1)
+	before := listings()
+	list("list/", 1)
+	if n := listings(); n != before {
+		t.Errorf("cached listing went to S3 %d times", n-before)
+	}
+
+	// Only listings containing the stored key are dropped
+	if err := gs.Store(ctx, "list/c", []byte("c")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	list("other/", 1)
+	if n := listings(); n != before {
+		t.Error("unrelated listing was invalidated")
+	}
+	list("list/", 2)
+	if n := listings(); n != before+1 {
+		t.Error("listing was not invalidated by Store")
+	}
+
+	if err := gs.Delete(ctx, "list/c"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	list("list/", 1)
+}
+
+func TestListCacheExpires(t *testing.T) {
+	lc := newListCache(50 * time.Millisecond)
+	lc.set("a/", true, []string{"a/b"})
+	if keys, ok := lc.get("a/", true); !ok || len(keys) != 1 {
+		t.Fatalf("expected the cached listing, got %v, %v", keys, ok)
+	}
+	if _, ok := lc.get("a/", false); ok {
+		t.Error("recursive listing was returned for a non-recursive one")
+	}
+	lc.set("b/", true, []string{"b/c"})
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := lc.get("a/", true); ok {
+		t.Error("expired listing was returned")
+	}
+	if _, ok := lc.entries[listCacheKey{"a/", true}]; ok {
+		t.Error("expired listing was kept after get")
+	}
+
+	// Expired listings that are never read again are dropped by the next set
+	lc.set("c/", true, []string{"c/d"})
+	if _, ok := lc.entries[listCacheKey{"b/", true}]; ok || len(lc.entries) != 1 {
+		t.Errorf("expected only the new listing to be kept, got %v", lc.entries)
+	}
+}
@@ -0,0 +1,351 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// The package defaults of the lock timing, used by storages created without the S3Opts field of the same name.
+var (
+	// LockExpiration is the age after which a lock file that was not renewed is considered stale.
+	//
+	// Deprecated: Set S3Opts.LockExpiration instead.
+	LockExpiration = 2 * time.Minute
+	// LockPollInterval is the time between two attempts to acquire a held lock.
+	//
+	// Deprecated: Set S3Opts.LockPollInterval instead.
+	LockPollInterval = 1 * time.Second
+	// LockTimeout is the time after which acquiring a lock is given up, zero waits until the context is done.
+	//
+	// Deprecated: Set S3Opts.LockTimeout instead.
+	LockTimeout = 15 * time.Second
+)
+
+// ErrLockNotAcquired is returned when a lock is still held by someone else after LockTimeout.
+var ErrLockNotAcquired = errors.New("acquiring lock failed")
+
+// LockInfo is the content of a lock file.
+type LockInfo struct {
+	// Updated is the time the lock was acquired or last renewed at
+	Updated time.Time
+	// Owner identifies the holder of the lock, it is empty for lock files written by older versions
+	Owner string
+}
+
+// LockCodec serializes the content of lock files, e.g. to share locks with another storage backend using the
+// same bucket. Decode must fail for content it doesn't understand, such lock files are considered stale.
+type LockCodec interface {
+	Encode(LockInfo) []byte
+	Decode([]byte) (LockInfo, error)
+}
+
+// TextLockCodec is the default LockCodec, it writes the time in RFC 3339 format and the owner on a second line.
+type TextLockCodec struct{}
+
+func (TextLockCodec) Encode(li LockInfo) []byte {
+	return []byte(li.Updated.Format(time.RFC3339Nano) + "\n" + li.Owner)
+}
+
+func (TextLockCodec) Decode(buf []byte) (LockInfo, error) {
+	updated, owner, _ := strings.Cut(string(buf), "\n")
+	t, err := time.Parse(time.RFC3339, updated)
+	return LockInfo{Updated: t, Owner: owner}, err
+}
+
+func (li LockInfo) expired(expiration time.Duration) bool {
+	return li.Updated.Add(expiration).Before(time.Now())
+}
+
+// newLockOwner returns a random token identifying a single lock acquisition.
+func newLockOwner() string {
+	var buf [16]byte
+	_, _ = io.ReadFull(rand.Reader, buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// Lock acquires the lock for key, blocking until it is free, ctx is done or LockTimeout passed.
+// This is the contract of certmagic.Locker, a nil error always means the lock is held by the caller.
+// The lock is renewed in the background like a Lease until Unlock is called, so that operations taking longer
+// than LockExpiration don't lose it.
+func (gs *S3Storage) Lock(ctx context.Context, key string) (err error) {
+	ctx, op := gs.startOp(ctx, "Lock", key)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	owner, err := gs.acquireLock(gs.withRetryBudget(ctx), key)
+	if err != nil {
+		return err
+	}
+	// Close stops the leases it finds in locks, one stored after it did would be renewed forever
+	gs.bgMu.Lock()
+	if err := gs.checkClosed(); err != nil {
+		gs.bgMu.Unlock()
+		_ = gs.s3client.RemoveObject(ctx, gs.bucket, gs.objLockName(key), minio.RemoveObjectOptions{})
+		return err
+	}
+	// Locking again without Unlock, e.g. after the lock was lost, replaces the previous lease
+	prev, ok := gs.locks.Swap(key, gs.newLease(key, owner))
+	gs.bgMu.Unlock()
+	if ok {
+		prev.(*Lease).stopRenewing()
+	}
+	return nil
+}
+
+// acquireLock waits until the lock for key is free or stale, takes it and returns the owner token written to it.
+func (gs *S3Storage) acquireLock(ctx context.Context, key string) (string, error) {
+	var (
+		owner     = newLockOwner()
+		startedAt = time.Now()
+		readErr   error
+	)
+
+	for {
+		if err := gs.checkCircuit(); err != nil {
+			return "", err
+		}
+		li, etag, err := gs.readLock(ctx, key)
+		if errors.Is(err, ErrRetryBudgetExhausted) {
+			return "", err
+		}
+		readErr = nil
+		switch {
+		case errors.Is(err, fs.ErrNotExist), errors.Is(err, errInvalidLock), err == nil && li.expired(gs.lockExpiration):
+			// Nobody holds the lock, the lock file does not make sense or it expired, take it
+			stolen := err == nil
+			taken, err := gs.takeLock(ctx, key, owner, etag)
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if err != nil {
+				return "", err
+			}
+			if taken {
+				if stolen && gs.onLockStolen != nil {
+					gs.onLockStolen(key, li.Owner)
+				}
+				return owner, nil
+			}
+		case err != nil:
+			readErr = err
+		}
+
+		// The lock is held or could not be read, try again later
+		if gs.lockTimeout > 0 && startedAt.Add(gs.lockTimeout).Before(time.Now()) {
+			if readErr != nil {
+				return "", fmt.Errorf("%w, reading lock file failed: %v", ErrLockNotAcquired, readErr)
+			}
+			return "", ErrLockNotAcquired
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(gs.lockPollInterval):
+		}
+	}
+}
+
+// takeLock writes the lock file for key and reads it back to check who holds the lock. The write is conditional:
+// it only creates the lock file if there is none, or replaces the one with the given ETag, so that out of two
+// acquirers racing for the lock only one can write it. Providers without conditional writes ignore the condition,
+// there the one that wrote last wins and the other one keeps waiting.
+func (gs *S3Storage) takeLock(ctx context.Context, key, owner, etag string) (bool, error) {
+	cond := http.Header{"If-None-Match": {"*"}}
+	if etag != "" {
+		cond = http.Header{"If-Match": {`"` + etag + `"`}}
+	}
+	err := gs.putLockFile(WithExtraHeaders(ctx, cond), key, owner)
+	if code := minio.ToErrorResponse(err).StatusCode; err != nil && code != http.StatusPreconditionFailed && code != http.StatusConflict {
+		return false, err
+	}
+	// Even if the condition failed, a retry of a write that went through may be what failed it
+	li, _, err := gs.readLock(ctx, key)
+	return err == nil && li.Owner == owner, nil
+}
+
+var errInvalidLock = errors.New("invalid lock file")
+
+// readLock returns the content of the lock file for key and its ETag, fs.ErrNotExist if there is none. The ETag is
+// also returned for lock files that can't be decoded.
+func (gs *S3Storage) readLock(ctx context.Context, key string) (LockInfo, string, error) {
+	buf, oi, err := gs.readObject(ctx, gs.objLockName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return LockInfo{}, "", err
+	}
+
+	li, err := gs.lockCodec.Decode(buf)
+	if err != nil {
+		return li, oi.ETag, errInvalidLock
+	}
+	return li, oi.ETag, nil
+}
+
+func (gs *S3Storage) putLockFile(ctx context.Context, key, owner string) error {
+	r := bytes.NewReader(gs.lockCodec.Encode(LockInfo{Updated: time.Now(), Owner: owner}))
+	_, err := gs.s3client.PutObject(ctx, gs.bucket, gs.objLockName(key), r, int64(r.Len()), minio.PutObjectOptions{ServerSideEncryption: gs.sse})
+	return err
+}
+
+// Unlock releases the lock for key taken through Lock. It is a no-op for locks that were never acquired by this
+// storage or are already gone, and a lock that was taken over by someone else after it went stale is left alone.
+func (gs *S3Storage) Unlock(ctx context.Context, key string) (err error) {
+	ctx, op := gs.startOp(ctx, "Unlock", key)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	v, ok := gs.locks.LoadAndDelete(key)
+	if !ok {
+		return nil
+	}
+	l := v.(*Lease)
+	if err := gs.checkCircuit(); err != nil {
+		gs.locks.Store(key, l)
+		return err
+	}
+	l.stopRenewing()
+
+	li, _, err := gs.readLock(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err == nil && li.Owner != l.owner {
+		gs.logger.Warn("Lock was taken over by someone else while held, leaving it alone", "lock", gs.objLockName(key))
+		return nil
+	}
+	return gs.s3client.RemoveObject(ctx, gs.bucket, gs.objLockName(key), minio.RemoveObjectOptions{})
+}
+
+// Lease is a held lock that is renewed in the background until it is released.
+type Lease struct {
+	gs    *S3Storage
+	key   string
+	owner string
+
+	lost chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// LockLease acquires the lock for key like Lock does, but keeps renewing it every LockExpiration/2 so that it
+// never goes stale while held. The lease must be released with Release.
+func (gs *S3Storage) LockLease(ctx context.Context, key string) (_ *Lease, err error) {
+	ctx, op := gs.startOp(ctx, "LockLease", key)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return nil, err
+	}
+	owner, err := gs.acquireLock(gs.withRetryBudget(ctx), key)
+	if err != nil {
+		return nil, err
+	}
+	return gs.newLease(key, owner), nil
+}
+
+// newLease starts renewing the lock for key that was just acquired by owner.
+func (gs *S3Storage) newLease(key, owner string) *Lease {
+	l := &Lease{
+		gs:    gs,
+		key:   key,
+		owner: owner,
+		lost:  make(chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go l.renew()
+	return l
+}
+
+// Lost returns a channel that is closed when the lease could not be renewed, e.g. because the lock was
+// removed or taken over by someone else. The lock must no longer be considered held once that happens.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release stops renewing the lease and removes the lock, unless it was lost in the meantime.
+func (l *Lease) Release() error {
+	l.stopRenewing()
+
+	select {
+	case <-l.lost:
+		return nil
+	default:
+	}
+
+	// Without a LockTimeout, releasing is bounded by the lock going stale anyway
+	timeout := l.gs.lockTimeout
+	if timeout <= 0 {
+		timeout = l.gs.lockExpiration
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	li, _, err := l.gs.readLock(ctx, l.key)
+	if err != nil || li.Owner != l.owner {
+		// Gone or not ours anymore, nothing to release
+		return nil
+	}
+	return l.gs.s3client.RemoveObject(ctx, l.gs.bucket, l.gs.objLockName(l.key), minio.RemoveObjectOptions{})
+}
+
+// stopRenewing stops the background renewal and waits for it to finish.
+func (l *Lease) stopRenewing() {
+	l.once.Do(func() { close(l.stop) })
+	<-l.done
+}
+
+func (l *Lease) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.gs.lockExpiration / 2)
+	defer ticker.Stop()
+	renewedAt := time.Now()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.gs.lockExpiration/2)
+		li, etag, err := l.gs.readLock(ctx, l.key)
+		lost := false
+		switch {
+		case err == nil && li.Owner == l.owner:
+			// Only replace the lock file that was read, someone may have taken over the lock in the meantime
+			err = l.gs.putLockFile(WithExtraHeaders(ctx, http.Header{"If-Match": {`"` + etag + `"`}}), l.key, l.owner)
+			code := minio.ToErrorResponse(err).StatusCode
+			lost = err != nil && (code == http.StatusPreconditionFailed || code == http.StatusConflict)
+		case err == nil, errors.Is(err, fs.ErrNotExist), errors.Is(err, errInvalidLock):
+			// Someone removed or took over the lock
+			lost = true
+		}
+		cancel()
+		if lost {
+			close(l.lost)
+			return
+		}
+
+		if err == nil {
+			renewedAt = time.Now()
+		} else if renewedAt.Add(l.gs.lockExpiration).Before(time.Now()) {
+			// Renewal kept failing until the lock went stale, others may take it now
+			close(l.lost)
+			return
+		}
+	}
+}
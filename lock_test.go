@@ -0,0 +1,591 @@
+package badgers3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setLockTiming overrides the lock timing for the duration of the test.
+func setLockTiming(t *testing.T, expiration, pollInterval, timeout time.Duration) {
+	prevExpiration, prevPollInterval, prevTimeout := LockExpiration, LockPollInterval, LockTimeout
+	LockExpiration, LockPollInterval, LockTimeout = expiration, pollInterval, timeout
+	t.Cleanup(func() {
+		LockExpiration, LockPollInterval, LockTimeout = prevExpiration, prevPollInterval, prevTimeout
+	})
+}
+
+func TestLockTimingPerStorage(t *testing.T) {
+	f := newFakeS3(t)
+	fast := newTestStorage(t, f, S3Opts{LockPollInterval: 10 * time.Millisecond, LockTimeout: 300 * time.Millisecond})
+	slow := newTestStorage(t, f, S3Opts{LockPollInterval: 100 * time.Millisecond, LockTimeout: 300 * time.Millisecond})
+	held := TextLockCodec{}.Encode(LockInfo{Updated: time.Now(), Owner: "someone-else"})
+	f.put("test/timing/fast.lock", held)
+	f.put("test/timing/slow.lock", held)
+
+	var wg sync.WaitGroup
+	for key, gs := range map[string]*S3Storage{"timing/fast": fast, "timing/slow": slow} {
+		wg.Add(1)
+		go func(key string, gs *S3Storage) {
+			defer wg.Done()
+			if err := gs.Lock(context.Background(), key); !errors.Is(err, ErrLockNotAcquired) {
+				t.Errorf("%s: expected the held lock to time out, got %v", key, err)
+			}
+		}(key, gs)
+	}
+	wg.Wait()
+
+	fastReads := len(f.recorded(http.MethodGet, "test/timing/fast.lock"))
+	slowReads := len(f.recorded(http.MethodGet, "test/timing/slow.lock"))
+	if slowReads > 5 || fastReads < 2*slowReads {
+		t.Errorf("expected each storage to poll at its own interval, got %d fast and %d slow reads", fastReads, slowReads)
+	}
+}
+
+func TestLeaseRenews(t *testing.T) {
+	setLockTiming(t, 300*time.Millisecond, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	lease, err := gs.LockLease(ctx, "lease/cert")
+	if err != nil {
+		t.Fatalf("acquiring lease failed: %v", err)
+	}
+
+	// Well past LockExpiration the lock must still be held
+	time.Sleep(time.Second)
+	if err := gs.Lock(ctx, "lease/cert"); !errors.Is(err, ErrLockNotAcquired) {
+		t.Fatalf("expected the renewed lock to be held, got %v", err)
+	}
+	select {
+	case <-lease.Lost():
+		t.Fatal("lease was lost while renewing")
+	default:
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatalf("releasing lease failed: %v", err)
+	}
+	if _, ok := f.get("test/lease/cert.lock"); ok {
+		t.Error("lock file still exists after release")
+	}
+}
+
+func TestLockRenews(t *testing.T) {
+	setLockTiming(t, 300*time.Millisecond, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	holder := newTestStorage(t, f, S3Opts{})
+	other := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	if err := holder.Lock(ctx, "renew/cert"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	// Well past LockTimeout and LockExpiration the lock must not be stolen
+	time.Sleep(time.Second)
+	if err := other.Lock(ctx, "renew/cert"); !errors.Is(err, ErrLockNotAcquired) {
+		t.Fatalf("expected the renewed lock to be held, got %v", err)
+	}
+
+	if err := holder.Unlock(ctx, "renew/cert"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if err := other.Lock(ctx, "renew/cert"); err != nil {
+		t.Fatalf("lock after unlock failed: %v", err)
+	}
+	// No renewal of the released lock must overwrite the new holder's lock file
+	time.Sleep(400 * time.Millisecond)
+	if err := other.Unlock(ctx, "renew/cert"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if _, ok := f.get("test/renew/cert.lock"); ok {
+		t.Error("lock file still exists after unlock")
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	setLockTiming(t, 300*time.Millisecond, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	lease, err := gs.LockLease(context.Background(), "lease/cert")
+	if err != nil {
+		t.Fatalf("acquiring lease failed: %v", err)
+	}
+	f.remove("test/lease/cert.lock")
+
+	select {
+	case <-lease.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("lease was not reported lost after its lock was removed")
+	}
+	if err := lease.Release(); err != nil {
+		t.Errorf("releasing a lost lease failed: %v", err)
+	}
+}
+
+func TestLeaseLostDuringRenewal(t *testing.T) {
+	setLockTiming(t, 300*time.Millisecond, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	lease, err := gs.LockLease(context.Background(), "lease/cert")
+	if err != nil {
+		t.Fatalf("acquiring lease failed: %v", err)
+	}
+	// Someone takes over the lock right after the renewal read it
+	foreign := TextLockCodec{}.Encode(LockInfo{Updated: time.Now(), Owner: "someone-else"})
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodPut && key == "test/lease/cert.lock" {
+			f.put(key, foreign)
+		}
+		return false
+	})
+
+	select {
+	case <-lease.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("lease was not reported lost after its lock was taken over")
+	}
+	if obj, ok := f.get("test/lease/cert.lock"); !ok || string(obj.data) != string(foreign) {
+		t.Error("renewal overwrote the lock of the new holder")
+	}
+}
+
+func TestLockSerializes(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 0)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	other := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	// A cached value must not make Lock succeed without taking the lock
+	gs.cache.setCacheEntry(context.Background(), []byte("locker/cert"), []byte("cert"), time.Hour)
+	if err := gs.Lock(ctx, "locker/cert"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if _, ok := f.get("test/locker/cert.lock"); !ok {
+		t.Fatal("lock file was not written")
+	}
+
+	acquired := make(chan time.Time)
+	go func() {
+		if err := other.Lock(ctx, "locker/cert"); err != nil {
+			t.Errorf("competing lock failed: %v", err)
+		}
+		acquired <- time.Now()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	unlockedAt := time.Now()
+	if err := gs.Unlock(ctx, "locker/cert"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if at := <-acquired; at.Before(unlockedAt) {
+		t.Fatal("competing acquirer got the lock while it was held")
+	}
+
+	// The first holder must not release a lock it no longer holds
+	if err := gs.Unlock(ctx, "locker/cert"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if _, ok := f.get("test/locker/cert.lock"); !ok {
+		t.Fatal("lock of the competing acquirer was removed")
+	}
+	if err := other.Unlock(ctx, "locker/cert"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if _, ok := f.get("test/locker/cert.lock"); ok {
+		t.Error("lock file still exists after unlock")
+	}
+
+	// Blocking acquisition gives up once the context is done
+	_ = gs.Lock(ctx, "locker/cert")
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := other.Lock(cctx, "locker/cert"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+}
+
+func TestLockRace(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 150*time.Millisecond)
+	f := newFakeS3(t)
+	racers := []*S3Storage{
+		newTestStorage(t, f, S3Opts{}),
+		newTestStorage(t, f, S3Opts{ExtraHeaders: http.Header{"X-Racer": {"slow"}}}),
+	}
+	// The slow racer writes the lock only after the other one wrote and read it back, which is when a plain
+	// write would take the lock away from it
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodPut && r.Header.Get("X-Racer") == "slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("race/%d", i)
+		if i%2 == 1 {
+			// Racing to take over an expired lock
+			f.put("test/"+key+".lock", TextLockCodec{}.Encode(LockInfo{Updated: time.Now().Add(-2 * time.Minute), Owner: "crashed"}))
+		}
+
+		var (
+			wg      sync.WaitGroup
+			start   = make(chan struct{})
+			winners int32
+		)
+		for _, gs := range racers {
+			wg.Add(1)
+			go func(gs *S3Storage) {
+				defer wg.Done()
+				<-start
+				err := gs.Lock(ctx, key)
+				switch {
+				case err == nil:
+					atomic.AddInt32(&winners, 1)
+				case !errors.Is(err, ErrLockNotAcquired):
+					t.Errorf("%s: lock failed: %v", key, err)
+				}
+			}(gs)
+		}
+		close(start)
+		wg.Wait()
+
+		if winners != 1 {
+			t.Errorf("%s: expected exactly one racer to get the lock, %d did", key, winners)
+		}
+	}
+}
+
+func TestLockPreconditionFailed(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, time.Second)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	foreign := TextLockCodec{}.Encode(LockInfo{Updated: time.Now(), Owner: "someone-else"})
+
+	// Someone else creates the lock right before our first write lands, and releases it a bit later
+	var once sync.Once
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		handled := false
+		if r.Method == http.MethodPut && key == "test/cond.lock" {
+			once.Do(func() {
+				f.put(key, foreign)
+				writeFakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+				handled = true
+				time.AfterFunc(100*time.Millisecond, func() { f.remove(key) })
+			})
+		}
+		return handled
+	})
+
+	if err := gs.Lock(context.Background(), "cond"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	puts := f.recorded(http.MethodPut, "test/cond.lock")
+	if len(puts) < 2 {
+		t.Fatalf("expected the lock to be written again after the precondition failed, got %d writes", len(puts))
+	}
+	for _, req := range puts {
+		if req.Header.Get("If-None-Match") != "*" {
+			t.Errorf("lock was written without If-None-Match: %v", req.Header)
+		}
+	}
+	if obj, ok := f.get("test/cond.lock"); !ok || string(obj.data) == string(foreign) {
+		t.Error("lock file was not written after the other lock was released")
+	}
+}
+
+func TestLockReadFailures(t *testing.T) {
+	setLockTiming(t, time.Minute, 50*time.Millisecond, 300*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodGet && key == "test/failing.lock" {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	})
+
+	err := gs.Lock(context.Background(), "failing")
+	if !errors.Is(err, ErrLockNotAcquired) || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("expected ErrLockNotAcquired with the read error, got %v", err)
+	}
+	// One read per LockPollInterval, not a tight loop
+	if reads := len(f.recorded(http.MethodGet, "test/failing.lock")); reads > 10 {
+		t.Errorf("expected the failing reads to back off, got %d of them", reads)
+	}
+	if len(f.recorded(http.MethodPut, "test/failing.lock")) != 0 {
+		t.Error("lock was written although it could not be read")
+	}
+}
+
+func TestLockCancel(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 10*time.Second)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	// The lock write hangs until the client gives up on it
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodPut && key == "test/cancel.lock" {
+			_, _ = io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return true
+		}
+		return false
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := gs.Lock(ctx, "cancel"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Lock took %v to return after the context was cancelled", elapsed)
+	}
+}
+
+func TestReleaseWithoutLockTimeout(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{LockTimeout: -1})
+	l, err := gs.LockLease(context.Background(), "release/untimed")
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := l.Release(); err != nil {
+		t.Errorf("release failed: %v", err)
+	}
+	if _, ok := f.get("test/release/untimed.lock"); ok {
+		t.Error("lock was not removed")
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	// Never locked
+	if err := gs.Unlock(ctx, "unlock/none"); err != nil {
+		t.Errorf("unlocking a key that was never locked failed: %v", err)
+	}
+
+	// Own lock
+	if err := gs.Lock(ctx, "unlock/own"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := gs.Unlock(ctx, "unlock/own"); err != nil {
+		t.Errorf("unlock failed: %v", err)
+	}
+	if _, ok := f.get("test/unlock/own.lock"); ok {
+		t.Error("own lock was not removed")
+	}
+	if err := gs.Unlock(ctx, "unlock/own"); err != nil {
+		t.Errorf("unlocking twice failed: %v", err)
+	}
+
+	// Taken over by someone else, e.g. after it went stale
+	if err := gs.Lock(ctx, "unlock/foreign"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	foreign := TextLockCodec{}.Encode(LockInfo{Updated: time.Now(), Owner: "someone-else"})
+	f.put("test/unlock/foreign.lock", foreign)
+	if err := gs.Unlock(ctx, "unlock/foreign"); err != nil {
+		t.Errorf("unlock failed: %v", err)
+	}
+	if obj, ok := f.get("test/unlock/foreign.lock"); !ok || string(obj.data) != string(foreign) {
+		t.Error("foreign lock was touched")
+	}
+}
+
+func TestUnlockAfterTakeover(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	a := newTestStorage(t, f, S3Opts{})
+	b := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	if err := a.Lock(ctx, "takeover/cert"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	// A's lock goes stale, e.g. because A was paused, and B takes it over
+	obj, _ := f.get("test/takeover/cert.lock")
+	li, err := TextLockCodec{}.Decode(obj.data)
+	if err != nil {
+		t.Fatalf("decoding lock file failed: %v", err)
+	}
+	li.Updated = time.Now().Add(-2 * time.Minute)
+	f.put("test/takeover/cert.lock", TextLockCodec{}.Encode(li))
+	if err := b.Lock(ctx, "takeover/cert"); err != nil {
+		t.Fatalf("taking over the expired lock failed: %v", err)
+	}
+
+	if err := a.Unlock(ctx, "takeover/cert"); err != nil {
+		t.Errorf("unlock failed: %v", err)
+	}
+	if len(f.recorded(http.MethodDelete, "test/takeover/cert.lock")) != 0 {
+		t.Error("unlock removed the lock of the new holder")
+	}
+	// B still holds the lock
+	if err := a.Lock(ctx, "takeover/cert"); !errors.Is(err, ErrLockNotAcquired) {
+		t.Errorf("expected the lock to be held by B, got %v", err)
+	}
+}
+
+func TestOnLockStolen(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	var stolen []string
+	gs := newTestStorage(t, f, S3Opts{
+		OnLockStolen: func(key, previousOwner string) { stolen = append(stolen, key+" "+previousOwner) },
+	})
+	ctx := context.Background()
+
+	// A free lock is not stolen
+	if err := gs.Lock(ctx, "stolen/free"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	f.put("test/stolen/cert.lock", TextLockCodec{}.Encode(LockInfo{Updated: time.Now().Add(-2 * time.Minute), Owner: "crashed"}))
+	if err := gs.Lock(ctx, "stolen/cert"); err != nil {
+		t.Fatalf("reclaiming the expired lock failed: %v", err)
+	}
+	if len(stolen) != 1 || stolen[0] != "stolen/cert crashed" {
+		t.Errorf("expected one stolen lock of crashed, got %q", stolen)
+	}
+}
+
+// jsonLockCodec writes lock files the way some other backends do.
+type jsonLockCodec struct{}
+
+func (jsonLockCodec) Encode(li LockInfo) []byte {
+	buf, _ := json.Marshal(li)
+	return buf
+}
+
+func (jsonLockCodec) Decode(buf []byte) (LockInfo, error) {
+	var li LockInfo
+	err := json.Unmarshal(buf, &li)
+	return li, err
+}
+
+func TestLockCodec(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{LockCodec: jsonLockCodec{}})
+	ctx := context.Background()
+
+	if err := gs.Lock(ctx, "codec/cert"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	obj, ok := f.get("test/codec/cert.lock")
+	if !ok {
+		t.Fatal("lock file missing")
+	}
+	li, err := jsonLockCodec{}.Decode(obj.data)
+	if err != nil || li.Owner == "" || time.Since(li.Updated) > time.Minute {
+		t.Fatalf("lock file not written with the codec: %q, %v", obj.data, err)
+	}
+
+	// The lock file is understood, so the lock is held
+	if err := gs.Lock(ctx, "codec/cert"); !errors.Is(err, ErrLockNotAcquired) {
+		t.Errorf("expected the lock to be held, got %v", err)
+	}
+	if err := gs.Unlock(ctx, "codec/cert"); err != nil {
+		t.Errorf("unlock failed: %v", err)
+	}
+	if _, ok := f.get("test/codec/cert.lock"); ok {
+		t.Error("lock file was not removed")
+	}
+}
+
+func TestLockAgainReplacesLease(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	if err := gs.Lock(ctx, "again/cert"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	v, _ := gs.locks.Load("again/cert")
+	first := v.(*Lease)
+
+	// The lock file is gone, so locking again succeeds without an Unlock in between
+	f.remove("test/again/cert.lock")
+	if err := gs.Lock(ctx, "again/cert"); err != nil {
+		t.Fatalf("locking again failed: %v", err)
+	}
+	select {
+	case <-first.done:
+	case <-time.After(time.Second):
+		t.Fatal("the replaced lease is still renewing")
+	}
+
+	if err := gs.Unlock(ctx, "again/cert"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if _, ok := f.get("test/again/cert.lock"); ok {
+		t.Error("lock file still exists after unlock")
+	}
+}
+
+func TestUnlockAfterClose(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	if err := gs.Lock(ctx, "closed/cert"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := gs.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if err := gs.Unlock(ctx, "closed/cert"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, ok := gs.locks.Load("closed/cert"); !ok {
+		t.Error("the lease was dropped by the failed unlock")
+	}
+}
+
+func TestLockDuringClose(t *testing.T) {
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 100*time.Millisecond)
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	// The storage is closed while the lock file is written
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodPut && key == "test/closing/cert.lock" {
+			_ = gs.Close()
+		}
+		return false
+	})
+	if err := gs.Lock(context.Background(), "closing/cert"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, ok := gs.locks.Load("closing/cert"); ok {
+		t.Error("a lease was stored after Close")
+	}
+	if _, ok := f.get("test/closing/cert.lock"); ok {
+		t.Error("the lock file was left behind")
+	}
+}
@@ -0,0 +1,91 @@
+package badgers3
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// recordingHandler keeps the records logged through it.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+// find returns the level and attributes of the last record with msg whose attributes include match.
+func (h *recordingHandler) find(msg string, match map[string]string) (slog.Level, map[string]slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.records) - 1; i >= 0; i-- {
+		r := h.records[i]
+		if r.Message != msg {
+			continue
+		}
+		attrs := map[string]slog.Value{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		matches := true
+		for k, v := range match {
+			if attrs[k].String() != v {
+				matches = false
+			}
+		}
+		if matches {
+			return r.Level, attrs, true
+		}
+	}
+	return 0, nil, false
+}
+
+func TestLogger(t *testing.T) {
+	f := newFakeS3(t)
+	h := &recordingHandler{}
+	gs := newTestStorage(t, f, S3Opts{Logger: slog.New(h), CachePolicy: CacheTrustCache})
+	ctx := context.Background()
+	if _, _, ok := h.find("Clear text certificate storage active", nil); !ok {
+		t.Error("startup message was not logged")
+	}
+
+	f.put("test/logged/cert", []byte("cert"))
+	for _, want := range []bool{false, true} {
+		if _, err := gs.Load(ctx, "logged/cert"); err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+		level, attrs, ok := h.find("Storage operation", map[string]string{"op": "Load", "key": "logged/cert"})
+		if !ok {
+			t.Fatal("Load was not logged")
+		}
+		if level != slog.LevelDebug || attrs["cache_hit"].Kind() != slog.KindBool || attrs["cache_hit"].Bool() != want {
+			t.Errorf("expected a debug record with cache_hit=%v, got %v %v", want, level, attrs)
+		}
+		if attrs["duration"].Kind() != slog.KindDuration {
+			t.Errorf("expected a duration, got %v", attrs)
+		}
+	}
+
+	// A missing key is no reason for a warning, other failures are
+	_, _ = gs.Load(ctx, "logged/missing")
+	if level, attrs, ok := h.find("Storage operation", map[string]string{"key": "logged/missing"}); !ok || level != slog.LevelDebug || attrs["error"].Any() == nil {
+		t.Errorf("expected a debug record with the error, got %v %v", level, attrs)
+	}
+	f.put("test/logged/empty", nil)
+	_, _ = gs.Load(ctx, "logged/empty")
+	if level, _, ok := h.find("Object is empty", map[string]string{"object": "test/logged/empty"}); !ok || level != slog.LevelWarn {
+		t.Errorf("expected a warning for the empty object, got %v", level)
+	}
+}
@@ -0,0 +1,54 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// Metrics receives the duration and outcome of storage operations, e.g. to export them to Prometheus with the
+// adapter in the prometheus subpackage. Implementations must be safe for concurrent use and return quickly, they
+// are called on every operation.
+type Metrics interface {
+	// ObserveOp is called when an operation finished. op is the name of the S3Storage method, e.g. "Load", and err
+	// the error it returned. Exists never reports an error.
+	ObserveOp(op string, dur time.Duration, err error)
+}
+
+// noopMetrics is used when S3Opts.Metrics is not set
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveOp(string, time.Duration, error) {}
+
+// ErrorClass classifies an error returned by a storage operation for metrics: "not_found", "timeout", "canceled",
+// "retry_budget", "circuit_open", "lock_not_acquired", "closed", the S3 error code such as "AccessDenied", or
+// "other". It returns the empty string for nil.
+func ErrorClass(err error) string {
+	var s3Err minio.ErrorResponse
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, ErrRetryBudgetExhausted):
+		// Checked first, it also counts as context.Canceled
+		return "retry_budget"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, ErrLockNotAcquired):
+		return "lock_not_acquired"
+	case errors.Is(err, ErrClosed):
+		return "closed"
+	case errors.As(err, &s3Err) && s3Err.Code != "":
+		return s3Err.Code
+	default:
+		return "other"
+	}
+}
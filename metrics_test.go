@@ -0,0 +1,133 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// recordingMetrics records the operations reported to it as "op:class".
+type recordingMetrics struct {
+	mu  sync.Mutex
+	ops []string
+}
+
+func (m *recordingMetrics) ObserveOp(op string, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ops = append(m.ops, op+":"+ErrorClass(err))
+}
+
+func (m *recordingMetrics) take() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := m.ops
+	m.ops = nil
+	return ops
+}
+
+func TestMetrics(t *testing.T) {
+	f := newFakeS3(t)
+	m := &recordingMetrics{}
+	gs := newTestStorage(t, f, S3Opts{Metrics: m})
+	ctx := context.Background()
+
+	_ = gs.Store(ctx, "metrics/cert", []byte("cert"))
+	_, _ = gs.Load(ctx, "metrics/cert")
+	_, _ = gs.Load(ctx, "metrics/missing")
+	_, _ = gs.Stat(ctx, "metrics/cert")
+	_ = gs.Exists(ctx, "metrics/cert")
+	_, _ = gs.List(ctx, "metrics/", true)
+	_ = gs.Lock(ctx, "metrics/cert")
+	_ = gs.Unlock(ctx, "metrics/cert")
+	_ = gs.Delete(ctx, "metrics/cert")
+
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		writeFakeError(w, http.StatusForbidden, "AccessDenied")
+		return true
+	})
+	_ = gs.Store(ctx, "metrics/denied", []byte("value"))
+
+	want := []string{
+		"Store:", "Load:", "Load:not_found", "Stat:", "Exists:", "List:", "Lock:", "Unlock:", "Delete:",
+		"Store:AccessDenied",
+	}
+	if got := m.take(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Without a hook nothing breaks
+	f.setHook(nil)
+	plain := newTestStorage(t, f, S3Opts{})
+	if err := plain.Store(ctx, "metrics/plain", []byte("value")); err != nil {
+		t.Errorf("store without metrics failed: %v", err)
+	}
+}
+
+func TestMetricsAllOperations(t *testing.T) {
+	f := newFakeS3(t)
+	m := &recordingMetrics{}
+	gs := newTestStorage(t, f, S3Opts{Metrics: m})
+	ctx := context.Background()
+	f.put("test/metrics/cert", []byte("cert"))
+
+	_, _ = gs.StatFull(ctx, "metrics/cert")
+	keys, errs := gs.ListStream(ctx, "metrics/", true)
+	for range keys {
+	}
+	<-errs
+	_ = gs.DeletePrefix(ctx, "metrics/other/")
+	if lease, err := gs.LockLease(ctx, "metrics/lease"); err == nil {
+		_ = lease.Release()
+	}
+	_, _ = gs.BucketConfig(ctx)
+	_ = gs.HealthCheck(ctx)
+	_ = gs.VerifyKey(ctx, "metrics/cert")
+	_ = gs.SwitchEncryption(ctx, &CleartextIO{})
+	_ = gs.SwitchEncryptionWith(ctx, &CleartextIO{}, SwitchOptions{})
+	_, _ = gs.AuditEncryption(ctx)
+
+	want := []string{
+		"StatFull", "ListStream", "DeletePrefix", "LockLease", "BucketConfig", "HealthCheck", "VerifyKey",
+		"SwitchEncryption", "SwitchEncryptionWith", "AuditEncryption",
+	}
+	var got []string
+	for _, op := range m.take() {
+		got = append(got, op[:strings.Index(op, ":")])
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{fs.ErrNotExist, "not_found"},
+		{fmt.Errorf("loading failed: %w", fs.ErrNotExist), "not_found"},
+		{context.DeadlineExceeded, "timeout"},
+		{context.Canceled, "canceled"},
+		{retryBudgetError{}, "retry_budget"},
+		{ErrCircuitOpen, "circuit_open"},
+		{fmt.Errorf("%w, reading lock file failed: %v", ErrLockNotAcquired, "boom"), "lock_not_acquired"},
+		{ErrClosed, "closed"},
+		{minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}, "SlowDown"},
+		{fmt.Errorf("storing failed: %w", minio.ErrorResponse{Code: "AccessDenied"}), "AccessDenied"},
+		{errors.New("boom"), "other"},
+	} {
+		if got := ErrorClass(tc.err); got != tc.want {
+			t.Errorf("%v: expected %q, got %q", tc.err, tc.want, got)
+		}
+	}
+}
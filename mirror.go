@@ -0,0 +1,89 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// openMirrors creates the storages of opts.MirrorBuckets. They are closed along with gs.
+func (gs *S3Storage) openMirrors(opts S3Opts) error {
+	for _, mirrorOpts := range opts.MirrorBuckets {
+		// Reads are cached by this storage, whichever bucket they were served from
+		mirrorOpts.DisableCache = true
+		if mirrorOpts.Logger == nil {
+			mirrorOpts.Logger = opts.Logger
+		}
+		if mirrorOpts.Tracer == nil {
+			mirrorOpts.Tracer = opts.Tracer
+		}
+		m, err := NewS3Storage(mirrorOpts)
+		if err != nil {
+			return fmt.Errorf("creating storage for mirror bucket %s failed: %w", mirrorOpts.Bucket, err)
+		}
+		gs.mirrors = append(gs.mirrors, m)
+	}
+	return nil
+}
+
+// toMirrors repeats a write that returned err in this storage's bucket in every mirror. The result fails if any
+// of the buckets failed, so that a caller retries until all of them are in sync.
+func (gs *S3Storage) toMirrors(err error, write func(m *S3Storage) error) error {
+	if len(gs.mirrors) == 0 {
+		return err
+	}
+	errs := []error{err}
+	for _, m := range gs.mirrors {
+		if err := write(m); err != nil {
+			errs = append(errs, fmt.Errorf("mirror bucket %s: %w", m.bucket, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// loadFromMirrors reads key from the first mirror that has it, after reading it from this storage's bucket failed
+// with err. The object is cached and copied back to this storage's bucket in the background.
+func (gs *S3Storage) loadFromMirrors(ctx context.Context, key string, err error) ([]byte, error) {
+	for _, m := range gs.mirrors {
+		buf, mirrorErr := m.loadObject(ctx, key)
+		if mirrorErr != nil {
+			continue
+		}
+		gs.logger.Warn("Object was read from a mirror bucket", "key", key, "mirror", m.bucket)
+		// The ETag of the mirror's object doesn't describe ours, so this copy is never revalidated against it
+		gs.cacheValue(ctx, key, buf, "")
+		gs.repopulate(key, buf)
+		return buf, nil
+	}
+	return nil, err
+}
+
+// repopulate writes value, read from a mirror, to the object of key in the background, at most once at a time per
+// key. The object is only created if there is none, so that a Store that went through in the meantime wins.
+func (gs *S3Storage) repopulate(key string, value []byte) {
+	if _, running := gs.repopulating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	started := gs.background(func(ctx context.Context) {
+		defer gs.repopulating.Delete(key)
+		ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+		defer cancel()
+		info, err := gs.putObject(WithExtraHeaders(ctx, http.Header{"If-None-Match": {"*"}}), key, value)
+		if minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+			return
+		}
+		if err != nil {
+			// Still unavailable, the next Load falling back to a mirror tries again
+			gs.logger.Debug("Copying object back from a mirror bucket failed", "key", key, "error", err)
+			return
+		}
+		gs.invalidateListings(key)
+		gs.cacheValue(ctx, key, value, info.ETag)
+	})
+	if !started {
+		gs.repopulating.Delete(key)
+	}
+}
@@ -0,0 +1,135 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// newMirroredTestStorage creates a storage backed by primary that mirrors to mirror.
+func newMirroredTestStorage(t *testing.T, primary, mirror *fakeS3) *S3Storage {
+	t.Helper()
+	return newTestStorage(t, primary, S3Opts{MirrorBuckets: []S3Opts{{
+		Endpoint:        mirror.endpoint(),
+		Bucket:          mirror.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		ObjPrefix:       "test",
+	}}})
+}
+
+func TestMirrorWrites(t *testing.T) {
+	primary, mirror := newFakeS3(t), newFakeS3(t)
+	gs := newMirroredTestStorage(t, primary, mirror)
+	ctx := context.Background()
+
+	if err := gs.Store(ctx, "mirror/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	for name, f := range map[string]*fakeS3{"primary": primary, "mirror": mirror} {
+		if _, ok := f.get("test/mirror/cert"); !ok {
+			t.Errorf("object was not written to the %s bucket", name)
+		}
+	}
+	if err := gs.Delete(ctx, "mirror/cert"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	for name, f := range map[string]*fakeS3{"primary": primary, "mirror": mirror} {
+		if _, ok := f.get("test/mirror/cert"); ok {
+			t.Errorf("object was not deleted from the %s bucket", name)
+		}
+	}
+
+	for _, f := range []*fakeS3{primary, mirror} {
+		f.put("test/mirror/site/a", []byte("cert"))
+		f.put("test/mirror/site/b", []byte("cert"))
+	}
+	if err := gs.DeletePrefix(ctx, "mirror/site/"); err != nil {
+		t.Fatalf("deleting prefix failed: %v", err)
+	}
+	for name, f := range map[string]*fakeS3{"primary": primary, "mirror": mirror} {
+		for _, key := range []string{"test/mirror/site/a", "test/mirror/site/b"} {
+			if _, ok := f.get(key); ok {
+				t.Errorf("%s was not deleted from the %s bucket", key, name)
+			}
+		}
+	}
+
+	// A mirror that didn't take the write fails it, even though the primary bucket has it
+	mirror.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodPut {
+			writeFakeError(w, http.StatusForbidden, "AccessDenied")
+			return true
+		}
+		return false
+	})
+	if err := gs.Store(ctx, "mirror/denied", []byte("cert")); err == nil || !strings.Contains(err.Error(), "mirror bucket") {
+		t.Errorf("expected the mirror's error, got %v", err)
+	}
+	if _, ok := primary.get("test/mirror/denied"); !ok {
+		t.Error("object was not written to the primary bucket")
+	}
+}
+
+func TestMirrorFailover(t *testing.T) {
+	// One request per operation keeps the outage quick
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+
+	primary, mirror := newFakeS3(t), newFakeS3(t)
+	gs := newMirroredTestStorage(t, primary, mirror)
+	ctx := context.Background()
+
+	// The primary bucket is down, reads are served by the mirror
+	mirror.put("test/mirror/down", []byte("from mirror"))
+	primary.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		writeFakeError(w, http.StatusInternalServerError, "InternalError")
+		return true
+	})
+	if buf, err := gs.Load(ctx, "mirror/down"); err != nil || string(buf) != "from mirror" {
+		t.Fatalf("load with the primary bucket down failed: %q, %v", buf, err)
+	}
+	primary.setHook(nil)
+	if buf, err := gs.Load(ctx, "mirror/down"); err != nil || string(buf) != "from mirror" {
+		t.Errorf("load after the outage failed: %q, %v", buf, err)
+	}
+
+	// The primary bucket is missing the object, it is copied back from the mirror
+	mirror.put("test/mirror/missing", []byte("from mirror"))
+	if buf, err := gs.Load(ctx, "mirror/missing"); err != nil || string(buf) != "from mirror" {
+		t.Fatalf("load of an object only the mirror has failed: %q, %v", buf, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := primary.get("test/mirror/missing"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("object was not copied back to the primary bucket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if buf, err := gs.loadObject(ctx, "mirror/missing"); err != nil || string(buf) != "from mirror" {
+		t.Errorf("copied object can't be read: %q, %v", buf, err)
+	}
+
+	if _, err := gs.Load(ctx, "mirror/nowhere"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	// Nothing is copied back once the storage is closed
+	if err := gs.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	gs.repopulate("mirror/closed", []byte("from mirror"))
+	if _, running := gs.repopulating.Load("mirror/closed"); running {
+		t.Error("copying back was started after close")
+	}
+}
@@ -0,0 +1,76 @@
+// Package otel traces the operations of badger-s3 storages with OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	badgers3 "github.com/diamondcdn/badger-s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer obtained from the TracerProvider
+const instrumentationName = "github.com/diamondcdn/badger-s3"
+
+// NewTracer returns a badgers3.Tracer for S3Opts.Tracer that starts client spans named after the operation,
+// e.g. "badger-s3 Load", with the tracer provider tp.
+func NewTracer(tp trace.TracerProvider) badgers3.Tracer {
+	return tracer{tp.Tracer(instrumentationName)}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, op string) (context.Context, badgers3.Span) {
+	ctx, s := t.t.Start(ctx, "badger-s3 "+op, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, span{s}
+}
+
+type span struct {
+	s trace.Span
+}
+
+// SetAttribute records value with the matching attribute type. Durations are recorded as text like "1.5s", values
+// of other types as formatted by fmt.Sprint, so that no attribute is lost.
+func (s span) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case float64:
+		kv = attribute.Float64(key, v)
+	case time.Duration:
+		kv = attribute.String(key, v.String())
+	case []string:
+		kv = attribute.StringSlice(key, v)
+	case []bool:
+		kv = attribute.BoolSlice(key, v)
+	case []int64:
+		kv = attribute.Int64Slice(key, v)
+	case []int:
+		kv = attribute.IntSlice(key, v)
+	case []float64:
+		kv = attribute.Float64Slice(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	s.s.SetAttributes(kv)
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.s.RecordError(err)
+		s.s.SetStatus(codes.Error, err.Error())
+	}
+	s.s.End()
+}
@@ -0,0 +1,64 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	badgers3 "github.com/diamondcdn/badger-s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tr := NewTracer(tp)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "caller")
+	_, s := tr.Start(ctx, "Load")
+	s.SetAttribute(badgers3.AttrKey, "certs/example.com.crt")
+	s.SetAttribute(badgers3.AttrCacheHit, false)
+	s.SetAttribute(badgers3.AttrBytes, int64(42))
+	s.SetAttribute("test.int", 7)
+	s.SetAttribute("test.float", 0.5)
+	s.SetAttribute("test.duration", 1500*time.Millisecond)
+	s.SetAttribute("test.strings", []string{"a", "b"})
+	s.SetAttribute("test.other", struct{ N int }{3})
+	s.End(errors.New("boom"))
+	parent.End()
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	load := spans[0]
+	if load.Name() != "badger-s3 Load" || load.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected badger-s3 Load below the caller, got %s below %v", load.Name(), load.Parent().SpanID())
+	}
+	want := map[attribute.Key]attribute.Value{
+		badgers3.AttrKey:      attribute.StringValue("certs/example.com.crt"),
+		badgers3.AttrCacheHit: attribute.BoolValue(false),
+		badgers3.AttrBytes:    attribute.Int64Value(42),
+		"test.int":            attribute.IntValue(7),
+		"test.float":          attribute.Float64Value(0.5),
+		"test.duration":       attribute.StringValue("1.5s"),
+		"test.strings":        attribute.StringSliceValue([]string{"a", "b"}),
+		"test.other":          attribute.StringValue("{3}"),
+	}
+	for _, kv := range load.Attributes() {
+		if v, ok := want[kv.Key]; ok && v != kv.Value {
+			t.Errorf("%s: expected %v, got %v", kv.Key, v.Emit(), kv.Value.Emit())
+		}
+		delete(want, kv.Key)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing attributes %v", want)
+	}
+	if load.Status().Code != codes.Error || len(load.Events()) != 1 {
+		t.Errorf("expected the error to be recorded, got %v with %d events", load.Status(), len(load.Events()))
+	}
+}
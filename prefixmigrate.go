@@ -0,0 +1,108 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// checkPreviousPrefix looks for objects stored under prev while the prefix and the issuer prefixes are still empty,
+// which happens when ObjPrefix was changed. It warns about them or, if migrate is set, copies them to the prefix
+// their key belongs under.
+func (gs *S3Storage) checkPreviousPrefix(ctx context.Context, prev string, migrate bool) error {
+	prev = strings.Trim(prev, "/")
+	if prev == gs.prefix {
+		return nil
+	}
+	for _, prefix := range gs.objPrefixes() {
+		if found, err := gs.hasObjects(ctx, prefix); err != nil || found {
+			return err
+		}
+	}
+	if found, err := gs.hasObjects(ctx, prev); err != nil || !found {
+		return err
+	}
+
+	if !migrate {
+		gs.logger.Warn("Nothing is stored under the prefix yet, but there are objects under the previous prefix. "+
+			"They are not used unless they are migrated, see S3Opts.MigratePreviousPrefix",
+			"prefix", gs.prefix+"/", "previous_prefix", prev+"/")
+		return nil
+	}
+
+	gs.logger.Info("Copying objects from the previous prefix", "previous_prefix", prev+"/", "prefix", gs.prefix+"/")
+	n := 0
+	for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
+		Prefix:    prev + "/",
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		// Locks of the previous prefix don't mean anything under the new one
+		if strings.HasSuffix(obj.Key, ".lock") {
+			continue
+		}
+		dst := gs.objName(strings.TrimPrefix(obj.Key, prev+"/"))
+		if _, err := gs.s3client.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: gs.bucket, Object: dst, Encryption: gs.sse},
+			minio.CopySrcOptions{Bucket: gs.bucket, Object: obj.Key, Encryption: encrypt.SSE(gs.sse)},
+		); err != nil {
+			return fmt.Errorf("copying %s to %s failed: %w", obj.Key, dst, err)
+		}
+		n++
+	}
+	gs.logger.Info("Copied objects from the previous prefix", "objects", n, "previous_prefix", prev+"/", "prefix", gs.prefix+"/")
+	return nil
+}
+
+// readLegacyObject looks for the object of key under the legacy prefixes, in order, after it was not found under
+// its prefix. If migrate is set, a legacy object found is copied to where it belongs.
+func (gs *S3Storage) readLegacyObject(ctx context.Context, key string) ([]byte, minio.ObjectInfo, error) {
+	for _, prefix := range gs.legacyPrefixes {
+		name := key
+		if prefix != "" {
+			name = prefix + "/" + key
+		}
+		raw, oi, err := gs.readObject(ctx, name, minio.GetObjectOptions{})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil || !gs.migrateLegacy {
+			return raw, oi, err
+		}
+
+		info, err := gs.s3client.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: gs.bucket, Object: gs.objName(key), Encryption: gs.sse},
+			minio.CopySrcOptions{Bucket: gs.bucket, Object: name, Encryption: encrypt.SSE(gs.sse)},
+		)
+		if err != nil {
+			// The legacy object is still good to read
+			gs.logger.Warn("Migrating legacy object failed", "object", name, "to", gs.objName(key), "error", err)
+			return raw, oi, nil
+		}
+		gs.invalidateListings(key)
+		oi.ETag = info.ETag
+		return raw, oi, nil
+	}
+	return nil, minio.ObjectInfo{}, fs.ErrNotExist
+}
+
+// hasObjects reports whether there is at least one object under prefix.
+func (gs *S3Storage) hasObjects(ctx context.Context, prefix string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix + "/",
+		Recursive: true,
+		MaxKeys:   1,
+	}) {
+		return obj.Err == nil, obj.Err
+	}
+	return false, nil
+}
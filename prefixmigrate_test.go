@@ -0,0 +1,104 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPreviousObjPrefix(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	f := newFakeS3(t)
+	f.put("old/certificates/example.com/example.com.crt", []byte("cert"))
+	f.put("old/certificates/example.com/example.com.key", []byte("key"))
+	f.put("old/issue_cert_example.com.lock", []byte("lock"))
+
+	newTestStorage(t, f, S3Opts{ObjPrefix: "new", PreviousObjPrefix: "old"})
+	if !strings.Contains(logs.String(), "previous_prefix=old/") {
+		t.Errorf("no warning about the previous prefix in %q", logs.String())
+	}
+	if _, ok := f.get("new/certificates/example.com/example.com.crt"); ok {
+		t.Error("objects were migrated without MigratePreviousPrefix")
+	}
+
+	gs := newTestStorage(t, f, S3Opts{ObjPrefix: "new", PreviousObjPrefix: "old", MigratePreviousPrefix: true})
+	if buf, err := gs.Load(context.Background(), "certificates/example.com/example.com.key"); err != nil || string(buf) != "key" {
+		t.Errorf("migrated object can't be loaded: %q, %v", buf, err)
+	}
+	if _, ok := f.get("new/issue_cert_example.com.lock"); ok {
+		t.Error("lock file was migrated")
+	}
+	if _, ok := f.get("old/certificates/example.com/example.com.crt"); !ok {
+		t.Error("object under the previous prefix was removed")
+	}
+
+	// Once the new prefix is in use, the previous one is ignored
+	logs.Reset()
+	newTestStorage(t, f, S3Opts{ObjPrefix: "new", PreviousObjPrefix: "old"})
+	if strings.Contains(logs.String(), "previous_prefix") {
+		t.Errorf("unexpected warning %q", logs.String())
+	}
+}
+
+func TestPreviousObjPrefixIssuerPrefixes(t *testing.T) {
+	f := newFakeS3(t)
+	f.put("old/certificates/acme-a/a.example.com/a.example.com.crt", []byte("a"))
+	f.put("old/certificates/acme-b/b.example.com/b.example.com.crt", []byte("b"))
+
+	// Issuer keys are copied to their issuer's prefix, the others to ObjPrefix
+	opts := S3Opts{ObjPrefix: "new", IssuerPrefixes: map[string]string{"acme-a": "le"}, PreviousObjPrefix: "old", MigratePreviousPrefix: true}
+	newTestStorage(t, f, opts)
+	if _, ok := f.get("le/certificates/acme-a/a.example.com/a.example.com.crt"); !ok {
+		t.Error("issuer key was not copied to its prefix")
+	}
+	if _, ok := f.get("new/certificates/acme-b/b.example.com/b.example.com.crt"); !ok {
+		t.Error("key was not copied to ObjPrefix")
+	}
+
+	// Objects under an issuer prefix alone mean the prefixes are in use
+	f.remove("new/certificates/acme-b/b.example.com/b.example.com.crt")
+	newTestStorage(t, f, opts)
+	if _, ok := f.get("new/certificates/acme-b/b.example.com/b.example.com.crt"); ok {
+		t.Error("objects were copied although an issuer prefix is in use")
+	}
+}
+
+func TestLegacyPrefixes(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	f.put("certificates/example.com/example.com.crt", []byte("unprefixed"))
+	f.put("v1/certificates/example.com/example.com.key", []byte("v1"))
+
+	gs := newTestStorage(t, f, S3Opts{ObjPrefix: "v2", LegacyPrefixes: []string{"v1/", ""}})
+	if buf, err := gs.Load(ctx, "certificates/example.com/example.com.crt"); err != nil || string(buf) != "unprefixed" {
+		t.Errorf("object without prefix not found: %q, %v", buf, err)
+	}
+	if buf, err := gs.Load(ctx, "certificates/example.com/example.com.key"); err != nil || string(buf) != "v1" {
+		t.Errorf("object under legacy prefix not found: %q, %v", buf, err)
+	}
+	if _, ok := f.get("v2/certificates/example.com/example.com.key"); ok {
+		t.Error("object was migrated without MigrateLegacyObjects")
+	}
+	if _, err := gs.Load(ctx, "certificates/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	gs = newTestStorage(t, f, S3Opts{ObjPrefix: "v2", LegacyPrefixes: []string{"v1"}, MigrateLegacyObjects: true})
+	if buf, err := gs.Load(ctx, "certificates/example.com/example.com.key"); err != nil || string(buf) != "v1" {
+		t.Errorf("object under legacy prefix not found: %q, %v", buf, err)
+	}
+	if obj, ok := f.get("v2/certificates/example.com/example.com.key"); !ok || string(obj.data) != "v1" {
+		t.Error("object was not migrated")
+	}
+	if _, ok := f.get("v1/certificates/example.com/example.com.key"); !ok {
+		t.Error("legacy object was removed")
+	}
+}
@@ -0,0 +1,48 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// ErrPresignEncrypted is returned by PresignPut when client-side encryption is enabled.
+var ErrPresignEncrypted = errors.New("presigned uploads bypass client-side encryption and are not allowed with EncryptionKey set")
+
+// PresignGet returns a URL that allows downloading the object stored for key without credentials until expiry
+// has passed. The download bypasses this package entirely, so with EncryptionKey set the URL yields the
+// encrypted object. Only use it for cleartext storage or server-side encryption.
+func (gs *S3Storage) PresignGet(ctx context.Context, key string, expiry time.Duration) (_ *url.URL, err error) {
+	ctx, op := gs.startOp(ctx, "PresignGet", key)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return nil, err
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return nil, err
+	}
+	return gs.s3client.PresignedGetObject(ctx, gs.bucket, gs.objName(key), expiry, nil)
+}
+
+// PresignPut returns a URL that allows uploading the object for key without credentials until expiry has passed.
+// The upload bypasses this package entirely, so it would store unencrypted data; it is refused with
+// ErrPresignEncrypted if EncryptionKey is set. The cache is not updated either.
+func (gs *S3Storage) PresignPut(ctx context.Context, key string, expiry time.Duration) (_ *url.URL, err error) {
+	ctx, op := gs.startOp(ctx, "PresignPut", key)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return nil, err
+	}
+	iowrap, _ := gs.ioSchemes()
+	switch iowrap.(type) {
+	case *CleartextIO, *GzipIO:
+		// Uncompressed uploads are read as they are
+	default:
+		return nil, ErrPresignEncrypted
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return nil, err
+	}
+	return gs.s3client.PresignedPutObject(ctx, gs.bucket, gs.objName(key), expiry)
+}
@@ -0,0 +1,86 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPresignGet(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+
+	u, err := gs.PresignGet(context.Background(), "presign/cert", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("presigning failed: %v", err)
+	}
+	if u.Path != "/test-bucket/test/presign/cert" {
+		t.Errorf("unexpected path %s", u.Path)
+	}
+	q := u.Query()
+	if q.Get("X-Amz-Expires") != "300" {
+		t.Errorf("expected the URL to expire after 300 seconds, got %q", q.Get("X-Amz-Expires"))
+	}
+	if q.Get("X-Amz-Signature") == "" {
+		t.Error("URL is not signed")
+	}
+}
+
+func TestPresignPut(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ObjPrefix: "uploads"})
+
+	u, err := gs.PresignPut(context.Background(), "presign/cert", time.Minute)
+	if err != nil {
+		t.Fatalf("presigning failed: %v", err)
+	}
+	if u.Path != "/test-bucket/uploads/presign/cert" {
+		t.Errorf("unexpected path %s", u.Path)
+	}
+	if u.Query().Get("X-Amz-Expires") != "60" {
+		t.Errorf("expected the URL to expire after 60 seconds, got %q", u.Query().Get("X-Amz-Expires"))
+	}
+
+	gs = newTestStorage(t, f, S3Opts{EncryptionKey: []byte("12345678123456781234567812345678")})
+	if _, err := gs.PresignPut(context.Background(), "presign/cert", time.Minute); !errors.Is(err, ErrPresignEncrypted) {
+		t.Errorf("expected ErrPresignEncrypted, got %v", err)
+	}
+}
+
+func TestPresignGetGuards(t *testing.T) {
+	f := newFakeS3(t)
+	m := &recordingMetrics{}
+	gs := newTestStorage(t, f, S3Opts{Metrics: m})
+	ctx := context.Background()
+
+	_, _ = gs.PresignGet(ctx, "presign/cert", time.Minute)
+	_ = gs.Close()
+	if _, err := gs.PresignGet(ctx, "presign/cert", time.Minute); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	want := []string{"PresignGet:", "PresignGet:closed"}
+	if got := m.take(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestPresignPutGuards(t *testing.T) {
+	f := newFakeS3(t)
+	m := &recordingMetrics{}
+	gs := newTestStorage(t, f, S3Opts{Metrics: m})
+	ctx := context.Background()
+
+	_, _ = gs.PresignPut(ctx, "presign/cert", time.Minute)
+	_ = gs.Close()
+	if _, err := gs.PresignPut(ctx, "presign/cert", time.Minute); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	want := []string{"PresignPut:", "PresignPut:closed"}
+	if got := m.take(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,55 @@
+// Package prometheus exports the operation metrics of badger-s3 storages to Prometheus.
+package prometheus
+
+import (
+	"time"
+
+	badgers3 "github.com/diamondcdn/badger-s3"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements badgers3.Metrics with a histogram of the operation durations and a counter of the failed
+// operations by error class, see badgers3.ErrorClass. It is a prometheus.Collector, register it like any other.
+type Metrics struct {
+	durations *prom.HistogramVec
+	errors    *prom.CounterVec
+}
+
+var _ badgers3.Metrics = (*Metrics)(nil)
+
+// New returns Metrics named badger_s3_operation_duration_seconds and badger_s3_operation_errors_total, prefixed
+// by namespace if it isn't empty.
+func New(namespace string) *Metrics {
+	return &Metrics{
+		durations: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "badger_s3",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of storage operations, by operation.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"op"}),
+		errors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "badger_s3",
+			Name:      "operation_errors_total",
+			Help:      "Failed storage operations, by operation and error class.",
+		}, []string{"op", "class"}),
+	}
+}
+
+func (m *Metrics) ObserveOp(op string, dur time.Duration, err error) {
+	m.durations.WithLabelValues(op).Observe(dur.Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(op, badgers3.ErrorClass(err)).Inc()
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prom.Desc) {
+	m.durations.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prom.Metric) {
+	m.durations.Collect(ch)
+	m.errors.Collect(ch)
+}
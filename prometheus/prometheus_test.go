@@ -0,0 +1,39 @@
+package prometheus
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New("test")
+	reg := prom.NewPedanticRegistry()
+	if err := reg.Register(m); err != nil {
+		t.Fatalf("registering failed: %v", err)
+	}
+
+	m.ObserveOp("Load", 10*time.Millisecond, nil)
+	m.ObserveOp("Load", 20*time.Millisecond, fs.ErrNotExist)
+	m.ObserveOp("Store", 30*time.Millisecond, errors.New("boom"))
+
+	if n := testutil.CollectAndCount(m, "test_badger_s3_operation_duration_seconds"); n != 2 {
+		t.Errorf("expected histograms for 2 operations, got %d", n)
+	}
+	for _, tc := range []struct {
+		op, class string
+		want      float64
+	}{
+		{"Load", "not_found", 1},
+		{"Store", "other", 1},
+		{"Load", "other", 0},
+	} {
+		if got := testutil.ToFloat64(m.errors.WithLabelValues(tc.op, tc.class)); got != tc.want {
+			t.Errorf("%s %s: expected %v errors, got %v", tc.op, tc.class, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// ErrSwitchInProgress is returned by SwitchEncryption while a switch to a different IO has not completed yet.
+var ErrSwitchInProgress = errors.New("switching encryption is already in progress")
+
+// SwitchEncryption makes newIO the IO for all future writes and rewrites every object under the prefix with it.
+// Until it returns, objects written with either the previous or the new IO can be read. It returns once all objects
+// were rewritten, run it in a goroutine to do this in the background.
+// If it fails or ctx is cancelled, reads keep accepting both schemes and calling it again with the same newIO
+// resumes the switch, objects already rewritten are skipped.
+func (gs *S3Storage) SwitchEncryption(ctx context.Context, newIO IO) (err error) {
+	ctx, op := gs.startOp(ctx, "SwitchEncryption", "")
+	defer op.end(&err)
+	return gs.switchEncryption(ctx, newIO, SwitchOptions{})
+}
+
+// SwitchOptions control how SwitchEncryptionWith rewrites objects.
+type SwitchOptions struct {
+	// Concurrency is the number of objects rewritten at once, one by default
+	Concurrency int
+	// Progress, if set, is called after every object with the state of the switch. Calls never overlap.
+	Progress func(SwitchProgress)
+}
+
+// SwitchProgress is the state of a running switch.
+type SwitchProgress struct {
+	// Processed is the number of objects done so far, including the ones that failed
+	Processed int
+	// Total is the number of objects under the prefixes when the switch started
+	Total  int
+	Errors int
+}
+
+// SwitchEncryptionWith is SwitchEncryption with control over concurrency and progress reporting. Objects that
+// can't be rewritten don't stop the switch, they are reported once all others were tried.
+func (gs *S3Storage) SwitchEncryptionWith(ctx context.Context, newIO IO, opts SwitchOptions) (err error) {
+	ctx, op := gs.startOp(ctx, "SwitchEncryptionWith", "")
+	defer op.end(&err)
+	return gs.switchEncryption(ctx, newIO, opts)
+}
+
+func (gs *S3Storage) switchEncryption(ctx context.Context, newIO IO, opts SwitchOptions) error {
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return err
+	}
+
+	gs.ioMu.Lock()
+	switch {
+	case gs.prevIO == nil:
+		gs.prevIO, gs.iowrap = gs.iowrap, newIO
+	case !sameIO(gs.iowrap, newIO):
+		gs.ioMu.Unlock()
+		return ErrSwitchInProgress
+	}
+	gs.ioMu.Unlock()
+
+	if err := gs.reEncryptAll(gs.withRetryBudget(ctx), newIO, opts); err != nil {
+		return err
+	}
+
+	gs.ioMu.Lock()
+	gs.prevIO = nil
+	gs.ioMu.Unlock()
+	return nil
+}
+
+// reEncryptObject is an object to rewrite
+type reEncryptObject struct {
+	key string
+}
+
+// reEncryptAll rewrites all objects under the prefixes that were not written with newIO.
+func (gs *S3Storage) reEncryptAll(ctx context.Context, newIO IO, opts SwitchOptions) error {
+	objects, err := gs.reEncryptObjects(ctx)
+	if err != nil {
+		return err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		progress = SwitchProgress{Total: len(objects)}
+		firstErr error
+		queue    = make(chan reEncryptObject)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range queue {
+				err := gs.reEncrypt(ctx, obj.key, newIO)
+				if ctx.Err() != nil {
+					// Interrupted, the object is rewritten when the switch is resumed
+					continue
+				}
+
+				mu.Lock()
+				progress.Processed++
+				if err != nil {
+					progress.Errors++
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+				if opts.Progress != nil {
+					opts.Progress(progress)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, obj := range objects {
+		select {
+		case queue <- obj:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d objects could not be rewritten: %w", progress.Errors, progress.Total, firstErr)
+	}
+	return nil
+}
+
+// reEncryptObjects lists the objects under the prefixes that are subject to encryption.
+func (gs *S3Storage) reEncryptObjects(ctx context.Context) ([]reEncryptObject, error) {
+	var objects []reEncryptObject
+	for _, prefix := range gs.objPrefixes() {
+		for obj := range gs.s3client.ListObjects(ctx, gs.bucket, minio.ListObjectsOptions{
+			Prefix:    prefix + "/",
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				return nil, obj.Err
+			}
+			key := strings.TrimPrefix(obj.Key, prefix+"/")
+			// Objects of nested prefixes are handled with their own prefix
+			if gs.objName(key) != obj.Key {
+				continue
+			}
+			// Lock files and the write probe are never encrypted
+			if strings.HasSuffix(key, ".lock") || key == writeProbeKey {
+				continue
+			}
+			objects = append(objects, reEncryptObject{key: key})
+		}
+	}
+	return objects, nil
+}
+
+// reEncrypt rewrites the object stored for key with newIO, unless it was already written with it or changes while
+// it is rewritten.
+func (gs *S3Storage) reEncrypt(ctx context.Context, key string, newIO IO) error {
+	name := gs.objName(key)
+	raw, oi, err := gs.readObject(ctx, name, minio.GetObjectOptions{})
+	if errors.Is(err, fs.ErrNotExist) {
+		// Deleted in the meantime
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading %s failed: %w", name, err)
+	}
+
+	buf, scheme, err := gs.decodeScheme(ctx, key, raw, oi)
+	if err != nil {
+		return fmt.Errorf("decrypting %s failed: %w", name, err)
+	}
+	if sameIO(scheme, newIO) {
+		return nil
+	}
+
+	body, size, putOpts, err := gs.encodeObject(ctx, newIO, key, buf, oi.Metadata.Get("Content-Encoding"))
+	if err != nil {
+		return fmt.Errorf("encoding %s failed: %w", name, err)
+	}
+	// Don't overwrite a value stored while we were busy, it was already written with newIO
+	_, err = gs.s3client.PutObject(WithExtraHeaders(ctx, http.Header{"If-Match": {`"` + oi.ETag + `"`}}), gs.bucket, name, body, size, putOpts)
+	if code := minio.ToErrorResponse(err).StatusCode; code == http.StatusPreconditionFailed || code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("storing %s failed: %w", name, err)
+	}
+	return nil
+}
+
+// AuditEncryption lists the objects under the prefixes by the scheme they were written with, e.g. "secretbox",
+// without downloading them. Objects that don't record their scheme, because they were written by an older version
+// or with an IO implemented outside this package, are listed under the empty string.
+func (gs *S3Storage) AuditEncryption(ctx context.Context) (_ map[string][]string, err error) {
+	ctx, op := gs.startOp(ctx, "AuditEncryption", "")
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return nil, err
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return nil, err
+	}
+	objects, err := gs.reEncryptObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	schemes := map[string][]string{}
+	for _, obj := range objects {
+		oi, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(obj.key), gs.statOptions())
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			// Deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading metadata of %s failed: %w", gs.objName(obj.key), err)
+		}
+		scheme := oi.UserMetadata[schemeMetaKey]
+		schemes[scheme] = append(schemes[scheme], obj.key)
+	}
+	return schemes, nil
+}
@@ -0,0 +1,294 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestSwitchEncryption(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("switch/example%d.com/cert", i)
+		keys = append(keys, key)
+		if err := gs.Store(ctx, key, []byte("value-"+key)); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+	f.put("test/switch/example0.com/cert.lock", []byte("lock"))
+
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "0123456789abcdef0123456789abcdef")
+
+	// Reads must keep working while objects are rewritten
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			for _, key := range keys {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if buf, err := gs.loadFromS3(ctx, key); err != nil || string(buf) != "value-"+key {
+					t.Errorf("reading %s during the switch failed: %q, %v", key, buf, err)
+				}
+			}
+		}
+	}()
+
+	err := gs.SwitchEncryption(ctx, sb)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("switching encryption failed: %v", err)
+	}
+
+	for _, key := range keys {
+		obj, _ := f.get("test/" + key)
+		if bytes.Contains(obj.data, []byte("value-")) {
+			t.Errorf("%s is still stored in clear text", key)
+		}
+		buf, err := io.ReadAll(sb.WrapReader(bytes.NewReader(obj.data)))
+		if err != nil || string(buf) != "value-"+key {
+			t.Errorf("%s can't be decrypted with the new key: %q, %v", key, buf, err)
+		}
+	}
+	if obj, _ := f.get("test/switch/example0.com/cert.lock"); string(obj.data) != "lock" {
+		t.Error("lock file was rewritten")
+	}
+
+	// The old scheme is no longer accepted
+	if _, prev := gs.ioSchemes(); prev != nil {
+		t.Error("previous IO is still in use after the switch")
+	}
+	f.put("test/switch/plain", []byte("plain"))
+	if _, err := gs.loadFromS3(ctx, "switch/plain"); err == nil {
+		t.Error("clear text object was accepted after the switch")
+	}
+}
+
+func TestSwitchEncryptionConcurrentStore(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	f.put("test/switch/cert", []byte("old"))
+	// A Store goes through after the switch read the object, before it is rewritten
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if r.Method == http.MethodPut && key == "test/switch/cert" && r.Header.Get("If-Match") != "" {
+			f.put(key, []byte("new"))
+		}
+		return false
+	})
+
+	if err := gs.SwitchEncryption(context.Background(), &SecretBoxIO{}); err != nil {
+		t.Fatalf("switching encryption failed: %v", err)
+	}
+	if obj, _ := f.get("test/switch/cert"); string(obj.data) != "new" {
+		t.Errorf("the stored value was overwritten with %q", obj.data)
+	}
+}
+
+func TestSwitchEncryptionInProgress(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	sb := &SecretBoxIO{}
+
+	// A switch that failed half way
+	gs.ioMu.Lock()
+	gs.prevIO, gs.iowrap = gs.iowrap, sb
+	gs.ioMu.Unlock()
+
+	if err := gs.SwitchEncryption(context.Background(), &SecretBoxIO{SecretKey: [32]byte{1}}); !errors.Is(err, ErrSwitchInProgress) {
+		t.Errorf("expected ErrSwitchInProgress, got %v", err)
+	}
+	// The same scheme and key resume the switch, even without the same pointer
+	if err := gs.SwitchEncryption(context.Background(), &SecretBoxIO{}); err != nil {
+		t.Errorf("resuming the switch failed: %v", err)
+	}
+
+	// IOs that can't be compared with == are told apart without panicking
+	gs.ioMu.Lock()
+	gs.prevIO, gs.iowrap = gs.iowrap, uncomparableIO{}
+	gs.ioMu.Unlock()
+	if err := gs.SwitchEncryption(context.Background(), uncomparableIO{}); !errors.Is(err, ErrSwitchInProgress) {
+		t.Errorf("expected ErrSwitchInProgress, got %v", err)
+	}
+}
+
+// uncomparableIO is an IO implemented outside this package that panics when compared with ==
+type uncomparableIO struct {
+	tags []string
+}
+
+func (uncomparableIO) WrapReader(r io.Reader) io.Reader { return r }
+func (uncomparableIO) ByteReader(buf []byte) Reader {
+	return Reader{bytes.NewReader(buf), int64(len(buf)), nil}
+}
+
+func TestSwitchEncryptionMetadata(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{ChecksumAlgorithm: "SHA256"})
+	ctx := context.Background()
+	if err := gs.Store(ctx, "switch/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+
+	if err := gs.SwitchEncryption(ctx, &SecretBoxIO{}); err != nil {
+		t.Fatalf("switching encryption failed: %v", err)
+	}
+	obj, _ := f.get("test/switch/cert")
+	puts := f.recorded(http.MethodPut, "test/switch/cert")
+	if len(puts) != 2 || puts[1].Header.Get("X-Amz-Checksum-Sha256") != checksum("SHA256", obj.data) {
+		t.Errorf("the rewritten object has no checksum: %v", puts)
+	}
+	if obj.header.Get("X-Amz-Meta-"+schemeMetaKey) != "secretbox" {
+		t.Errorf("the rewritten object doesn't record its scheme: %v", obj.header)
+	}
+
+	// Encrypting would drop the Content-Encoding, the object is left alone like Store refuses it
+	plain := newTestStorage(t, f, S3Opts{ObjPrefix: "encoded"})
+	if err := plain.Store(WithContentEncoding(ctx, "gzip"), "switch/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if err := plain.SwitchEncryption(ctx, &SecretBoxIO{}); !errors.Is(err, ErrContentEncodingEncrypted) {
+		t.Errorf("expected ErrContentEncodingEncrypted, got %v", err)
+	}
+	if obj, _ := f.get("encoded/switch/cert"); string(obj.data) != "cert" || obj.header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("the encoded object was rewritten: %q, %v", obj.data, obj.header)
+	}
+}
+
+func TestSwitchEncryptionProgress(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 20; i++ {
+		if err := gs.Store(ctx, fmt.Sprintf("progress/example%d.com/cert", i), []byte("value")); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+	sb := &SecretBoxIO{}
+	copy(sb.SecretKey[:], "0123456789abcdef0123456789abcdef")
+	encrypted := func() int {
+		n := 0
+		for i := 0; i < 20; i++ {
+			obj, _ := f.get(fmt.Sprintf("test/progress/example%d.com/cert", i))
+			if _, err := io.ReadAll(sb.WrapReader(bytes.NewReader(obj.data))); err == nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	var last SwitchProgress
+	err := gs.SwitchEncryptionWith(ctx, sb, SwitchOptions{
+		Concurrency: 3,
+		Progress: func(p SwitchProgress) {
+			last = p
+			if p.Processed == 5 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the switch to be cancelled, got %v", err)
+	}
+	if last.Total != 20 || last.Processed < 5 || last.Processed >= 20 || last.Errors != 0 {
+		t.Errorf("unexpected progress %+v", last)
+	}
+	if n := encrypted(); n < last.Processed {
+		t.Errorf("%d objects reported as processed, but only %d were rewritten", last.Processed, n)
+	}
+
+	// Resuming rewrites the rest
+	if err := gs.SwitchEncryptionWith(context.Background(), sb, SwitchOptions{Concurrency: 4}); err != nil {
+		t.Fatalf("resuming the switch failed: %v", err)
+	}
+	if n := encrypted(); n != 20 {
+		t.Errorf("expected all 20 objects to be rewritten, got %d", n)
+	}
+}
+
+func TestSchemeMetadata(t *testing.T) {
+	f := newFakeS3(t)
+	enc := newTestStorage(t, f, S3Opts{EncryptionKey: []byte("12345678123456781234567812345678")})
+	plain := newTestStorage(t, f, S3Opts{})
+	ctx := context.Background()
+
+	if err := enc.Store(ctx, "scheme/enc", []byte("secret")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if err := plain.Store(ctx, "scheme/plain", []byte("plain")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	f.put("test/scheme/legacy", []byte("legacy"))
+
+	obj, _ := f.get("test/scheme/enc")
+	if got := obj.header.Get("X-Amz-Meta-Badger-S3-Scheme"); got != "secretbox" {
+		t.Errorf("expected scheme secretbox to be recorded, got %q", got)
+	}
+	if got := obj.header.Get("X-Amz-Meta-Badger-S3-Io-Version"); got != "1" {
+		t.Errorf("expected IO version 1 to be recorded, got %q", got)
+	}
+
+	// Without the metadata, cleartext would hand out the ciphertext
+	if buf, err := plain.loadFromS3(ctx, "scheme/enc"); err == nil {
+		t.Errorf("encrypted object was read as clear text: %q", buf)
+	}
+	if buf, err := enc.loadFromS3(ctx, "scheme/enc"); err != nil || string(buf) != "secret" {
+		t.Errorf("loading the encrypted object failed: %q, %v", buf, err)
+	}
+	// Objects without metadata are read as before
+	if buf, err := plain.loadFromS3(ctx, "scheme/legacy"); err != nil || string(buf) != "legacy" {
+		t.Errorf("loading the object without metadata failed: %q, %v", buf, err)
+	}
+
+	// While switching to cleartext, the metadata picks the decoder for each object
+	enc.ioMu.Lock()
+	enc.prevIO, enc.iowrap = enc.iowrap, &CleartextIO{}
+	enc.ioMu.Unlock()
+	for key, want := range map[string]string{"scheme/enc": "secret", "scheme/plain": "plain"} {
+		raw, oi, err := enc.readObject(ctx, enc.objName(key), minio.GetObjectOptions{})
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", key, err)
+		}
+		buf, scheme, err := enc.decodeScheme(context.Background(), key, raw, oi)
+		if err != nil || string(buf) != want {
+			t.Errorf("decoding %s failed: %q, %v", key, buf, err)
+		}
+		if _, ok := scheme.(*CleartextIO); ok != (key == "scheme/plain") {
+			t.Errorf("%s was decoded with %T", key, scheme)
+		}
+	}
+
+	audit, err := plain.AuditEncryption(ctx)
+	if err != nil {
+		t.Fatalf("audit failed: %v", err)
+	}
+	want := map[string][]string{
+		"secretbox": {"scheme/enc"},
+		"cleartext": {"scheme/plain"},
+		"":          {"scheme/legacy"},
+	}
+	if fmt.Sprint(audit) != fmt.Sprint(want) {
+		t.Errorf("expected audit %v, got %v", want, audit)
+	}
+}
@@ -0,0 +1,75 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrRetryBudgetExhausted is returned once the requests made with a context from WithRetryBudget failed more often
+// than the budget allows.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// retryBudgetError is what the transport fails requests with once the budget is used up. It also matches
+// context.Canceled, which makes minio give up on the request right away instead of retrying it.
+type retryBudgetError struct{}
+
+func (retryBudgetError) Error() string { return ErrRetryBudgetExhausted.Error() }
+
+func (retryBudgetError) Is(target error) bool {
+	return target == ErrRetryBudgetExhausted || target == context.Canceled
+}
+
+type retryBudgetKey struct{}
+
+type retryBudget struct {
+	remaining int32
+}
+
+// WithRetryBudget returns a context that bounds the retries of all S3 requests issued with it to n in total, no
+// matter how many calls they are spread across. Every failed attempt uses up one retry, once there are none left
+// further requests fail with ErrRetryBudgetExhausted. A budget already set on ctx is replaced.
+func WithRetryBudget(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{remaining: int32(n)})
+}
+
+// withRetryBudget applies the configured RetryBudget to operations made of many calls, unless the caller set
+// a budget already.
+func (gs *S3Storage) withRetryBudget(ctx context.Context) context.Context {
+	if gs.retryBudget <= 0 || ctx.Value(retryBudgetKey{}) != nil {
+		return ctx
+	}
+	return WithRetryBudget(ctx, gs.retryBudget)
+}
+
+// budgetTransport charges failed requests to the retry budget of their context.
+type budgetTransport struct {
+	base http.RoundTripper
+}
+
+func (bt *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	budget, ok := req.Context().Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return bt.base.RoundTrip(req)
+	}
+	if atomic.LoadInt32(&budget.remaining) < 0 {
+		return nil, retryBudgetError{}
+	}
+
+	resp, err := bt.base.RoundTrip(req)
+	if (err != nil && req.Context().Err() == nil) || (err == nil && retryableStatus(resp.StatusCode)) {
+		atomic.AddInt32(&budget.remaining, -1)
+	}
+	return resp, err
+}
+
+// retryableStatus reports whether minio retries a request that got the given status
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, 499, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestRetryBudget(t *testing.T) {
+	// Each call alone may be retried often enough to keep Lock busy until LockTimeout
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 3
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+	setLockTiming(t, time.Minute, 20*time.Millisecond, 10*time.Second)
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{RetryBudget: 2})
+	var failed int32
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key == "test/budget/cert.lock" {
+			atomic.AddInt32(&failed, 1)
+			writeFakeError(w, http.StatusInternalServerError, "InternalError")
+			return true
+		}
+		return false
+	})
+
+	start := time.Now()
+	if err := gs.Lock(context.Background(), "budget/cert"); !errors.Is(err, ErrRetryBudgetExhausted) {
+		t.Fatalf("expected ErrRetryBudgetExhausted, got %v", err)
+	}
+	// The first attempt and two retries
+	if n := atomic.LoadInt32(&failed); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("lock gave up only after %v", d)
+	}
+
+	// Any call can be given a budget
+	atomic.StoreInt32(&failed, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := gs.Stat(WithRetryBudget(ctx, 0), "budget/cert.lock"); !errors.Is(err, ErrRetryBudgetExhausted) {
+		t.Errorf("expected ErrRetryBudgetExhausted, got %v", err)
+	}
+	if n := atomic.LoadInt32(&failed); n != 1 {
+		t.Errorf("expected a single request without retries, got %d", n)
+	}
+}
@@ -0,0 +1,115 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// Tracer starts spans for storage operations, e.g. backed by OpenTelemetry with the adapter in the otel
+// subpackage. The span must be a child of the one in ctx, if any, and the returned context must carry it, so that
+// spans started further down nest below it.
+type Tracer interface {
+	Start(ctx context.Context, op string) (context.Context, Span)
+}
+
+// Span is a storage operation in progress.
+type Span interface {
+	// SetAttribute records a property of the operation. The storage sets string, bool and int64 values, but
+	// implementations must accept values of any type, e.g. by recording them formatted as text.
+	SetAttribute(key string, value interface{})
+	// End finishes the span with the error the operation returned, nil on success.
+	End(err error)
+}
+
+// The attributes set on spans. Bucket and key follow the OpenTelemetry semantic conventions for S3.
+const (
+	AttrBucket   = "aws.s3.bucket"
+	AttrKey      = "aws.s3.key"
+	AttrCacheHit = "badger_s3.cache_hit"
+	AttrBytes    = "badger_s3.bytes"
+)
+
+// noopTracer is used when S3Opts.Tracer is not set
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End(error)                        {}
+
+// operation is a storage operation being traced, measured and logged.
+type operation struct {
+	gs    *S3Storage
+	ctx   context.Context
+	name  string
+	key   string
+	start time.Time
+	span  Span
+	// cacheHit is set by recordCache if the operation looked at the cache
+	cacheHit *bool
+}
+
+type operationKey struct{}
+
+// startOp starts the operation name on key. The returned context carries its span, it must be used for everything
+// the operation does. The operation is finished with end.
+func (gs *S3Storage) startOp(ctx context.Context, name, key string) (context.Context, *operation) {
+	op := &operation{gs: gs, name: name, key: key, start: time.Now()}
+	ctx, op.span = gs.tracer.Start(ctx, name)
+	op.ctx = ctx
+	_, noop := op.span.(noopSpan)
+	if !noop {
+		op.span.SetAttribute(AttrBucket, gs.bucket)
+		op.span.SetAttribute(AttrKey, key)
+	}
+	// Only pay for the context value if someone is interested in the cache hit
+	if !noop || gs.logger.Enabled(ctx, slog.LevelDebug) {
+		ctx = context.WithValue(ctx, operationKey{}, op)
+	}
+	return ctx, op
+}
+
+// end reports the operation to the metrics hook, ends its span and logs it. It is meant to be deferred with a
+// pointer to the named error result, err is nil for operations that don't return one. Operations are logged at
+// debug level, failures other than a missing key as warnings.
+func (op *operation) end(err *error) {
+	var opErr error
+	if err != nil {
+		opErr = *err
+	}
+	dur := time.Since(op.start)
+	op.gs.metrics.ObserveOp(op.name, dur, opErr)
+	op.span.End(opErr)
+
+	level := slog.LevelDebug
+	if opErr != nil && !errors.Is(opErr, fs.ErrNotExist) {
+		level = slog.LevelWarn
+	}
+	if !op.gs.logger.Enabled(op.ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{slog.String("op", op.name), slog.String("key", op.key), slog.Duration("duration", dur)}
+	if op.cacheHit != nil {
+		attrs = append(attrs, slog.Bool("cache_hit", *op.cacheHit))
+	}
+	if opErr != nil {
+		attrs = append(attrs, slog.Any("error", opErr))
+	}
+	op.gs.logger.LogAttrs(op.ctx, level, "Storage operation", attrs...)
+}
+
+// recordCache counts a cache hit or miss and records it on the operation in ctx.
+func (gs *S3Storage) recordCache(ctx context.Context, hit bool) {
+	gs.cache.record(hit)
+	if op, ok := ctx.Value(operationKey{}).(*operation); ok {
+		op.cacheHit = &hit
+		op.span.SetAttribute(AttrCacheHit, hit)
+	}
+}
@@ -0,0 +1,107 @@
+package badgers3
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"testing"
+)
+
+// recordedSpan is a span finished by recordingTracer.
+type recordedSpan struct {
+	op     string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	err    error
+	tracer *recordingTracer
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+
+func (s *recordedSpan) End(err error) {
+	s.err = err
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// recordingTracer keeps the spans that ended in memory.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, op string) (context.Context, Span) {
+	s := &recordedSpan{op: op, attrs: map[string]interface{}{}, tracer: t}
+	s.parent, _ = ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	return context.WithValue(ctx, recordedSpanKey{}, s), s
+}
+
+func (t *recordingTracer) take() []*recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := t.spans
+	t.spans = nil
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	f := newFakeS3(t)
+	tracer := &recordingTracer{}
+	gs := newTestStorage(t, f, S3Opts{Tracer: tracer, CachePolicy: CacheTrustCache})
+
+	// The caller's span is the parent
+	ctx, caller := tracer.Start(context.Background(), "caller")
+	if err := gs.Store(ctx, "trace/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	_, _ = gs.Load(ctx, "trace/cert")
+	_, _ = gs.Load(ctx, "trace/missing")
+	_ = gs.Lock(ctx, "trace/cert")
+
+	spans := tracer.take()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+	for i, want := range []struct {
+		op       string
+		cacheHit interface{}
+		bytes    interface{}
+		err      error
+	}{
+		{"Store", nil, int64(4), nil},
+		{"Load", true, int64(4), nil},
+		{"Load", false, int64(0), fs.ErrNotExist},
+		{"Lock", nil, nil, nil},
+	} {
+		s := spans[i]
+		if s.op != want.op || s.parent != caller {
+			t.Errorf("span %d: expected %s below the caller's span, got %s below %v", i, want.op, s.op, s.parent)
+		}
+		if s.attrs[AttrBucket] != f.bucket || s.attrs[AttrKey] == nil {
+			t.Errorf("%s: missing bucket or key: %v", s.op, s.attrs)
+		}
+		if s.attrs[AttrCacheHit] != want.cacheHit || s.attrs[AttrBytes] != want.bytes {
+			t.Errorf("%s: expected cache hit %v and %v bytes, got %v", s.op, want.cacheHit, want.bytes, s.attrs)
+		}
+		if !errors.Is(s.err, want.err) {
+			t.Errorf("%s: expected error %v, got %v", s.op, want.err, s.err)
+		}
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	gs := newTestStorage(t, newFakeS3(t), S3Opts{})
+	ctx := context.Background()
+	opCtx, op := gs.startOp(ctx, "Load", "key")
+	if opCtx != ctx {
+		t.Error("the context was wrapped without a tracer")
+	}
+	if _, ok := op.span.(noopSpan); !ok {
+		t.Errorf("expected a no-op span, got %T", op.span)
+	}
+	op.end(nil)
+}
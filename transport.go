@@ -0,0 +1,162 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type extraHeadersKey struct{}
+
+// WithExtraHeaders returns a context that makes every S3 request issued with it carry the given headers,
+// in addition to the ones configured in S3Opts.ExtraHeaders. Per-call headers take precedence.
+// The headers are added after the request was signed, so X-Amz-* headers, which S3 requires to be signed, are
+// not supported and left out.
+func WithExtraHeaders(ctx context.Context, h http.Header) context.Context {
+	merged := http.Header{}
+	if prev, ok := ctx.Value(extraHeadersKey{}).(http.Header); ok {
+		merged = prev.Clone()
+	}
+	for k, v := range h {
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	return context.WithValue(ctx, extraHeadersKey{}, merged)
+}
+
+// signedHeader reports whether S3 requires the header k to be signed, which extra headers can't be.
+func signedHeader(k string) bool {
+	return strings.HasPrefix(http.CanonicalHeaderKey(k), "X-Amz-")
+}
+
+// headerTransport adds the configured and per-call extra headers to every outgoing request.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (ht *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	callHeaders, _ := req.Context().Value(extraHeadersKey{}).(http.Header)
+	if len(ht.headers) == 0 && len(callHeaders) == 0 {
+		return ht.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	for _, h := range []http.Header{ht.headers, callHeaders} {
+		for k, v := range h {
+			if !signedHeader(k) {
+				req.Header[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+	}
+	return ht.base.RoundTrip(req)
+}
+
+// MaxRetryAfter caps how long a throttled request waits for the delay asked for by the server's Retry-After header.
+var MaxRetryAfter = 30 * time.Second
+
+// retryAfterAttempts is the number of times a throttled request is sent again by retryAfterTransport before the
+// response is left to minio's retry.
+const retryAfterAttempts = 3
+
+// retryAfterTransport sends a request that was throttled again once the delay in the Retry-After header of the
+// response passed, instead of leaving it to minio's retry and its own backoff. The body is sent again from
+// GetBody, requests without one have their body buffered. It wraps the other transports, so that every attempt is
+// charged to the retry budget and counted by the circuit breaker. A delay that would pass the deadline of the
+// request is not waited for.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (rt *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	getBody := req.GetBody
+	if getBody == nil && req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		getBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		// A RoundTripper must not modify the request it was given
+		attemptReq := req
+		if getBody != nil && (attempt > 0 || req.GetBody == nil) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+		resp, err := rt.base.RoundTrip(attemptReq)
+		if err != nil || (resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests) || attempt == retryAfterAttempts {
+			return resp, err
+		}
+
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			return resp, nil
+		}
+		if delay > MaxRetryAfter {
+			delay = MaxRetryAfter
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			return resp, nil
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return resp, nil
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	at, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := at.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// slowOpTransport logs a warning for every request that takes longer than threshold.
+type slowOpTransport struct {
+	base      http.RoundTripper
+	threshold time.Duration
+	logger    *slog.Logger
+}
+
+func (st *slowOpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := st.base.RoundTrip(req)
+	if d := time.Since(start); d > st.threshold {
+		st.logger.Warn("Slow S3 request", "method", req.Method, "path", req.URL.Path, "duration", d.Round(time.Millisecond))
+	}
+	return resp, err
+}
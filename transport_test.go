@@ -0,0 +1,302 @@
+package badgers3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestRetryAfter(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	f.put("test/throttled/cert", []byte("cert"))
+
+	var throttled int32
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key != "test/throttled/cert" || !atomic.CompareAndSwapInt32(&throttled, 0, 1) {
+			return false
+		}
+		w.Header().Set("Retry-After", "2")
+		writeFakeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return true
+	})
+
+	start := time.Now()
+	buf, err := gs.Load(context.Background(), "throttled/cert")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if string(buf) != "cert" {
+		t.Errorf("expected cert, got %q", buf)
+	}
+	if d := time.Since(start); d < 2*time.Second || d > 4*time.Second {
+		t.Errorf("expected the retry to wait about 2s, took %v", d)
+	}
+}
+
+func TestRetryAfterWithoutBackoff(t *testing.T) {
+	// Without retries of its own, minio gives up on a throttled request right away
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	var throttled int32
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key != "test/throttled/cert" || atomic.AddInt32(&throttled, 1)%2 == 0 {
+			return false
+		}
+		w.Header().Set("Retry-After", "1")
+		writeFakeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return true
+	})
+
+	start := time.Now()
+	if err := gs.Store(context.Background(), "throttled/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if d := time.Since(start); d < time.Second || d > 1500*time.Millisecond {
+		t.Errorf("expected the retry to wait 1s, took %v", d)
+	}
+	if obj, ok := f.get("test/throttled/cert"); !ok || string(obj.data) != "cert" {
+		t.Error("the request body was not sent again")
+	}
+
+	start = time.Now()
+	if _, err := gs.loadFromS3(context.Background(), "throttled/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if d := time.Since(start); d < time.Second || d > 1500*time.Millisecond {
+		t.Errorf("expected the retry to wait 1s, took %v", d)
+	}
+}
+
+func TestRetryAfterGetBody(t *testing.T) {
+	f := newFakeS3(t)
+	var throttled int32
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if !atomic.CompareAndSwapInt32(&throttled, 0, 1) {
+			return false
+		}
+		w.Header().Set("Retry-After", "0")
+		writeFakeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return true
+	})
+
+	req, err := http.NewRequest(http.MethodPut, f.URL+"/test-bucket/test/throttled/cert", bytes.NewReader([]byte("cert")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	getBody := req.GetBody
+	var rewound int32
+	req.GetBody = func() (io.ReadCloser, error) {
+		atomic.AddInt32(&rewound, 1)
+		return getBody()
+	}
+
+	// The body is not buffered, the retry gets it from GetBody
+	rt := &retryAfterTransport{base: f.Client().Transport}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the retry to succeed, got %s", resp.Status)
+	}
+	if n := atomic.LoadInt32(&rewound); n != 1 {
+		t.Errorf("expected GetBody to be called once, got %d", n)
+	}
+	if obj, ok := f.get("test/throttled/cert"); !ok || string(obj.data) != "cert" {
+		t.Error("the request body was not sent again")
+	}
+}
+
+func TestRetryAfterCapped(t *testing.T) {
+	prev := MaxRetryAfter
+	MaxRetryAfter = 100 * time.Millisecond
+	t.Cleanup(func() { MaxRetryAfter = prev })
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	f.put("test/throttled/cert", []byte("cert"))
+	var throttled int32
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key != "test/throttled/cert" || !atomic.CompareAndSwapInt32(&throttled, 0, 1) {
+			return false
+		}
+		w.Header().Set("Retry-After", "3600")
+		writeFakeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return true
+	})
+
+	start := time.Now()
+	if _, err := gs.Load(context.Background(), "throttled/cert"); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Retry-After was not capped, took %v", d)
+	}
+}
+
+func TestRetryAfterCharged(t *testing.T) {
+	// One request per attempt of the transport keeps the requests countable
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{CircuitBreakerThreshold: retryAfterAttempts + 1, CircuitBreakerCooldown: time.Minute})
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		w.Header().Set("Retry-After", "0")
+		writeFakeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return true
+	})
+
+	// The first attempt and the one sent again use up the budget
+	ctx := WithRetryBudget(context.Background(), 1)
+	if err := gs.Store(ctx, "throttled/budget", []byte("cert")); !errors.Is(err, ErrRetryBudgetExhausted) {
+		t.Fatalf("expected ErrRetryBudgetExhausted, got %v", err)
+	}
+	if n := len(f.recorded(http.MethodPut, "test/throttled/budget")); n != 2 {
+		t.Errorf("expected 2 requests within the budget, got %d", n)
+	}
+
+	// Every attempt counts as a failure
+	if err := gs.Store(context.Background(), "throttled/breaker", []byte("cert")); err == nil {
+		t.Fatal("expected the store to fail")
+	}
+	if _, err := gs.Stat(context.Background(), "throttled/breaker"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+}
+
+func TestRetryAfterDeadline(t *testing.T) {
+	prevRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prevRetry })
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{})
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		w.Header().Set("Retry-After", "5")
+		writeFakeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := gs.Store(ctx, "throttled/cert", []byte("cert")); err == nil {
+		t.Fatal("expected the store to fail")
+	}
+	if n := len(f.recorded(http.MethodPut, "test/throttled/cert")); n != 1 {
+		t.Errorf("expected no request to be sent again past the deadline, got %d requests", n)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("expected the store to give up right away, took %v", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"5", 5 * time.Second, true},
+		{"0", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	} {
+		got, ok := parseRetryAfter(tc.value, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%q: expected %v, %v, got %v, %v", tc.value, tc.want, tc.ok, got, ok)
+		}
+	}
+}
+
+func TestSlowOpThreshold(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{SlowOpThreshold: 150 * time.Millisecond})
+	f.put("test/slow/cert", []byte("cert"))
+	f.put("test/fast/cert", []byte("cert"))
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		if key == "test/slow/cert" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return false
+	})
+
+	for _, key := range []string{"slow/cert", "fast/cert"} {
+		if _, err := gs.Stat(context.Background(), key); err != nil {
+			t.Fatalf("stat failed: %v", err)
+		}
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "Slow S3 request method=HEAD path=/test-bucket/test/slow/cert duration=") {
+		t.Errorf("no warning for the slow request in %q", out)
+	}
+	if strings.Contains(out, "fast/cert") {
+		t.Errorf("warning for the fast request in %q", out)
+	}
+}
+
+// recordingTransport records the paths of all requests it sends.
+type recordingTransport struct {
+	base  http.RoundTripper
+	paths []string
+	mu    sync.Mutex
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.paths = append(rt.paths, req.Method+" "+req.URL.Path)
+	rt.mu.Unlock()
+	return rt.base.RoundTrip(req)
+}
+
+func TestCustomTransport(t *testing.T) {
+	f := newFakeS3(t)
+	rt := &recordingTransport{base: f.Client().Transport}
+	gs := newTestStorage(t, f, S3Opts{Transport: rt, ExtraHeaders: http.Header{"X-Tenant": {"acme"}}})
+
+	if err := gs.Store(context.Background(), "transport/cert", []byte("cert")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	found := false
+	for _, p := range rt.paths {
+		found = found || p == "PUT /test-bucket/test/transport/cert"
+	}
+	if !found {
+		t.Errorf("store did not go through the transport, it saw %v", rt.paths)
+	}
+	// The package's own layers still apply
+	if puts := f.recorded(http.MethodPut, "test/transport/cert"); len(puts) != 1 || puts[0].Header.Get("X-Tenant") != "acme" {
+		t.Errorf("extra headers were not sent: %v", puts)
+	}
+}
@@ -0,0 +1,102 @@
+package badgers3
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// HealthCheck checks that S3 and the cache can be used, e.g. for a readiness probe. It looks the bucket up, or
+// an object if the storage was created with SkipBucketCheck, and writes and reads a cache entry. The returned
+// error names the first check that failed. Use a ctx with a deadline, S3 requests are retried until it passes.
+func (gs *S3Storage) HealthCheck(ctx context.Context) (err error) {
+	ctx, op := gs.startOp(ctx, "HealthCheck", "")
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return err
+	}
+
+	if gs.skipBucketCheck {
+		_, err := gs.s3client.StatObject(ctx, gs.bucket, gs.objName(writeProbeKey), gs.statOptions())
+		if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return fmt.Errorf("checking S3 bucket %s failed: %w", gs.bucket, err)
+		}
+	} else {
+		ok, err := gs.s3client.BucketExists(ctx, gs.bucket)
+		if err != nil {
+			return fmt.Errorf("checking S3 bucket %s failed: %w", gs.bucket, err)
+		}
+		if !ok {
+			return fmt.Errorf("S3 bucket %s does not exist", gs.bucket)
+		}
+	}
+
+	if err := gs.cache.check(ctx); err != nil {
+		return fmt.Errorf("checking cache failed: %w", err)
+	}
+	return nil
+}
+
+// VerifyKey checks that the object stored for key is intact: it is fetched from S3 (bypassing the cache) and
+// decrypted. Certificates (.crt) and private keys (.key) are also parsed. The returned error names the first
+// step that failed.
+func (gs *S3Storage) VerifyKey(ctx context.Context, key string) (err error) {
+	ctx, op := gs.startOp(ctx, "VerifyKey", key)
+	defer op.end(&err)
+	if err := gs.checkClosed(); err != nil {
+		return err
+	}
+	if err := gs.checkCircuit(); err != nil {
+		return err
+	}
+	raw, oi, err := gs.readObject(ctx, gs.objName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("loading %s failed: %w", key, err)
+	}
+
+	buf, err := gs.decode(ctx, key, raw, oi)
+	if err != nil {
+		return fmt.Errorf("decrypting %s failed: %w", key, err)
+	}
+
+	switch {
+	case strings.HasSuffix(key, ".crt"):
+		return verifyCertificates(key, buf)
+	case strings.HasSuffix(key, ".key"):
+		if _, err := certmagic.PEMDecodePrivateKey(buf); err != nil {
+			return fmt.Errorf("parsing private key %s failed: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// verifyCertificates checks that buf is a PEM encoded chain of certificates.
+func verifyCertificates(key string, buf []byte) error {
+	var count int
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("parsing certificate %s failed: unexpected PEM block %q", key, block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("parsing certificate %s failed: %w", key, err)
+		}
+		count++
+	}
+	if count == 0 {
+		return fmt.Errorf("parsing certificate %s failed: no PEM encoded certificate found", key)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package badgers3
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// testCertificate returns a PEM encoded self-signed certificate and its private key.
+func testCertificate(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := certmagic.PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
+
+func TestVerifyKey(t *testing.T) {
+	f := newFakeS3(t)
+	gs := newTestStorage(t, f, S3Opts{EncryptionKey: []byte("12345678123456781234567812345678")})
+	ctx := context.Background()
+	certPEM, keyPEM := testCertificate(t)
+
+	for key, value := range map[string][]byte{
+		"verify/example.com.crt":  certPEM,
+		"verify/example.com.key":  keyPEM,
+		"verify/example.com.json": []byte(`{}`),
+		"verify/truncated.crt":    certPEM,
+		"verify/garbage.crt":      []byte("not a certificate"),
+	} {
+		if err := gs.Store(ctx, key, value); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+	obj, _ := f.get("test/verify/truncated.crt")
+	f.put("test/verify/truncated.crt", obj.data[:len(obj.data)/2])
+
+	for key, wantErr := range map[string]string{
+		"verify/example.com.crt":  "",
+		"verify/example.com.key":  "",
+		"verify/example.com.json": "",
+		"verify/truncated.crt":    "decrypting",
+		"verify/garbage.crt":      "parsing certificate",
+		"verify/missing.crt":      "loading",
+	} {
+		err := gs.VerifyKey(ctx, key)
+		switch {
+		case wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", key, err)
+		case wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)):
+			t.Errorf("%s: expected a %q error, got %v", key, wantErr, err)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+
+	db := newTestCacheDB(t)
+	gs := newTestStorage(t, f, S3Opts{CacheDB: db})
+	if err := gs.HealthCheck(ctx); err != nil {
+		t.Fatalf("health check failed: %v", err)
+	}
+	probe := newTestStorage(t, f, S3Opts{SkipBucketCheck: true})
+	if err := probe.HealthCheck(ctx); err != nil {
+		t.Fatalf("health check without bucket check failed: %v", err)
+	}
+	if n := len(f.recorded(http.MethodHead, "test/"+writeProbeKey)); n != 1 {
+		t.Errorf("expected the probe object to be looked up once, got %d", n)
+	}
+
+	// S3 refuses access
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		writeFakeError(w, http.StatusForbidden, "AccessDenied")
+		return true
+	})
+	for _, s := range []*S3Storage{gs, probe} {
+		if err := s.HealthCheck(ctx); err == nil || !strings.Contains(err.Error(), "checking S3 bucket") {
+			t.Errorf("expected S3 to be reported, got %v", err)
+		}
+	}
+
+	// S3 hangs, the deadline is respected
+	f.setHook(func(w http.ResponseWriter, r *http.Request, key string) bool {
+		<-r.Context().Done()
+		return true
+	})
+	deadline, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := gs.HealthCheck(deadline); err == nil {
+		t.Error("health check passed while S3 hangs")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("health check returned after %v", elapsed)
+	}
+	f.setHook(nil)
+
+	// The cache is gone
+	_ = db.Close()
+	if err := gs.HealthCheck(ctx); err == nil || !strings.Contains(err.Error(), "checking cache") {
+		t.Errorf("expected the cache to be reported, got %v", err)
+	}
+}